@@ -28,18 +28,41 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/trace"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
+	"unsafe"
 )
 
 // ANSI color codes
@@ -52,9 +75,8 @@ const (
 
 // We always assume an 80×24 terminal.
 const (
-	DefaultCols  = 80
-	DefaultRows  = 24
-	MaxTransfers = 50
+	DefaultCols = 80
+	DefaultRows = 24
 )
 
 // We'll allow a fullscreen mode but always default to 80×24.
@@ -64,6 +86,18 @@ var (
 	terminalRows = DefaultRows
 )
 
+// What reaches the system for devices, filesystems and opening files goes
+// through these, so that tests can stand in for what the test machine
+// doesn't have
+var (
+	openFile        = os.OpenFile      // openInput and outFile
+	alignSectorSize = sectorSize       // checkAlignment
+	optimalIOSizeOf = optimalIOSize    // bs=auto
+	deviceSizeOf    = deviceSize       // the size of a disk input
+	fsFreeOf        = fsFree           // -checkSpace
+	deviceInfoOf    = lookupDeviceInfo // -deviceInfo
+)
+
 // bitClearAndSet is used for conv=, oflag= mappings
 type bitClearAndSet struct {
 	clear int
@@ -73,26 +107,203 @@ type bitClearAndSet struct {
 // convMap, flagMap define possible conv=, oflag= values
 var convMap = map[string]bitClearAndSet{
 	"notrunc": {clear: os.O_TRUNC},
+	"nocreat": {clear: os.O_CREATE},
+	"excl":    {set: os.O_EXCL},
+	// fullalloc, sync and the data conversions have no open flags; see
+	// hasOption
+	"fullalloc": {},
+	"sync":      {},
+	"noerror":   {},
+	"fsync":     {},
+	"fdatasync": {},
+	"sparse":    {},
+	"ascii":     {},
+	"ebcdic":    {},
+	"ibm":       {},
+	"lcase":     {},
+	"ucase":     {},
+	"swab":      {},
+}
+
+// charsetTables maps the conv= character set translations to their tables
+var charsetTables = map[string]*[256]byte{
+	"ascii":  &ebcdicToASCII,
+	"ebcdic": &asciiToEBCDIC,
+	"ibm":    &asciiToIBM,
+}
+
+// ebcdicToASCII is conv=ascii, the EBCDIC to ASCII table of GNU dd
+var ebcdicToASCII = [256]byte{
+	0x00, 0x01, 0x02, 0x03, 0x9c, 0x09, 0x86, 0x7f,
+	0x97, 0x8d, 0x8e, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x9d, 0x85, 0x08, 0x87,
+	0x18, 0x19, 0x92, 0x8f, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x80, 0x81, 0x82, 0x83, 0x84, 0x0a, 0x17, 0x1b,
+	0x88, 0x89, 0x8a, 0x8b, 0x8c, 0x05, 0x06, 0x07,
+	0x90, 0x91, 0x16, 0x93, 0x94, 0x95, 0x96, 0x04,
+	0x98, 0x99, 0x9a, 0x9b, 0x14, 0x15, 0x9e, 0x1a,
+	0x20, 0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6,
+	0xa7, 0xa8, 0xd5, 0x2e, 0x3c, 0x28, 0x2b, 0x7c,
+	0x26, 0xa9, 0xaa, 0xab, 0xac, 0xad, 0xae, 0xaf,
+	0xb0, 0xb1, 0x21, 0x24, 0x2a, 0x29, 0x3b, 0x7e,
+	0x2d, 0x2f, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7,
+	0xb8, 0xb9, 0xcb, 0x2c, 0x25, 0x5f, 0x3e, 0x3f,
+	0xba, 0xbb, 0xbc, 0xbd, 0xbe, 0xbf, 0xc0, 0xc1,
+	0xc2, 0x60, 0x3a, 0x23, 0x40, 0x27, 0x3d, 0x22,
+	0xc3, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67,
+	0x68, 0x69, 0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9,
+	0xca, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70,
+	0x71, 0x72, 0x5e, 0xcc, 0xcd, 0xce, 0xcf, 0xd0,
+	0xd1, 0xe5, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+	0x79, 0x7a, 0xd2, 0xd3, 0xd4, 0x5b, 0xd6, 0xd7,
+	0xd8, 0xd9, 0xda, 0xdb, 0xdc, 0xdd, 0xde, 0xdf,
+	0xe0, 0xe1, 0xe2, 0xe3, 0xe4, 0x5d, 0xe6, 0xe7,
+	0x7b, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47,
+	0x48, 0x49, 0xe8, 0xe9, 0xea, 0xeb, 0xec, 0xed,
+	0x7d, 0x4a, 0x4b, 0x4c, 0x4d, 0x4e, 0x4f, 0x50,
+	0x51, 0x52, 0xee, 0xef, 0xf0, 0xf1, 0xf2, 0xf3,
+	0x5c, 0x9f, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+	0x59, 0x5a, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9,
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+	0x38, 0x39, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff,
+}
+
+// asciiToEBCDIC is conv=ebcdic, GNU dd's ASCII to EBCDIC table
+var asciiToEBCDIC = [256]byte{
+	0x00, 0x01, 0x02, 0x03, 0x37, 0x2d, 0x2e, 0x2f,
+	0x16, 0x05, 0x25, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x3c, 0x3d, 0x32, 0x26,
+	0x18, 0x19, 0x3f, 0x27, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x40, 0x5a, 0x7f, 0x7b, 0x5b, 0x6c, 0x50, 0x7d,
+	0x4d, 0x5d, 0x5c, 0x4e, 0x6b, 0x60, 0x4b, 0x61,
+	0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7,
+	0xf8, 0xf9, 0x7a, 0x5e, 0x4c, 0x7e, 0x6e, 0x6f,
+	0x7c, 0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xc7,
+	0xc8, 0xc9, 0xd1, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6,
+	0xd7, 0xd8, 0xd9, 0xe2, 0xe3, 0xe4, 0xe5, 0xe6,
+	0xe7, 0xe8, 0xe9, 0xad, 0xe0, 0xbd, 0x9a, 0x6d,
+	0x79, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+	0x88, 0x89, 0x91, 0x92, 0x93, 0x94, 0x95, 0x96,
+	0x97, 0x98, 0x99, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6,
+	0xa7, 0xa8, 0xa9, 0xc0, 0x4f, 0xd0, 0x5f, 0x07,
+	0x20, 0x21, 0x22, 0x23, 0x24, 0x15, 0x06, 0x17,
+	0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x09, 0x0a, 0x1b,
+	0x30, 0x31, 0x1a, 0x33, 0x34, 0x35, 0x36, 0x08,
+	0x38, 0x39, 0x3a, 0x3b, 0x04, 0x14, 0x3e, 0xe1,
+	0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+	0x49, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57,
+	0x58, 0x59, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67,
+	0x68, 0x69, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75,
+	0x76, 0x77, 0x78, 0x80, 0x8a, 0x8b, 0x8c, 0x8d,
+	0x8e, 0x8f, 0x90, 0x6a, 0x9b, 0x9c, 0x9d, 0x9e,
+	0x9f, 0xa0, 0xaa, 0xab, 0xac, 0x4a, 0xae, 0xaf,
+	0xb0, 0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7,
+	0xb8, 0xb9, 0xba, 0xbb, 0xbc, 0xa1, 0xbe, 0xbf,
+	0xca, 0xcb, 0xcc, 0xcd, 0xce, 0xcf, 0xda, 0xdb,
+	0xdc, 0xdd, 0xde, 0xdf, 0xea, 0xeb, 0xec, 0xed,
+	0xee, 0xef, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff,
+}
+
+// asciiToIBM is conv=ibm, GNU dd's alternate ASCII to EBCDIC table
+var asciiToIBM = [256]byte{
+	0x00, 0x01, 0x02, 0x03, 0x37, 0x2d, 0x2e, 0x2f,
+	0x16, 0x05, 0x25, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x3c, 0x3d, 0x32, 0x26,
+	0x18, 0x19, 0x3f, 0x27, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x40, 0x5a, 0x7f, 0x7b, 0x5b, 0x6c, 0x50, 0x7d,
+	0x4d, 0x5d, 0x5c, 0x4e, 0x6b, 0x60, 0x4b, 0x61,
+	0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7,
+	0xf8, 0xf9, 0x7a, 0x5e, 0x4c, 0x7e, 0x6e, 0x6f,
+	0x7c, 0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xc7,
+	0xc8, 0xc9, 0xd1, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6,
+	0xd7, 0xd8, 0xd9, 0xe2, 0xe3, 0xe4, 0xe5, 0xe6,
+	0xe7, 0xe8, 0xe9, 0xad, 0xe0, 0xbd, 0x5f, 0x6d,
+	0x79, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+	0x88, 0x89, 0x91, 0x92, 0x93, 0x94, 0x95, 0x96,
+	0x97, 0x98, 0x99, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6,
+	0xa7, 0xa8, 0xa9, 0xc0, 0x4f, 0xd0, 0xa1, 0x07,
+	0x20, 0x21, 0x22, 0x23, 0x24, 0x15, 0x06, 0x17,
+	0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x09, 0x0a, 0x1b,
+	0x30, 0x31, 0x1a, 0x33, 0x34, 0x35, 0x36, 0x08,
+	0x38, 0x39, 0x3a, 0x3b, 0x04, 0x14, 0x3e, 0xe1,
+	0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+	0x49, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57,
+	0x58, 0x59, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67,
+	0x68, 0x69, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75,
+	0x76, 0x77, 0x78, 0x80, 0x8a, 0x8b, 0x8c, 0x8d,
+	0x8e, 0x8f, 0x90, 0x9a, 0x9b, 0x9c, 0x9d, 0x9e,
+	0x9f, 0xa0, 0xaa, 0xab, 0xac, 0xad, 0xae, 0xaf,
+	0xb0, 0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7,
+	0xb8, 0xb9, 0xba, 0xbb, 0xbc, 0xbd, 0xbe, 0xbf,
+	0xca, 0xcb, 0xcc, 0xcd, 0xce, 0xcf, 0xda, 0xdb,
+	0xdc, 0xdd, 0xde, 0xdf, 0xea, 0xeb, 0xec, 0xed,
+	0xee, 0xef, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff,
 }
 
 var flagMap = map[string]bitClearAndSet{
 	"sync": {set: os.O_SYNC},
+	// append writes at the end of the existing output, never truncating it
+	"append": {clear: os.O_TRUNC, set: os.O_APPEND},
+	"direct": {set: oDirect},
+	// padwrites and seek_bytes have no open flags; see hasOption
+	"padwrites":  {},
+	"seek_bytes": {},
+}
+
+var allowedFlags = os.O_TRUNC | os.O_SYNC | os.O_CREATE | os.O_EXCL | os.O_APPEND | oDirect
+
+// directAlign is the alignment of dd()'s buffer, enough for O_DIRECT
+// on both 512-byte and 4K sector devices
+const directAlign = 4096
+
+// iflagMap defines possible iflag= values
+var iflagMap = map[string]bitClearAndSet{
+	"noatime": {set: oNoatime},
+	"direct":  {set: oDirect},
+	// not open flags: a short or empty read ends the input, short
+	// reads are put together into whole blocks, or skip and count are
+	// in bytes
+	"eof-on-short": {},
+	"fullblock":    {},
+	"skip_bytes":   {},
+	"count_bytes":  {},
 }
 
-var allowedFlags = os.O_TRUNC | os.O_SYNC
+var allowedInFlags = oNoatime | oDirect
 
 // Transfer holds parameters for one dd operation
 type Transfer struct {
+	Index          int
 	InputFilename  string
 	OutputFilename string
+	// Name, from nameN, labels the transfer in the display and summary
+	Name string
 
+	// Bs is the input block size; Obs, if set, is a different output
+	// block size that writes are re-blocked to
 	Bs    int64
+	Obs   int64
 	Count int64
 	Size  int64
 	Skip  int64
 	Seek  int64
 	Conv  string
 	Oflag int
+	Iflag int
+
+	// SkipOff and SeekOff are Skip and Seek in bytes
+	SkipOff int64
+	SeekOff int64
+
+	// raw oflag=/iflag= lists, for options that aren't open flags
+	OflagStr string
+	IflagStr string
+
+	// InputEncoding is "hex" or "base64" to decode text input, and
+	// OutputEncoding the same for the output, wrapped every OutputWrap chars
+	InputEncoding  string
+	OutputEncoding string
+	OutputWrap     int
 
 	Total       int64
 	Transferred int64
@@ -101,11 +312,192 @@ type Transfer struct {
 	EndTime   time.Time
 	Mutex     sync.Mutex
 	Finished  bool
+	Err       error
+
+	// Atomic writes a regular-file output under a temporary name and
+	// renames it into place only once the transfer (and verify) succeeded;
+	// KeepPartial keeps the temporary file when it fails
+	Atomic      bool
+	KeepPartial bool
+
+	// Resume continues from the end of an existing output; Resumed is
+	// how many bytes were already there. With ResumeVerify only whole
+	// blocks that match the input are kept; on a mismatch the copy
+	// restarts, or fails with ResumeFailOnMismatch.
+	Resume               bool
+	Resumed              int64
+	ResumeVerify         bool
+	ResumeFailOnMismatch bool
+	// Checkpointed is where a -resume checkpoint file says the copy got
+	// to, for outputs such as devices whose size doesn't tell
+	Checkpointed   int64
+	FromCheckpoint bool
+
+	// Until, if set, ends the input where this byte sequence first
+	// appears, after it with UntilInclusive
+	Until          []byte
+	UntilInclusive bool
+
+	// Partition, if set, limits the input to that partition of its MBR or
+	// GPT; skip and count then apply within the partition
+	Partition int
+
+	// HashAlg computes a digest of the data while it is copied, reported
+	// in Digest and compared with Expect if that is set
+	HashAlg string
+	Expect  string
+	Digest  string
+
+	// AppendChecksum writes a trailer with the digest and length of the
+	// data after it; VerifyAppended reads such a trailer from the end of
+	// the input, copies only the data before it and checks its digest
+	AppendChecksum bool
+	VerifyAppended bool
+
+	// Sparse (conv=sparse) seeks over all-zero blocks of a regular-file
+	// output instead of writing them; Holes counts the bytes skipped
+	Sparse bool
+	Holes  int64
+
+	// conv=fsync and conv=fdatasync flush the output to its device at
+	// the end of the copy, from SyncStart to SyncEnd
+	SyncStart time.Time
+	SyncEnd   time.Time
+
+	// Verify reads the output back after the copy; that pass is timed
+	// on its own and counts its progress in Verified
+	Verify      bool
+	VerifyBs    int64
+	Verified    int64
+	VerifyStart time.Time
+	VerifyEnd   time.Time
+
+	// SampleFraction, if set, compares that fraction of the blocks of
+	// input and output after the copy, chosen randomly from SampleSeed.
+	// Sampled counts the blocks compared and Mismatches the output
+	// offsets of those that differed.
+	SampleFraction float64
+	SampleSeed     int64
+	Sampled        int64
+	Mismatches     []int64
+
+	// Warmup excludes the start of the copy from the steady-state rate
+	// in the summary: WarmupBytes had been copied at WarmupEnd, which
+	// stays zero if the copy finished sooner
+	Warmup      time.Duration
+	WarmupBytes int64
+	WarmupEnd   time.Time
+
+	// Retries is how many times a transfer that fails reading its input
+	// starts over, waiting RetryBackoff, doubled per retry, at most
+	// MaxBackoff, with jitter from RetrySeed
+	Retries      int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	RetrySeed    int64
+
+	// Paused is how long the transfer was held back by -maxLoad
+	Paused time.Duration
+
+	// With conv=noerror, a block that can't be read is tried ReadRetries
+	// more times and then skipped (zero-filled with conv=sync); BadBlocks
+	// counts the blocks skipped
+	ReadRetries int
+	BadBlocks   int64
+	// MapFile (mapN) records, in ddrescue's mapfile format, which input
+	// ranges were read (+) and which couldn't be (-)
+	MapFile string
+	// Rescue (rescueN) re-reads only the ranges MapFile marks unreadable,
+	// in ever smaller blocks, and writes what it recovers into the
+	// existing output; what stays unreadable is overwritten with
+	// RescueFill, if set. Unreadable is how much that was.
+	Rescue     bool
+	RescueFill []byte
+	Unreadable int64
+
+	// NullIO replaces the input and output with in-memory no-ops
+	NullIO bool
+
+	// BwLimit (bwlimitN) caps the copy at this many bytes per second
+	BwLimit int64
+	// IopsLimit (iopslimitN) caps the reads per second
+	IopsLimit int
+	// Sched is the I/O and CPU priority of the transfer's thread
+	// (ioclassN, ioprioN, niceN or their global defaults; Linux)
+	Sched schedPrio
+	// Weight (weightN) is the transfer's share of -bwlimitTotal relative
+	// to the other running transfers
+	Weight int
+	// bwTotal, with -bwlimitTotal, is the limiter all transfers share
+	bwTotal *sharedLimiter
+
+	// limiter caps how much is read from the input; see SetLimit
+	limiter *limitReader
+	// written checksums what was written, for Verify
+	written *checksumWriter
+	// writePath is where the output is actually written: OutputFilename,
+	// or its temporary name with Atomic
+	writePath string
+	// followStop, when set, makes a regular-file input follow its growth
+	// until the channel is closed
+	followStop <-chan struct{}
+	// ctx is canceled to stop the transfer early
+	ctx context.Context
+	// recording, with -record, logs every read and write dd() makes
+	recording *transferTrace
+	// moved gets a value, if it has room, when the first bytes are
+	// written, so the progress display can show them right away
+	moved chan<- struct{}
+	// rates, with -finalChart, is the copy rate in MB/s sampled every
+	// chartInterval
+	rates []float64
+	// gate, with -maxLoad, holds reads back while the system is busy
+	gate *loadGate
+	// shared, with -shareSource, is the input read once for this and
+	// the other transfers copying the same data
+	shared *sharedSource
+	// After lists the transfers (afterN) that must finish successfully
+	// before this one starts; deps are those transfers
+	After []int
+	deps  []*Transfer
+	// disks, with -perDevice, are the physical disks of the input and
+	// output
+	disks []uint64
+	// Phase (phaseN) groups transfers that run together; each phase
+	// starts once the one before it has finished successfully
+	Phase string
+	// Prio (prioN) orders the transfers waiting for a slot: the highest
+	// starts first, and equal ones in order
+	Prio int
+	// Delay (delayN) holds the transfer back for this long after the
+	// copying begins; notBefore is when it may start
+	Delay     time.Duration
+	notBefore time.Time
 }
 
-// parseConvOflag interprets conv=, oflag= strings
+// parseConvOflag interprets conv=, oflag= strings. Like dd, outputs are
+// created if missing unless conv=nocreat is given, and truncated unless
+// conv=notrunc is given.
 func parseConvOflag(convStr, oflagStr string) (int, error) {
-	flags := 0
+	flags := os.O_TRUNC | os.O_CREATE
+	n := 0
+	for name := range charsetTables {
+		if hasOption(convStr, name) {
+			n++
+		}
+	}
+	if n > 1 {
+		return 0, fmt.Errorf("conv=ascii, ebcdic and ibm are mutually exclusive")
+	}
+	if hasOption(convStr, "fullalloc") && hasOption(convStr, "sparse") {
+		return 0, fmt.Errorf("conv=fullalloc and sparse are mutually exclusive")
+	}
+	if hasOption(convStr, "nocreat") && hasOption(convStr, "excl") {
+		return 0, fmt.Errorf("conv=nocreat and excl are mutually exclusive")
+	}
+	if hasOption(convStr, "lcase") && hasOption(convStr, "ucase") {
+		return 0, fmt.Errorf("conv=lcase and ucase are mutually exclusive")
+	}
 	if convStr != "none" {
 		for _, c := range strings.Split(convStr, ",") {
 			if v, ok := convMap[c]; ok {
@@ -129,6 +521,81 @@ func parseConvOflag(convStr, oflagStr string) (int, error) {
 	return flags, nil
 }
 
+// charsetTable returns the translation table conv asks for, or nil. Case
+// conversion is folded into it; like GNU dd, it applies to the ASCII side,
+// after conv=ascii and before conv=ebcdic or ibm.
+func charsetTable(conv string) *[256]byte {
+	var charset *[256]byte
+	for name, t := range charsetTables {
+		if hasOption(conv, name) {
+			charset = t
+		}
+	}
+	var lo, hi byte
+	switch {
+	case hasOption(conv, "lcase"):
+		lo, hi = 'A', 'Z'
+	case hasOption(conv, "ucase"):
+		lo, hi = 'a', 'z'
+	default:
+		return charset
+	}
+	changeCase := func(b byte) byte {
+		if b >= lo && b <= hi {
+			return b ^ 0x20
+		}
+		return b
+	}
+	var table [256]byte
+	for i := range table {
+		b := byte(i)
+		switch charset {
+		case nil:
+			b = changeCase(b)
+		case &ebcdicToASCII:
+			b = changeCase(charset[b])
+		default:
+			b = charset[changeCase(b)]
+		}
+		table[i] = b
+	}
+	return &table
+}
+
+// changesData reports whether conv makes the output differ from the input
+func changesData(conv string) bool {
+	return charsetTable(conv) != nil || hasOption(conv, "sync") || hasOption(conv, "swab")
+}
+
+// hasOption reports whether a conv=, oflag= or iflag= list contains name
+func hasOption(list, name string) bool {
+	for _, c := range strings.Split(list, ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIflag interprets iflag= strings
+func parseIflag(iflagStr string) (int, error) {
+	flags := 0
+	if hasOption(iflagStr, "eof-on-short") && hasOption(iflagStr, "fullblock") {
+		return 0, fmt.Errorf("iflag=eof-on-short and fullblock are mutually exclusive")
+	}
+	if iflagStr != "none" {
+		for _, f := range strings.Split(iflagStr, ",") {
+			if v, ok := iflagMap[f]; ok {
+				flags &= ^v.clear
+				flags |= v.set
+			} else {
+				return 0, fmt.Errorf("unknown iflag=%s", f)
+			}
+		}
+	}
+	return flags, nil
+}
+
 // parseBlockSize interprets e.g. "4M", "512b", etc.
 func parseBlockSize(sizeStr string, defaultSize int64) int64 {
 	if sizeStr == "" {
@@ -157,324 +624,5756 @@ func parseBlockSize(sizeStr string, defaultSize int64) int64 {
 	return val * multiplier
 }
 
-// doOneTransfer runs dd for one Transfer
-func doOneTransfer(t *Transfer, stdin io.Reader) error {
-	r, err := inFile(stdin, t.InputFilename, t.Bs, t.Size, t.Skip, t.Count, &t.Total)
-	if err != nil {
-		return err
+// errClass groups transfer errors for the final report
+type errClass int
+
+const (
+	classOther errClass = iota
+	classInput
+	classOutput
+	classRead
+	classWrite
+	classNoSpace
+	classVerify
+	classChecksum
+	classCanceled
+)
+
+// errClassNames holds the singular and plural report label of each class
+var errClassNames = map[errClass][2]string{
+	classOther:    {"other error", "other errors"},
+	classInput:    {"input error", "input errors"},
+	classOutput:   {"output error", "output errors"},
+	classRead:     {"read error", "read errors"},
+	classWrite:    {"write error", "write errors"},
+	classNoSpace:  {"out-of-space", "out-of-space"},
+	classVerify:   {"verify error", "verify errors"},
+	classChecksum: {"checksum mismatch", "checksum mismatches"},
+	classCanceled: {"canceled", "canceled"},
+}
+
+// transferError tags an error with the stage of the transfer it came from
+type transferError struct {
+	class errClass
+	err   error
+}
+
+func (e *transferError) Error() string { return e.err.Error() }
+func (e *transferError) Unwrap() error { return e.err }
+
+// classifyError returns the class of a transfer error; running out of
+// space is reported on its own regardless of where it happened.
+func classifyError(err error) errClass {
+	if errors.Is(err, syscall.ENOSPC) {
+		return classNoSpace
 	}
-	w, err := outFile(os.Stdout, t.OutputFilename, t.Bs, t.Seek, t.Oflag)
-	if err != nil {
-		return err
+	if errors.Is(err, context.Canceled) {
+		return classCanceled
 	}
-	return dd(r, w, t.Bs, &t.Transferred)
+	var te *transferError
+	if errors.As(err, &te) {
+		return te.class
+	}
+	return classOther
 }
 
-// dd copies data from r to w in chunks
-func dd(r io.Reader, w io.Writer, inBufSize int64, bytesWritten *int64) error {
-	if inBufSize == 0 {
-		return fmt.Errorf("input buffer size is zero")
+// doOneTransfer runs dd for one Transfer
+func doOneTransfer(t *Transfer, stdin io.Reader) (err error) {
+	limit := t.byteLimit()
+	if t.VerifyAppended {
+		alg, length, digest, err := readTrailer(t.InputFilename)
+		if err != nil {
+			return &transferError{classInput, err}
+		}
+		t.HashAlg, t.Expect = alg, digest
+		if limit < 0 || limit > length {
+			limit = length
+		}
 	}
-	buf := make([]byte, inBufSize)
-	for {
-		n, err := r.Read(buf)
-		if n > 0 {
-			_, writeErr := w.Write(buf[:n])
-			if writeErr != nil {
-				return fmt.Errorf("error writing: %w", writeErr)
+	if t.Partition > 0 {
+		// skip and count are relative to the partition
+		start, size, err := partitionRange(t.InputFilename, t.Partition)
+		if err != nil {
+			return &transferError{classInput, err}
+		}
+		t.SkipOff += start
+		size -= t.SkipOff - start
+		if size < 0 {
+			size = 0
+		}
+		if limit < 0 || limit > size {
+			limit = size
+		}
+	}
+	if t.Resume {
+		t.Resumed = resumeOffset(t.OutputFilename, t.SeekOff)
+		if t.FromCheckpoint {
+			// a regular file can't hold more than it has, whatever the
+			// checkpoint says
+			if fi, err := os.Stat(t.OutputFilename); err != nil || !fi.Mode().IsRegular() || t.Checkpointed < t.Resumed {
+				t.Resumed = t.Checkpointed
 			}
-			*bytesWritten += int64(n)
 		}
-		if err != nil {
-			if err == io.EOF {
-				break
+		if limit >= 0 && t.Resumed > limit {
+			t.Resumed = limit
+		}
+		if t.ResumeVerify && t.Resumed > 0 {
+			// only trust whole blocks of the existing output, and only
+			// if they still match the input
+			t.Resumed -= t.Resumed % t.Bs
+			ok, err := resumePrefixMatches(t, t.Resumed)
+			if err != nil {
+				return &transferError{classVerify, err}
+			}
+			if !ok {
+				t.Resumed = 0
+				if t.ResumeFailOnMismatch {
+					return &transferError{classVerify, fmt.Errorf("existing output %q doesn't match the input, not resuming", t.OutputFilename)}
+				}
+				log.Printf("Transfer #%d: existing output doesn't match the input, restarting", t.Index)
+			}
+		}
+		if t.Resumed > 0 {
+			// carry on where the existing output ends
+			t.SkipOff += t.Resumed
+			t.SeekOff += t.Resumed
+			if limit >= 0 {
+				limit -= t.Resumed
 			}
-			return fmt.Errorf("error reading: %w", err)
 		}
 	}
-	return nil
-}
 
-// inFile sets up the input with skip & limit
-func inFile(stdin io.Reader, name string, bs, size int64, skip, count int64, totalOut *int64) (io.Reader, error) {
-	if name == "" {
-		r := stdin
-		if skip > 0 {
-			_, err := io.CopyN(io.Discard, r, skip*bs)
+	var r *limitReader
+	if t.NullIO {
+		// -nullio: zeros in and nothing out, so only the copy loop costs
+		r = newLimitReader(nullReader{}, limit, nil)
+		t.Total = limit
+	} else if t.shared != nil {
+		r, err = t.shared.open(t, stdin)
+		if err != nil {
+			return &transferError{classInput, err}
+		}
+	} else {
+		r, err = inFile(stdin, t.InputFilename, t.SkipOff, limit, t.Iflag, t.followStop, &t.Total)
+		if err != nil {
+			return &transferError{classInput, err}
+		}
+	}
+	defer r.Close()
+	if hasOption(t.Conv, "noerror") {
+		// below the limit, so skipped blocks count towards count/size:
+		// as the zeros that replace them with sync, or else by lim
+		seeker, _ := r.c.(io.Seeker)
+		nr := &noErrorReader{r: r.r, s: seeker, t: t, zero: hasOption(t.Conv, "sync"), lim: r}
+		if t.MapFile != "" {
+			m, err := readRescueMap(t.MapFile)
 			if err != nil {
-				return nil, fmt.Errorf("error skipping stdin: %w", err)
+				return &transferError{classOutput, err}
 			}
+			nr.m, nr.base = m, t.SkipOff
+			defer func() {
+				if werr := m.write(t.MapFile); werr != nil && err == nil {
+					err = &transferError{classOutput, werr}
+				}
+			}()
 		}
-		if count != math.MaxInt64 {
-			*totalOut = count * bs
-			return io.LimitReader(r, *totalOut), nil
-		} else if size > 0 {
-			*totalOut = size
-			return io.LimitReader(r, size), nil
+		r.r = nr
+	}
+	if f, ok := r.c.(*os.File); ok && t.Iflag&oDirect != 0 {
+		r.r = &directReader{r: r.r, f: f}
+	}
+	t.Mutex.Lock()
+	t.limiter = r
+	t.Mutex.Unlock()
+	var src io.Reader = r
+	if t.ctx != nil {
+		src = &ctxReader{ctx: t.ctx, r: src}
+	}
+	if t.gate != nil {
+		src = &pauseReader{r: src, t: t}
+	}
+	if t.BwLimit > 0 {
+		src = &rateLimitReader{r: src, ctx: t.ctx, l: newRateLimiter(t.BwLimit)}
+	}
+	if t.bwTotal != nil {
+		l := t.bwTotal.join(t.Weight)
+		defer t.bwTotal.leave(l)
+		src = &rateLimitReader{r: src, ctx: t.ctx, l: l}
+	}
+	if t.IopsLimit > 0 {
+		src = &iopsLimitReader{r: src, ctx: t.ctx, l: newRateLimiter(int64(t.IopsLimit))}
+	}
+	if hasOption(t.IflagStr, "eof-on-short") {
+		src = &shortEOFReader{r: src}
+	}
+	if t.InputEncoding != "" {
+		// after the wrappers that pace and stop reading the input, before
+		// those that change the data
+		src = decodingReader(src, t.InputEncoding)
+		// the total is counted in encoded bytes; estimate the decoded size
+		t.Mutex.Lock()
+		if t.InputEncoding == "hex" {
+			t.Total /= 2
+		} else {
+			t.Total = t.Total * 3 / 4
 		}
-		return r, nil
+		t.Mutex.Unlock()
 	}
-
-	in, err := os.Open(name)
-	if err != nil {
-		return nil, fmt.Errorf("error opening input %q: %w", name, err)
+	if t.Until != nil {
+		src = &untilReader{r: src, delim: t.Until, inclusive: t.UntilInclusive}
 	}
-	fi, err := in.Stat()
-	if err != nil {
-		in.Close()
-		return nil, fmt.Errorf("error stating %q: %w", name, err)
+	if hasOption(t.IflagStr, "fullblock") {
+		src = fullBlockReader{src}
 	}
-	if fi.Mode().IsRegular() {
-		_, err := in.Seek(skip*bs, io.SeekStart)
+	if hasOption(t.Conv, "sync") {
+		src = syncReader{src}
+	}
+	if table := charsetTable(t.Conv); table != nil {
+		src = &translateReader{r: src, table: table}
+	}
+	if hasOption(t.Conv, "swab") {
+		src = &swabReader{r: src}
+	}
+	t.writePath = t.OutputFilename
+	oflag := t.Oflag
+	if t.Atomic {
+		t.writePath = t.OutputFilename + ".tmp"
+		// nocreat and excl are about the real output; the temporary
+		// file is always new
+		if err := checkCreate(t.OutputFilename, oflag); err != nil {
+			return &transferError{classOutput, err}
+		}
+		oflag = oflag&^os.O_EXCL | os.O_CREATE
+	}
+	var w io.Writer = io.Discard
+	if !t.NullIO {
+		w, err = outFile(os.Stdout, t.writePath, t.SeekOff, oflag, hasOption(t.Conv, "fullalloc"))
 		if err != nil {
-			in.Close()
-			return nil, fmt.Errorf("error seeking %q: %w", name, err)
+			return &transferError{classOutput, err}
 		}
-		if count != math.MaxInt64 {
-			*totalOut = count * bs
-			return io.NewSectionReader(in, skip*bs, *totalOut), nil
-		} else if size > 0 {
-			*totalOut = size
-			return io.NewSectionReader(in, skip*bs, size), nil
-		} else {
-			st, _ := in.Stat()
-			*totalOut = st.Size() - (skip * bs)
-			return in, nil
+	}
+	raw := w
+	if f, ok := raw.(*os.File); ok && oflag&os.O_APPEND != 0 {
+		// verify reads back from where the appended data starts
+		if off, err := f.Seek(0, io.SeekCurrent); err == nil {
+			t.SeekOff = off
 		}
 	}
-	// non-regular
-	r := in
-	if skip > 0 {
-		_, err := io.CopyN(io.Discard, r, skip*bs)
-		if err != nil {
-			in.Close()
-			return nil, fmt.Errorf("error skipping in %q: %w", name, err)
+	if t.writePath != "" && !t.NullIO {
+		// close errors can be the first sign of lost writes (e.g. on NFS)
+		out := w.(io.Closer)
+		defer func() {
+			if cerr := out.Close(); cerr != nil && err == nil {
+				err = &transferError{classWrite, fmt.Errorf("error closing %q: %w", t.writePath, cerr)}
+			}
+		}()
+	}
+	var sw *sparseWriter
+	if t.Sparse {
+		sw = &sparseWriter{f: raw.(*os.File), t: t}
+		w = sw
+	}
+	if f, ok := raw.(*os.File); ok && oflag&oDirect != 0 {
+		w = &directWriter{w: w, f: f}
+	}
+	if t.Verify {
+		// checksum exactly what reaches the output, after any padding or
+		// encoding, so the read-back can be compared with it
+		t.written = &checksumWriter{w: w, h: sha256.New()}
+		w = t.written
+	}
+	var pw *padWriter
+	if hasOption(t.OflagStr, "padwrites") {
+		pw = newPadWriter(w, t.outBs())
+		w = pw
+	} else if t.Obs > 0 && t.Obs != t.Bs {
+		pw = newPadWriter(w, t.Obs)
+		pw.short = true
+		w = pw
+	}
+	var ew *encodedWriter
+	if t.OutputEncoding != "" {
+		ew = newEncodedWriter(w, t.OutputEncoding, t.OutputWrap)
+		w = ew
+	}
+	var digest *checksumWriter
+	if t.HashAlg != "" {
+		// the digest covers the data itself, before any output encoding
+		digest = &checksumWriter{w: w, h: hashAlgs[t.HashAlg]()}
+		w = digest
+	}
+	if t.recording != nil {
+		src = &recordingReader{r: src, tt: t.recording}
+		w = &recordingWriter{w: w, tt: t.recording}
+	}
+	if t.moved != nil {
+		w = &firstWriteNotifier{w: w, c: t.moved}
+	}
+	if err := dd(src, w, t.Bs, t); err != nil {
+		return err
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return &transferError{classWrite, fmt.Errorf("error writing: %w", err)}
 		}
 	}
-	if count != math.MaxInt64 {
-		*totalOut = count * bs
-		return io.LimitReader(r, *totalOut), nil
-	} else if size > 0 {
-		*totalOut = size
-		return io.LimitReader(r, size), nil
+	if pw != nil {
+		if err := pw.Flush(); err != nil {
+			return &transferError{classWrite, fmt.Errorf("error writing: %w", err)}
+		}
 	}
-	return r, nil
-}
-
-// outFile sets up output with seek & flags
-func outFile(stdout io.WriteSeeker, name string, bs int64, seek int64, flags int) (io.Writer, error) {
-	if name == "" {
-		return stdout, nil
+	if sw != nil {
+		if err := sw.Finish(); err != nil {
+			return &transferError{classWrite, fmt.Errorf("error writing: %w", err)}
+		}
 	}
-	perm := os.O_CREATE | os.O_WRONLY | (flags & allowedFlags)
-	f, err := os.OpenFile(name, perm, 0o666)
-	if err != nil {
-		return nil, fmt.Errorf("error opening output %q: %w", name, err)
+	if digest != nil {
+		sum := hex.EncodeToString(digest.h.Sum(nil))
+		t.Mutex.Lock()
+		t.Digest = sum
+		t.Mutex.Unlock()
+		if t.Expect != "" && !strings.EqualFold(sum, t.Expect) {
+			return &transferError{classChecksum, fmt.Errorf("%s mismatch: got %s, expected %s", t.HashAlg, sum, t.Expect)}
+		}
+		if t.AppendChecksum {
+			if _, err := raw.Write(makeTrailer(t.HashAlg, t.Transferred, digest.h.Sum(nil))); err != nil {
+				return &transferError{classWrite, fmt.Errorf("error writing checksum trailer: %w", err)}
+			}
+		}
 	}
-	if seek*bs != 0 {
-		if _, err := f.Seek(seek*bs, io.SeekCurrent); err != nil {
-			return nil, fmt.Errorf("error seeking %q: %w", name, err)
+	if f, ok := raw.(*os.File); ok && t.writePath != "" && (hasOption(t.Conv, "fsync") || hasOption(t.Conv, "fdatasync")) {
+		if err := syncOutput(t, f); err != nil {
+			return &transferError{classWrite, fmt.Errorf("error syncing %q: %w", t.writePath, err)}
 		}
 	}
-	return f, nil
+	return nil
 }
 
-func usage() {
-	log.Fatal(`Multi-Transfer dd with up to 50 sets. Use -numTransfers=N to specify how many sets are actually used.
-Example:
- ./dd_multi_n -numTransfers=3 \
-   -if1=/dev/zero -of1=file1.img -bs1=4M -size1=1G ...
-   -if2=/dev/urandom -of2=file2.img -bs2=1M -size2=2G ...
-   -if3=input.iso -of3=device -count3=700 ...
-`)
+// syncOutput flushes f to its device for conv=fsync, or only its data
+// (not metadata such as times) for conv=fdatasync where the system has
+// it, timing the flush in t
+func syncOutput(t *Transfer, f *os.File) error {
+	t.Mutex.Lock()
+	t.SyncStart = time.Now()
+	t.Mutex.Unlock()
+	defer func() {
+		t.Mutex.Lock()
+		t.SyncEnd = time.Now()
+		t.Mutex.Unlock()
+	}()
+	if hasOption(t.Conv, "fdatasync") && !hasOption(t.Conv, "fsync") {
+		return fdatasync(f)
+	}
+	return f.Sync()
 }
 
-// Convert x=y to -x y for the flag package
-func convertArgs(osArgs []string) []string {
-	var args []string
-	for _, v := range osArgs {
-		l := strings.SplitN(v, "=", 2)
-		if len(l) == 2 {
-			l[0] = "-" + l[0]
-		}
-		args = append(args, l...)
+// title is how the display and summary name the transfer
+func (t *Transfer) title() string {
+	if t.Name != "" {
+		return fmt.Sprintf("%s: %s --> %s", t.Name, t.InputFilename, t.OutputFilename)
 	}
-	return args
+	return fmt.Sprintf("%s --> %s", t.InputFilename, t.OutputFilename)
 }
 
-func main() {
-	if err := run(os.Stdin, os.Stdout); err != nil {
-		log.Fatal(err)
+// outBs is the size of the transfer's output blocks
+func (t *Transfer) outBs() int64 {
+	if t.Obs > 0 {
+		return t.Obs
 	}
+	return t.Bs
 }
 
-func run(stdin io.Reader, stdout io.WriteSeeker) error {
-	// We'll define up to MaxTransfers sets of flags
-	f := flag.NewFlagSet("dd_multi_n", flag.ExitOnError)
+// byteLimit is how much count or size lets the transfer copy, or -1
+// for all of the input
+func (t *Transfer) byteLimit() int64 {
+	if t.Count != math.MaxInt64 {
+		return t.Count * t.Bs
+	} else if t.Size > 0 {
+		return t.Size
+	}
+	return -1
+}
 
-	numTransfers := f.Int("numTransfers", 0, "Number of parallel transfers (1..50)")
-	fsFullscreen := f.Bool("fullscreen", false, "Center progress bar(s) in fullscreen mode")
+// hashAlgs are the digests available for hash=
+var hashAlgs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
 
-	// We'll store each set in slices
-	inputFiles := make([]string, MaxTransfers)
-	outputFiles := make([]string, MaxTransfers)
-	bsVals := make([]string, MaxTransfers)
-	convVals := make([]string, MaxTransfers)
-	oflagVals := make([]string, MaxTransfers)
+// parseHash checks hash= and expect= for a transfer. Without hash=, the
+// algorithm is inferred from the length of the expected digest.
+func parseHash(alg, expect string) (string, error) {
+	if expect != "" {
+		if _, err := hex.DecodeString(expect); err != nil {
+			return "", fmt.Errorf("expect=%s is not a hex digest", expect)
+		}
+		if alg == "" {
+			switch len(expect) {
+			case 2 * md5.Size:
+				alg = "md5"
+			case 2 * sha1.Size:
+				alg = "sha1"
+			case 2 * sha256.Size:
+				alg = "sha256"
+			case 2 * sha512.Size:
+				alg = "sha512"
+			default:
+				return "", fmt.Errorf("can't tell the algorithm of expect=%s, set hash=", expect)
+			}
+		}
+	}
+	if alg == "" {
+		return "", nil
+	}
+	newHash, ok := hashAlgs[alg]
+	if !ok {
+		return "", fmt.Errorf("unknown hash=%s", alg)
+	}
+	if expect != "" && len(expect) != 2*newHash().Size() {
+		return "", fmt.Errorf("expect=%s is not a %s digest", expect, alg)
+	}
+	return alg, nil
+}
 
-	countVals := make([]int64, MaxTransfers)
-	skipVals := make([]int64, MaxTransfers)
-	seekVals := make([]int64, MaxTransfers)
-	sizeVals := make([]int64, MaxTransfers)
+// decodingReader decodes hex or base64 text from r, ignoring whitespace
+// and line breaks between the encoded characters.
+func decodingReader(r io.Reader, encoding string) io.Reader {
+	r = &spaceStripper{r: r}
+	if encoding == "hex" {
+		return hex.NewDecoder(r)
+	}
+	return base64.NewDecoder(base64.StdEncoding, r)
+}
 
-	// Pre-define all flags so we don't get "flag provided but not defined"
-	for i := 1; i <= MaxTransfers; i++ {
-		f.StringVar(&inputFiles[i-1], fmt.Sprintf("if%d", i), "",
-			fmt.Sprintf("Input file #%d", i))
-		f.StringVar(&outputFiles[i-1], fmt.Sprintf("of%d", i), "",
-			fmt.Sprintf("Output file #%d", i))
-		f.StringVar(&bsVals[i-1], fmt.Sprintf("bs%d", i), "",
-			fmt.Sprintf("Block size #%d", i))
-		f.StringVar(&convVals[i-1], fmt.Sprintf("conv%d", i), "none",
-			fmt.Sprintf("Conversions #%d", i))
-		f.StringVar(&oflagVals[i-1], fmt.Sprintf("oflag%d", i), "none",
-			fmt.Sprintf("Output flags #%d", i))
+// spaceStripper drops ASCII whitespace from what it reads
+type spaceStripper struct {
+	r io.Reader
+}
 
-		f.Int64Var(&countVals[i-1], fmt.Sprintf("count%d", i), math.MaxInt64,
-			fmt.Sprintf("Blocks #%d", i))
-		f.Int64Var(&skipVals[i-1], fmt.Sprintf("skip%d", i), 0,
-			fmt.Sprintf("Skip #%d blocks", i))
-		f.Int64Var(&seekVals[i-1], fmt.Sprintf("seek%d", i), 0,
-			fmt.Sprintf("Seek #%d blocks", i))
-		f.Int64Var(&sizeVals[i-1], fmt.Sprintf("size%d", i), 0,
-			fmt.Sprintf("Total bytes #%d", i))
+func (s *spaceStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		j := 0
+		for _, c := range p[:n] {
+			switch c {
+			case ' ', '\t', '\r', '\n', '\v', '\f':
+			default:
+				p[j] = c
+				j++
+			}
+		}
+		// don't report an all-whitespace chunk as a zero-byte read
+		if j > 0 || err != nil {
+			return j, err
+		}
 	}
+}
 
-	// Parse
-	f.Parse(convertArgs(os.Args[1:]))
+// encodedWriter writes what it is given to w as hex or base64 text
+type encodedWriter struct {
+	enc io.Writer
+	lw  *lineWrapper
+}
 
-	// If -fullscreen is set, we don't detect real terminal size;
-	// we just keep 80x24, but do a full-screen effect anyway.
-	if *fsFullscreen {
-		fullscreen = true
+func newEncodedWriter(w io.Writer, encoding string, wrap int) *encodedWriter {
+	lw := &lineWrapper{w: w, width: wrap}
+	if encoding == "hex" {
+		return &encodedWriter{enc: hex.NewEncoder(lw), lw: lw}
 	}
+	return &encodedWriter{enc: base64.NewEncoder(base64.StdEncoding, lw), lw: lw}
+}
 
-	if *numTransfers <= 0 || *numTransfers > MaxTransfers {
-		usage()
-	}
+func (e *encodedWriter) Write(p []byte) (int, error) {
+	return e.enc.Write(p)
+}
 
-	// Build the actual Transfer objects
-	var transfers []*Transfer
-	for i := 1; i <= *numTransfers; i++ {
-		inName := inputFiles[i-1]
-		outName := outputFiles[i-1]
-		bsStr := bsVals[i-1]
-		convStr := convVals[i-1]
-		oflagStr := oflagVals[i-1]
+// Close flushes any partial base64 group and ends the last line
+func (e *encodedWriter) Close() error {
+	if c, ok := e.enc.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return e.lw.Close()
+}
 
-		countVal := countVals[i-1]
-		skipVal := skipVals[i-1]
-		seekVal := seekVals[i-1]
-		sizeVal := sizeVals[i-1]
+// lineWrapper inserts a newline every width bytes (never, if width is 0)
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int
+}
 
-		// If both inName/outName are empty, skip
-		if inName == "" && outName == "" {
-			continue
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if l.width > 0 {
+			if room := l.width - l.col; len(chunk) > room {
+				chunk = chunk[:room]
+			}
 		}
-
-		bsVal := parseBlockSize(bsStr, 512)
-		flags, err := parseConvOflag(convStr, oflagStr)
+		n, err := l.w.Write(chunk)
+		written += n
+		l.col += n
 		if err != nil {
-			log.Printf("Error parsing conv/oflag for transfer #%d: %v", i, err)
-			continue
+			return written, err
+		}
+		p = p[n:]
+		if l.width > 0 && l.col == l.width {
+			if _, err := l.w.Write([]byte{'\n'}); err != nil {
+				return written, err
+			}
+			l.col = 0
 		}
+	}
+	return written, nil
+}
 
-		t := &Transfer{
-			InputFilename:  inName,
-			OutputFilename: outName,
-			Bs:             bsVal,
-			Count:          countVal,
-			Size:           sizeVal,
-			Skip:           skipVal,
-			Seek:           seekVal,
-			Conv:           convStr,
-			Oflag:          flags,
+// Close terminates a partial last line
+func (l *lineWrapper) Close() error {
+	if l.col == 0 {
+		return nil
+	}
+	l.col = 0
+	_, err := l.w.Write([]byte{'\n'})
+	return err
+}
+
+// checksumWriter hashes and counts the bytes written through it
+type checksumWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.h.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// verifyTransfer reads back the region the copy wrote to the output and
+// compares its checksum with that of the bytes that were written. It is
+// timed separately from the copy so the summary can show both phases.
+func verifyTransfer(t *Transfer) error {
+	t.Mutex.Lock()
+	t.VerifyStart = time.Now()
+	t.Mutex.Unlock()
+	defer func() {
+		t.Mutex.Lock()
+		t.VerifyEnd = time.Now()
+		t.Mutex.Unlock()
+	}()
+
+	f, err := os.Open(t.writePath)
+	if err != nil {
+		return &transferError{classVerify, fmt.Errorf("error opening %q for verify: %w", t.writePath, err)}
+	}
+	defer f.Close()
+	if _, err := f.Seek(t.SeekOff, io.SeekStart); err != nil {
+		return &transferError{classVerify, fmt.Errorf("error seeking %q for verify: %w", t.writePath, err)}
+	}
+
+	// only the region written is read back, not the rest of a device
+	h := sha256.New()
+	r := io.LimitReader(f, t.written.n)
+	buf := make([]byte, t.VerifyBs)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			t.Mutex.Lock()
+			t.Verified += int64(n)
+			t.Mutex.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &transferError{classVerify, fmt.Errorf("error reading %q for verify: %w", t.writePath, err)}
+		}
+	}
+	if t.Verified != t.written.n {
+		return &transferError{classVerify, fmt.Errorf("verify of %q read %d bytes, expected %d", t.writePath, t.Verified, t.written.n)}
+	}
+	if !bytes.Equal(h.Sum(nil), t.written.h.Sum(nil)) {
+		return &transferError{classVerify, fmt.Errorf("verify of %q failed: output differs from the data written", t.writePath)}
+	}
+	return nil
+}
+
+// checkCreate applies conv=nocreat and excl to an output that isn't
+// opened itself, failing the way opening it would
+func checkCreate(name string, flags int) error {
+	_, err := os.Lstat(name)
+	switch {
+	case flags&os.O_CREATE == 0 && err != nil:
+		return fmt.Errorf("error opening output %q: %w", name, err)
+	case flags&os.O_EXCL != 0 && err == nil:
+		return fmt.Errorf("error opening output %q: %w", name, os.ErrExist)
+	}
+	return nil
+}
+
+// finishAtomic renames an Atomic transfer's temporary output into place
+// after success, or removes it (unless KeepPartial) after err.
+func finishAtomic(t *Transfer, err error) error {
+	if !t.Atomic || t.writePath == "" {
+		return err
+	}
+	if err != nil {
+		if !t.KeepPartial {
+			os.Remove(t.writePath)
+		}
+		return err
+	}
+	if rerr := os.Rename(t.writePath, t.OutputFilename); rerr != nil {
+		return &transferError{classOutput, fmt.Errorf("error renaming %q into place: %w", t.writePath, rerr)}
+	}
+	return nil
+}
+
+// atomicUnsupported explains why -atomic can't apply to an output, or
+// returns "" if it can: only whole regular files can be swapped in by rename.
+func atomicUnsupported(name string, seekOff int64, resume, appending bool) string {
+	switch {
+	case name == "":
+		return "output is stdout"
+	case isFD(name):
+		return "output is an inherited file descriptor"
+	case seekOff != 0:
+		return "output is written at a seek offset"
+	case resume:
+		return "-resume continues the existing output"
+	case appending:
+		return "oflag=append adds to the existing output"
+	}
+	if fi, err := os.Stat(name); err == nil && !fi.Mode().IsRegular() {
+		return "output is not a regular file"
+	}
+	return ""
+}
+
+// The -appendChecksum trailer, the last trailerSize bytes of an output:
+//
+//	algorithm  8 bytes, the hash= name, NUL-padded
+//	length     8 bytes, big-endian size of the data before the trailer
+//	digest    64 bytes, NUL-padded for digests shorter than SHA-512's
+//	magic      8 bytes, trailerMagic
+const (
+	trailerMagic = "DDMTRLR1"
+	trailerSize  = 88
+)
+
+func makeTrailer(alg string, length int64, digest []byte) []byte {
+	b := make([]byte, trailerSize)
+	copy(b[0:8], alg)
+	binary.BigEndian.PutUint64(b[8:16], uint64(length))
+	copy(b[16:80], digest)
+	copy(b[80:], trailerMagic)
+	return b
+}
+
+// readTrailer reads the -appendChecksum trailer at the end of file name
+// and returns its algorithm, data length and hex digest
+func readTrailer(name string) (string, int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("error opening input %q: %w", name, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, "", fmt.Errorf("error stating %q: %w", name, err)
+	}
+	b := make([]byte, trailerSize)
+	if fi.Size() < trailerSize {
+		return "", 0, "", fmt.Errorf("%q has no checksum trailer (too short)", name)
+	}
+	if _, err := f.ReadAt(b, fi.Size()-trailerSize); err != nil {
+		return "", 0, "", fmt.Errorf("error reading checksum trailer of %q: %w", name, err)
+	}
+	if string(b[80:]) != trailerMagic {
+		return "", 0, "", fmt.Errorf("%q has no checksum trailer", name)
+	}
+	alg := strings.TrimRight(string(b[0:8]), "\x00")
+	newHash, ok := hashAlgs[alg]
+	if !ok {
+		return "", 0, "", fmt.Errorf("checksum trailer of %q has unknown algorithm %q", name, alg)
+	}
+	length := int64(binary.BigEndian.Uint64(b[8:16]))
+	if length != fi.Size()-trailerSize {
+		return "", 0, "", fmt.Errorf("checksum trailer of %q is for %d bytes of data, but %d precede it", name, length, fi.Size()-trailerSize)
+	}
+	digest := b[16 : 16+newHash().Size()]
+	return alg, length, hex.EncodeToString(digest), nil
+}
+
+// sparseUnsupported explains why t's output can't be written with
+// holes, or returns "" if it can
+func sparseUnsupported(t *Transfer) string {
+	switch {
+	case t.OutputFilename == "" || isFD(t.OutputFilename):
+		return "output is stdout or a file descriptor"
+	case t.NullIO:
+		return "-nullio writes nothing"
+	case t.Oflag&os.O_APPEND != 0:
+		return "oflag=append writes can't skip ahead"
+	}
+	// skipping zeros on a device would leave its old data there
+	if fi, err := os.Stat(t.OutputFilename); err == nil && !fi.Mode().IsRegular() {
+		return "output is not a regular file"
+	}
+	return ""
+}
+
+// appendUnsupported explains why t can't get an -appendChecksum
+// trailer, or returns "" if it can
+func appendUnsupported(t *Transfer) string {
+	switch {
+	case t.OutputFilename == "":
+		return "output is stdout"
+	case t.Resume:
+		return "-resume continues the existing output"
+	case t.OutputEncoding != "" || hasOption(t.OflagStr, "padwrites"):
+		return "the output isn't the data the digest is of"
+	case t.Oflag&os.O_APPEND != 0:
+		return "oflag=append puts the trailer after the existing data"
+	case t.Oflag&os.O_TRUNC == 0:
+		return "conv=notrunc could leave old data after the trailer"
+	}
+	if fi, err := os.Stat(t.OutputFilename); err == nil && !fi.Mode().IsRegular() {
+		return "output is not a regular file"
+	}
+	return ""
+}
+
+// verifyAppendedUnsupported explains why t's input can't be checked
+// with -verifyAppended, or returns "" if it can
+func verifyAppendedUnsupported(t *Transfer) string {
+	switch {
+	case t.InputFilename == "" || isURL(t.InputFilename):
+		return "the trailer is read from the end of a file"
+	case t.SkipOff != 0 || t.Partition > 0 || t.Resume:
+		return "the digest covers all of the data, from its start"
+	case t.InputEncoding != "":
+		return "the input is encoded"
+	}
+	if fi, err := os.Stat(t.InputFilename); err != nil || !fi.Mode().IsRegular() {
+		return "input is not a regular file"
+	}
+	return ""
+}
+
+// copyWithRetries runs doOneTransfer, and again up to t.Retries times
+// while it fails reading its input, starting over each time after a
+// retryDelay
+func copyWithRetries(t *Transfer, stdin io.Reader) error {
+	skipOff, seekOff := t.SkipOff, t.SeekOff
+	var rng *rand.Rand
+	for attempt := 1; ; attempt++ {
+		err := doOneTransfer(t, stdin)
+		class := classifyError(err)
+		if err == nil || attempt > t.Retries || (class != classInput && class != classRead) {
+			return err
+		}
+		if t.ctx != nil && t.ctx.Err() != nil {
+			return err
+		}
+		if rng == nil {
+			rng = rand.New(rand.NewSource(t.RetrySeed + int64(t.Index)))
+		}
+		d := retryDelay(attempt, t.RetryBackoff, t.MaxBackoff, rng)
+		log.Printf("Transfer #%d failed: %v; retry %d of %d in %s", t.Index, err, attempt, t.Retries, d.Round(time.Millisecond))
+		if t.ctx != nil {
+			select {
+			case <-time.After(d):
+			case <-t.ctx.Done():
+				return &transferError{classOther, t.ctx.Err()}
+			}
+		} else {
+			time.Sleep(d)
+		}
+
+		if t.Oflag&os.O_APPEND != 0 {
+			// drop what the failed attempt appended
+			if fi, err := os.Stat(t.writePath); err == nil && fi.Mode().IsRegular() && fi.Size() > t.SeekOff {
+				if err := os.Truncate(t.writePath, t.SeekOff); err != nil {
+					log.Printf("Warning: transfer #%d: %v", t.Index, err)
+				}
+			}
+		}
+		// doOneTransfer moves the offsets for partitions, -resume and
+		// oflag=append
+		t.Mutex.Lock()
+		t.SkipOff, t.SeekOff = skipOff, seekOff
+		t.Transferred, t.Total, t.Resumed = 0, 0, 0
+		t.Mutex.Unlock()
+	}
+}
+
+// retryDelay is the wait before retry number attempt: base doubled for
+// each earlier retry and capped at max, then drawn at random from its
+// upper half so that transfers failing together don't retry together
+func retryDelay(attempt int, base, max time.Duration, rng *rand.Rand) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rng.Int63n(int64(d-half)+1))
+}
+
+// partitionRange reads the MBR or GPT at the start of the image or disk
+// name and returns the byte offset and size of partition n (1-based; for
+// MBR only the four primary entries).
+func partitionRange(name string, n int) (int64, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error opening %q for its partition table: %w", name, err)
+	}
+	defer f.Close()
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return 0, 0, fmt.Errorf("error reading partition table of %q: %w", name, err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return 0, 0, fmt.Errorf("%q has no recognizable partition table", name)
+	}
+	protective := false
+	for i := 0; i < 4; i++ {
+		if mbr[446+16*i+4] == 0xee {
+			protective = true
+		}
+	}
+
+	if !protective {
+		if n > 4 {
+			return 0, 0, fmt.Errorf("%q: partition %d doesn't exist (only MBR primary partitions 1-4 are supported)", name, n)
+		}
+		e := mbr[446+16*(n-1):]
+		start := int64(binary.LittleEndian.Uint32(e[8:]))
+		sectors := int64(binary.LittleEndian.Uint32(e[12:]))
+		if e[4] == 0 || sectors == 0 {
+			return 0, 0, fmt.Errorf("%q: partition %d doesn't exist", name, n)
+		}
+		return start * 512, sectors * 512, nil
+	}
+
+	// GPT: the header is in LBA 1, whose size depends on the sector size
+	sizes := []int64{512, 4096}
+	if ss := sectorSize(name); ss > 0 {
+		sizes = []int64{ss}
+	}
+	hdr := make([]byte, 92)
+	for _, lba := range sizes {
+		if _, err := f.ReadAt(hdr, lba); err != nil || string(hdr[:8]) != "EFI PART" {
+			continue
+		}
+		entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+		count := int(binary.LittleEndian.Uint32(hdr[80:]))
+		entrySize := int64(binary.LittleEndian.Uint32(hdr[84:]))
+		if n > count || entrySize < 128 {
+			return 0, 0, fmt.Errorf("%q: partition %d doesn't exist", name, n)
+		}
+		e := make([]byte, 128)
+		if _, err := f.ReadAt(e, entriesLBA*lba+int64(n-1)*entrySize); err != nil {
+			return 0, 0, fmt.Errorf("error reading GPT entry %d of %q: %w", n, name, err)
+		}
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			return 0, 0, fmt.Errorf("%q: partition %d doesn't exist", name, n)
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		return first * lba, (last - first + 1) * lba, nil
+	}
+	return 0, 0, fmt.Errorf("%q has a protective MBR but no readable GPT header", name)
+}
+
+// resumePrefixMatches reports whether the first n bytes of the existing
+// output match the n bytes of input they were copied from, comparing
+// SHA-256 digests of both
+func resumePrefixMatches(t *Transfer, n int64) (bool, error) {
+	var total int64
+	in, err := inFile(nil, t.InputFilename, t.SkipOff, n, t.Iflag, nil, &total)
+	if err != nil {
+		return false, fmt.Errorf("error reading input to check resume: %w", err)
+	}
+	defer in.Close()
+	out, err := os.Open(t.OutputFilename)
+	if err != nil {
+		return false, fmt.Errorf("error reading output to check resume: %w", err)
+	}
+	defer out.Close()
+
+	buf := make([]byte, t.Bs)
+	hi, ho := sha256.New(), sha256.New()
+	ni, err := io.CopyBuffer(hi, in, buf)
+	if err != nil {
+		return false, fmt.Errorf("error reading input to check resume: %w", err)
+	}
+	no, err := io.CopyBuffer(ho, io.NewSectionReader(out, t.SeekOff, n), buf)
+	if err != nil {
+		return false, fmt.Errorf("error reading output to check resume: %w", err)
+	}
+	return ni == n && no == n && bytes.Equal(hi.Sum(nil), ho.Sum(nil)), nil
+}
+
+// resumeFlag is -resume: a plain boolean, or "verify" to check the
+// existing output against the input before continuing after it
+type resumeFlag struct {
+	on, verify bool
+	state      string // a -checkpoint file to resume from
+}
+
+func (r *resumeFlag) String() string {
+	if r == nil || !r.on {
+		return "false"
+	} else if r.verify {
+		return "verify"
+	} else if r.state != "" {
+		return r.state
+	}
+	return "true"
+}
+
+func (r *resumeFlag) Set(s string) error {
+	r.verify, r.state = false, ""
+	if s == "verify" {
+		r.on, r.verify = true, true
+		return nil
+	}
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		// anything else names a checkpoint file
+		r.on, r.state = true, s
+		return nil
+	}
+	r.on = on
+	return nil
+}
+
+func (r *resumeFlag) IsBoolFlag() bool { return true }
+
+// resumeOffset returns how many bytes of a previous run a regular-file
+// output already holds past seekOff, or 0 if there is nothing to resume.
+func resumeOffset(name string, seekOff int64) int64 {
+	if name == "" {
+		return 0
+	}
+	fi, err := os.Stat(name)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() <= seekOff {
+		return 0
+	}
+	return fi.Size() - seekOff
+}
+
+// checkpointEntry is where one transfer got to, in a -checkpoint file.
+// Offset counts the bytes of the input after skip copied to the output
+// after seek, including any an earlier run resumed after.
+type checkpointEntry struct {
+	Index  int    `json:"index"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Offset int64  `json:"offset"`
+	Done   bool   `json:"done"`
+	Error  string `json:"error,omitempty"`
+}
+
+// writeCheckpoint saves where transfers are to path, through a temporary
+// file renamed into place so a crash leaves the previous checkpoint
+func writeCheckpoint(path string, transfers []*Transfer) error {
+	var state struct {
+		Time      time.Time         `json:"time"`
+		Transfers []checkpointEntry `json:"transfers"`
+	}
+	state.Time = time.Now()
+	for _, tr := range transfers {
+		tr.Mutex.Lock()
+		c := checkpointEntry{
+			Index:  tr.Index,
+			Input:  tr.InputFilename,
+			Output: tr.OutputFilename,
+			Offset: tr.Resumed + tr.Transferred,
+			Done:   tr.Finished && tr.Err == nil,
+		}
+		if tr.Err != nil {
+			c.Error = tr.Err.Error()
+		}
+		tr.Mutex.Unlock()
+		state.Transfers = append(state.Transfers, c)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return err
+}
+
+// readCheckpoint loads a -checkpoint file for -resume=FILE, by transfer
+// number
+func readCheckpoint(path string) (map[int]checkpointEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading -resume checkpoint: %w", err)
+	}
+	var state struct {
+		Transfers []checkpointEntry `json:"transfers"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing -resume checkpoint %s: %w", path, err)
+	}
+	m := map[int]checkpointEntry{}
+	for _, c := range state.Transfers {
+		m[c.Index] = c
+	}
+	return m, nil
+}
+
+// sparseWriter seeks over writes that are all zeros instead of writing
+// them, leaving holes in a regular file (conv=sparse)
+type sparseWriter struct {
+	f    *os.File
+	t    *Transfer
+	zero []byte
+	hole bool // the last write was skipped
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	if len(s.zero) < len(p) {
+		s.zero = make([]byte, len(p))
+	}
+	if !bytes.Equal(p, s.zero[:len(p)]) {
+		s.hole = false
+		return s.f.Write(p)
+	}
+	if _, err := s.f.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	s.hole = true
+	s.t.Mutex.Lock()
+	s.t.Holes += int64(len(p))
+	s.t.Mutex.Unlock()
+	return len(p), nil
+}
+
+// Finish extends the file over a hole at its end, which seeking alone
+// doesn't
+func (s *sparseWriter) Finish() error {
+	if !s.hole {
+		return nil
+	}
+	off, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return s.f.Truncate(off)
+}
+
+// padWriter makes every write to w exactly one block, collecting short
+// chunks and zero-padding the final partial block on Flush. Fixed-block
+// devices like tapes reject anything else (oflag=padwrites). With short,
+// the final block is written as it is: that re-blocks the input into
+// writes of obs= bytes.
+type padWriter struct {
+	w     io.Writer
+	buf   []byte
+	n     int
+	short bool
+}
+
+func newPadWriter(w io.Writer, bs int64) *padWriter {
+	return &padWriter{w: w, buf: alignedBuffer(bs)}
+}
+
+func (p *padWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c := copy(p.buf[p.n:], b)
+		p.n += c
+		b = b[c:]
+		written += c
+		if p.n == len(p.buf) {
+			if _, err := p.w.Write(p.buf); err != nil {
+				return written, err
+			}
+			p.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Flush pads and writes any partial block
+func (p *padWriter) Flush() error {
+	if p.n == 0 {
+		return nil
+	}
+	n := p.n
+	p.n = 0
+	if p.short {
+		_, err := p.w.Write(p.buf[:n])
+		return err
+	}
+	clear(p.buf[n:])
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// traceEvent is one Read or Write call made by dd(): the buffer length,
+// what the call returned, and its error (Errno keeps system errors
+// classifiable on replay)
+type traceEvent struct {
+	Op    string `json:"op"` // read or write
+	Len   int    `json:"len"`
+	N     int    `json:"n"`
+	Err   string `json:"err,omitempty"`
+	Errno int    `json:"errno,omitempty"`
+}
+
+func newTraceEvent(op string, length, n int, err error) traceEvent {
+	e := traceEvent{Op: op, Len: length, N: n}
+	if err != nil {
+		e.Err = err.Error()
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			e.Errno = int(errno)
+		}
+	}
+	return e
+}
+
+// error rebuilds the recorded error
+func (e traceEvent) error() error {
+	switch {
+	case e.Err == "":
+		return nil
+	case e.Err == io.EOF.Error():
+		return io.EOF
+	case e.Errno != 0:
+		return syscall.Errno(e.Errno)
+	}
+	return errors.New(e.Err)
+}
+
+// transferTrace is one transfer in a -record file
+type transferTrace struct {
+	Index  int          `json:"index"`
+	Input  string       `json:"input"`
+	Output string       `json:"output"`
+	Bs     int64        `json:"bs"`
+	Events []traceEvent `json:"events"`
+}
+
+type recordingReader struct {
+	r  io.Reader
+	tt *transferTrace
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.tt.Events = append(r.tt.Events, newTraceEvent("read", len(p), n, err))
+	return n, err
+}
+
+type recordingWriter struct {
+	w  io.Writer
+	tt *transferTrace
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.tt.Events = append(w.tt.Events, newTraceEvent("write", len(p), n, err))
+	return n, err
+}
+
+func writeRecording(path string, transfers []*Transfer) error {
+	var traces []*transferTrace
+	for _, t := range transfers {
+		traces = append(traces, t.recording)
+	}
+	data, err := json.MarshalIndent(traces, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("error writing -record file: %w", err)
+	}
+	return nil
+}
+
+// replayer plays back the events of one recorded transfer to dd()
+// through replayReader and replayWriter; reads return zeros. A call that
+// doesn't match the next event means the engine no longer behaves as it
+// did when recorded.
+type replayer struct {
+	events []traceEvent
+	pos    int
+}
+
+func (rp *replayer) next(op string, length int) (traceEvent, error) {
+	if rp.pos >= len(rp.events) {
+		return traceEvent{}, fmt.Errorf("replay diverged: %s of %d bytes after the trace ended", op, length)
+	}
+	e := rp.events[rp.pos]
+	if e.Op != op || e.Len != length {
+		return traceEvent{}, fmt.Errorf("replay diverged at event %d: %s of %d bytes, recorded %s of %d",
+			rp.pos, op, length, e.Op, e.Len)
+	}
+	rp.pos++
+	return e, nil
+}
+
+type replayReader struct{ *replayer }
+
+func (r replayReader) Read(p []byte) (int, error) {
+	e, err := r.next("read", len(p))
+	if err != nil {
+		return 0, err
+	}
+	clear(p[:e.N])
+	return e.N, e.error()
+}
+
+type replayWriter struct{ *replayer }
+
+func (w replayWriter) Write(p []byte) (int, error) {
+	e, err := w.next("write", len(p))
+	if err != nil {
+		return 0, err
+	}
+	return e.N, e.error()
+}
+
+// replayRecording runs dd() over every transfer of a -record file and
+// prints the summary it would have produced
+func replayRecording(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading -replay file: %w", err)
+	}
+	var traces []*transferTrace
+	if err := json.Unmarshal(data, &traces); err != nil {
+		return fmt.Errorf("error parsing -replay file: %w", err)
+	}
+	var transfers []*Transfer
+	for _, tt := range traces {
+		t := &Transfer{
+			Index:          tt.Index,
+			InputFilename:  tt.Input,
+			OutputFilename: tt.Output,
+			Bs:             tt.Bs,
 			StartTime:      time.Now(),
 		}
-		transfers = append(transfers, t)
+		rp := &replayer{events: tt.Events}
+		t.Err = dd(replayReader{rp}, replayWriter{rp}, t.Bs, t)
+		if t.Err == nil && rp.pos < len(rp.events) {
+			t.Err = fmt.Errorf("replay diverged: dd finished after %d of %d events", rp.pos, len(rp.events))
+		}
+		if t.Err != nil {
+			log.Printf("Replay of transfer #%d: %v", t.Index, t.Err)
+		}
+		t.EndTime = time.Now()
+		t.Finished = true
+		transfers = append(transfers, t)
+	}
+	printSummary(os.Stderr, transfers, 0, false)
+	return nil
+}
+
+// ctxReader stops reading once ctx is canceled, e.g. by -onError=abort
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// pauseReader waits at t's gate before every read and counts the time
+// spent waiting in t.Paused
+type pauseReader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (p *pauseReader) Read(b []byte) (int, error) {
+	waited, err := p.t.gate.wait(p.t.ctx)
+	if waited > 0 {
+		p.t.Mutex.Lock()
+		p.t.Paused += waited
+		p.t.Mutex.Unlock()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return p.r.Read(b)
+}
+
+// iopsLimitReader holds reads back to l's rate in reads per second
+// (iopslimitN), whatever their size
+type iopsLimitReader struct {
+	r   io.Reader
+	ctx context.Context
+	l   *rateLimiter
+}
+
+func (r *iopsLimitReader) Read(p []byte) (int, error) {
+	if err := r.l.wait(r.ctx, 1); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// noErrorReader keeps reading past read errors (conv=noerror): a failed
+// read is retried t.ReadRetries times, then that many bytes of the input
+// are skipped, by seeking over them if it can, and either returned as
+// zeros or left out of the copy
+type noErrorReader struct {
+	r    io.Reader
+	s    io.Seeker // nil if the input can't seek
+	t    *Transfer
+	zero bool
+	off  int64 // bytes read or skipped so far, for the log
+	// lim counts the bytes skipped without zero towards count/size
+	lim *limitReader
+	// m, with mapN, records what was read and what was skipped, at input
+	// offsets from base
+	m    *rescueMap
+	base int64
+}
+
+func (u *noErrorReader) Read(p []byte) (int, error) {
+	tries := 0
+	for {
+		n, err := u.r.Read(p)
+		if n > 0 || err == nil || err == io.EOF {
+			u.m.set(u.base+u.off, int64(n), '+')
+			u.off += int64(n)
+			if err != nil && err != io.EOF {
+				// the next read reports it again
+				err = nil
+			}
+			return n, err
+		}
+		if tries < u.t.ReadRetries {
+			tries++
+			continue
+		}
+		tries = 0
+		log.Printf("Transfer #%d: skipping %d unreadable bytes at input offset %d: %v", u.t.Index, len(p), u.off, err)
+		if u.s != nil {
+			// a pipe just carries on with what comes next
+			if _, serr := u.s.Seek(int64(len(p)), io.SeekCurrent); serr != nil && !errors.Is(serr, syscall.ESPIPE) {
+				return 0, fmt.Errorf("%w; skipping the bad block: %v", err, serr)
+			}
+		}
+		u.m.set(u.base+u.off, int64(len(p)), '-')
+		u.off += int64(len(p))
+		u.t.Mutex.Lock()
+		u.t.BadBlocks++
+		u.t.Mutex.Unlock()
+		if u.zero {
+			clear(p)
+			return len(p), nil
+		}
+		if u.lim != nil {
+			remain := u.lim.skip(int64(len(p)))
+			if remain <= 0 {
+				return 0, io.EOF
+			}
+			if int64(len(p)) > remain {
+				p = p[:remain]
+			}
+		}
+	}
+}
+
+// rescueMap is a ddrescue mapfile: the input split into ranges by
+// status, '+' for read, '-' for unreadable and '?' for not tried yet,
+// sorted and without gaps from 0 up to the end of the last range
+type rescueMap struct {
+	mu     sync.Mutex
+	ranges []mapRange
+}
+
+type mapRange struct {
+	pos, size int64
+	status    byte
+}
+
+// set gives [pos, pos+size) status st, splitting and merging ranges as
+// needed; it does nothing on a nil map
+func (m *rescueMap) set(pos, size int64, st byte) {
+	if m == nil || size <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.ranges); n > 0 && m.ranges[n-1].pos+m.ranges[n-1].size == pos && m.ranges[n-1].status == st {
+		// the usual case: carrying on where the last read ended
+		m.ranges[n-1].size += size
+		return
+	}
+	end := pos + size
+	if n := len(m.ranges); n == 0 || m.ranges[n-1].pos+m.ranges[n-1].size < pos {
+		// not tried up to here
+		last := int64(0)
+		if n > 0 {
+			last = m.ranges[n-1].pos + m.ranges[n-1].size
+		}
+		if last < pos {
+			m.ranges = append(m.ranges, mapRange{last, pos - last, '?'})
+		}
+	}
+	var out []mapRange
+	add := func(r mapRange) {
+		if r.size <= 0 {
+			return
+		}
+		if k := len(out) - 1; k >= 0 && out[k].status == r.status && out[k].pos+out[k].size == r.pos {
+			out[k].size += r.size
+			return
+		}
+		out = append(out, r)
+	}
+	placed := false
+	for _, r := range m.ranges {
+		rend := r.pos + r.size
+		if rend <= pos || r.pos >= end {
+			if !placed && r.pos >= end {
+				add(mapRange{pos, size, st})
+				placed = true
+			}
+			add(r)
+			continue
+		}
+		// r overlaps: keep the parts outside [pos, end)
+		add(mapRange{r.pos, pos - r.pos, r.status})
+		if !placed {
+			add(mapRange{pos, size, st})
+			placed = true
+		}
+		add(mapRange{end, rend - end, r.status})
+	}
+	if !placed {
+		add(mapRange{pos, size, st})
+	}
+	m.ranges = out
+}
+
+// readRescueMap loads a ddrescue mapfile, or returns an empty map if it
+// doesn't exist yet
+func readRescueMap(path string) (*rescueMap, error) {
+	m := &rescueMap{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading map: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	statusLine := true
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if statusLine {
+			// current_pos current_status [current_pass]
+			statusLine = false
+			continue
+		}
+		bad := len(fields) != 3 || len(fields[2]) != 1
+		var pos, size int64
+		if !bad {
+			var err1, err2 error
+			pos, err1 = strconv.ParseInt(fields[0], 0, 64)
+			size, err2 = strconv.ParseInt(fields[1], 0, 64)
+			bad = err1 != nil || err2 != nil
+		}
+		if bad {
+			return nil, fmt.Errorf("%s:%d: not a mapfile line: %q", path, line, sc.Text())
+		}
+		m.set(pos, size, fields[2][0])
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading map: %w", err)
+	}
+	return m, nil
+}
+
+// write saves m to path in ddrescue's format, through a temporary file
+// renamed into place
+func (m *rescueMap) write(path string) error {
+	m.mu.Lock()
+	var b strings.Builder
+	b.WriteString("# Mapfile. Created by dd-multi\n")
+	b.WriteString("# current_pos  current_status  current_pass\n")
+	var cur int64
+	if n := len(m.ranges); n > 0 {
+		cur = m.ranges[n-1].pos + m.ranges[n-1].size
+	}
+	fmt.Fprintf(&b, "0x%08X     +               1\n", cur)
+	b.WriteString("#      pos        size  status\n")
+	for _, r := range m.ranges {
+		fmt.Fprintf(&b, "0x%08X  0x%08X  %c\n", r.pos, r.size, r.status)
+	}
+	m.mu.Unlock()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing map: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing map: %w", err)
+	}
+	return nil
+}
+
+// count adds up the sizes of the ranges with status st
+func (m *rescueMap) count(st byte) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, r := range m.ranges {
+		if r.status == st {
+			n += r.size
+		}
+	}
+	return n
+}
+
+// with returns a copy of the ranges with status st
+func (m *rescueMap) with(st byte) []mapRange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rs []mapRange
+	for _, r := range m.ranges {
+		if r.status == st {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// rescueMinBs is the block size of the last rescue pass: one sector
+const rescueMinBs = 512
+
+// rescueTransfer makes rescue passes over the ranges t's map marks
+// unreadable (rescueN): each pass reads them in blocks an eighth the size
+// of the one before, from bs down to rescueMinBs, trying every block
+// ReadRetries more times. What it reads is written to the same place in
+// the output as a conv=noerror,sync copy puts it and marked read in the
+// map, which is saved after every pass.
+func rescueTransfer(t *Transfer) (err error) {
+	m, err := readRescueMap(t.MapFile)
+	if err != nil {
+		return &transferError{classInput, err}
+	}
+	in, err := openInput(t.InputFilename, t.Iflag)
+	if err != nil {
+		return &transferError{classInput, err}
+	}
+	defer in.Close()
+	out, err := os.OpenFile(t.OutputFilename, os.O_WRONLY, 0)
+	if err != nil {
+		return &transferError{classOutput, err}
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = &transferError{classWrite, fmt.Errorf("error closing %q: %w", t.OutputFilename, cerr)}
+		}
+	}()
+	t.Mutex.Lock()
+	t.Total = m.count('-')
+	t.Mutex.Unlock()
+
+	buf := alignedBuffer(max(t.Bs, rescueMinBs))
+	for bs := t.Bs; ; bs /= 8 {
+		bs = max(bs, rescueMinBs)
+		var recovered int64
+		for _, r := range m.with('-') {
+			for pos := r.pos; pos < r.pos+r.size; pos += bs {
+				if t.ctx != nil && t.ctx.Err() != nil {
+					return t.ctx.Err()
+				}
+				p := buf[:min(bs, r.pos+r.size-pos)]
+				var rerr error
+				for try := 0; try <= t.ReadRetries; try++ {
+					if _, rerr = in.ReadAt(p, pos); rerr == nil {
+						break
+					}
+				}
+				if rerr != nil {
+					continue
+				}
+				if _, err := out.WriteAt(p, t.SeekOff+pos-t.SkipOff); err != nil {
+					return &transferError{classWrite, err}
+				}
+				m.set(pos, int64(len(p)), '+')
+				recovered += int64(len(p))
+				t.Mutex.Lock()
+				t.Transferred += int64(len(p))
+				t.Mutex.Unlock()
+			}
+		}
+		log.Printf("Transfer #%d: rescue pass with %d-byte blocks recovered %d bytes, %d still unreadable", t.Index, bs, recovered, m.count('-'))
+		if err := m.write(t.MapFile); err != nil {
+			return &transferError{classOutput, err}
+		}
+		if bs == rescueMinBs || m.count('-') == 0 {
+			break
+		}
+	}
+
+	t.Unreadable = m.count('-')
+	if len(t.RescueFill) > 0 {
+		// a whole number of patterns, so every block starts with one
+		chunk := bytes.Repeat(t.RescueFill, int(max(t.Bs, rescueMinBs))/len(t.RescueFill)+1)
+		chunk = chunk[:len(chunk)-len(chunk)%len(t.RescueFill)]
+		for _, r := range m.with('-') {
+			for pos := r.pos; pos < r.pos+r.size; pos += int64(len(chunk)) {
+				p := chunk[:min(int64(len(chunk)), r.pos+r.size-pos)]
+				if _, err := out.WriteAt(p, t.SeekOff+pos-t.SkipOff); err != nil {
+					return &transferError{classWrite, err}
+				}
+			}
+		}
+	}
+	if hasOption(t.Conv, "fsync") || hasOption(t.Conv, "fdatasync") {
+		if err := syncOutput(t, out); err != nil {
+			return &transferError{classWrite, err}
+		}
+	}
+	return nil
+}
+
+// syncReader pads every short read with NULs to the full buffer, which
+// dd() makes one input block (conv=sync)
+type syncReader struct {
+	r io.Reader
+}
+
+func (s syncReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 && n < len(p) {
+		clear(p[n:])
+		n = len(p)
+	}
+	return n, err
+}
+
+// translateReader maps every byte it reads through a conv= character set
+// table
+type translateReader struct {
+	r     io.Reader
+	table *[256]byte
+}
+
+func (t *translateReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for i, b := range p[:n] {
+		p[i] = t.table[b]
+	}
+	return n, err
+}
+
+// swabReader swaps every pair of bytes (conv=swab). An odd byte at the end
+// of a read is held back and paired with the first byte of the next one;
+// only the very last byte of the input can stay unpaired.
+type swabReader struct {
+	r    io.Reader
+	held byte
+	has  bool
+}
+
+func (s *swabReader) Read(p []byte) (int, error) {
+	if len(p) < 2 {
+		return s.r.Read(p)
+	}
+	var n int
+	var err error
+	for n == 0 && err == nil {
+		off := 0
+		if s.has {
+			p[0] = s.held
+			s.has = false
+			off = 1
+		}
+		n, err = s.r.Read(p[off:])
+		n += off
+		if n%2 == 1 && err == nil {
+			n--
+			s.held = p[n]
+			s.has = true
+		}
+	}
+	for i := 0; i+1 < n; i += 2 {
+		p[i], p[i+1] = p[i+1], p[i]
+	}
+	return n, err
+}
+
+// shortEOFReader implements iflag=eof-on-short for devices that signal
+// the end of their data with a short or empty read instead of io.EOF
+type shortEOFReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (s *shortEOFReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+	n, err := s.r.Read(p)
+	if err == nil && n < len(p) {
+		s.done = true
+		if n == 0 {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+// fullBlockReader implements iflag=fullblock: it keeps reading until the
+// buffer, which dd() makes one input block, is full. Pipes and sockets
+// then still give conv=sync and the output whole blocks. (count= is in
+// bytes here anyway, so it needs no fullblock.)
+type fullBlockReader struct {
+	r io.Reader
+}
+
+func (f fullBlockReader) Read(p []byte) (int, error) {
+	n, empty := 0, 0
+	for n < len(p) && empty < maxEmptyReads {
+		m, err := f.r.Read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+	}
+	return n, nil
+}
+
+// maxEmptyReads is how many reads in a row may return no data and no
+// error before dd() gives up, like bufio does
+const maxEmptyReads = 100
+
+// rateLimiter is a token bucket refilled at rate bytes per second, holding
+// at most a tenth of a second's worth. It starts empty, so that a short
+// copy doesn't average more than rate.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := float64(rate) / 10
+	return &rateLimiter{rate: float64(rate), burst: burst, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping while it is in debt. A
+// block bigger than the bucket is let through at once and paid for by
+// the next wait, so any block size works and the average stays at rate.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	debt := -l.tokens
+	l.tokens -= float64(n)
+	// setRate may change the rate as soon as the lock is released
+	rate := l.rate
+	l.mu.Unlock()
+	if debt <= 0 {
+		return nil
+	}
+	var canceled <-chan struct{}
+	if ctx != nil {
+		canceled = ctx.Done()
+	}
+	timer := time.NewTimer(time.Duration(debt / rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-canceled:
+		return ctx.Err()
+	}
+}
+
+// setRate changes the rate of l, keeping what it has refilled so far
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.rate, l.burst = rate, rate/10
+	l.tokens = math.Min(l.burst, l.tokens)
+	l.mu.Unlock()
+}
+
+// sharedLimiter is -bwlimitTotal. Each running transfer draws from a
+// bucket of its own, and the total rate is divided among those buckets
+// in proportion to the transfers' weights whenever one starts or ends,
+// so that e.g. weights 3 and 1 copy at 3:1 while both run.
+type sharedLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	active map[*rateLimiter]int
+}
+
+func newSharedLimiter(rate int64) *sharedLimiter {
+	return &sharedLimiter{rate: rate, active: make(map[*rateLimiter]int)}
+}
+
+// join returns the bucket of a transfer of weight w that starts copying;
+// it must leave when it is done
+func (s *sharedLimiter) join(w int) *rateLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := newRateLimiter(s.rate)
+	s.active[l] = w
+	s.divide()
+	return l
+}
+
+// leave hands the share of l back to the transfers still running
+func (s *sharedLimiter) leave(l *rateLimiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, l)
+	s.divide()
+}
+
+func (s *sharedLimiter) divide() {
+	sum := 0
+	for _, w := range s.active {
+		sum += w
+	}
+	for l, w := range s.active {
+		l.setRate(float64(s.rate) * float64(w) / float64(sum))
+	}
+}
+
+// rateLimitReader holds reads back to l's rate (bwlimitN, -bwlimitTotal)
+type rateLimitReader struct {
+	r   io.Reader
+	ctx context.Context
+	l   *rateLimiter
+}
+
+func (r *rateLimitReader) Read(p []byte) (int, error) {
+	if err := r.l.wait(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n < len(p) {
+		// give back what wasn't read
+		r.l.mu.Lock()
+		r.l.tokens += float64(len(p) - n)
+		r.l.mu.Unlock()
+	}
+	return n, err
+}
+
+// firstWriteNotifier sends on c, without waiting, when the first
+// write succeeds
+type firstWriteNotifier struct {
+	w    io.Writer
+	c    chan<- struct{}
+	sent bool
+}
+
+func (f *firstWriteNotifier) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 && !f.sent {
+		f.sent = true
+		select {
+		case f.c <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
+
+// untilReader ends its input at the first occurrence of delim, which
+// may span reads. The last len(delim)-1 bytes read are held back until
+// it is clear they don't start a match.
+type untilReader struct {
+	r         io.Reader
+	delim     []byte
+	inclusive bool
+	buf       []byte // read but not returned yet
+	tmp       []byte
+	found     bool
+	eof       bool
+	err       error // from r, returned after buf
+}
+
+func (u *untilReader) Read(p []byte) (int, error) {
+	for {
+		if u.found || u.eof {
+			if len(u.buf) == 0 {
+				if u.err != nil {
+					return 0, u.err
+				}
+				return 0, io.EOF
+			}
+			n := copy(p, u.buf)
+			u.buf = u.buf[n:]
+			return n, nil
+		}
+		if i := bytes.Index(u.buf, u.delim); i >= 0 {
+			if u.inclusive {
+				i += len(u.delim)
+			}
+			u.buf = u.buf[:i]
+			u.found = true
+			continue
+		}
+		if safe := len(u.buf) - len(u.delim) + 1; safe > 0 {
+			n := copy(p, u.buf[:safe])
+			u.buf = u.buf[n:]
+			return n, nil
+		}
+		if len(u.tmp) < len(p) {
+			u.tmp = make([]byte, len(p))
+		}
+		n, err := u.r.Read(u.tmp[:len(p)])
+		u.buf = append(u.buf, u.tmp[:n]...)
+		if err != nil {
+			u.eof = true
+			if err != io.EOF {
+				u.err = err
+			}
+		} else if n == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// nullReader is the -nullio input: it "reads" by leaving the buffer as
+// it is
+type nullReader struct{}
+
+func (nullReader) Read(p []byte) (int, error) { return len(p), nil }
+
+// dd copies data from r to w in chunks, adding what it writes to
+// t.Transferred
+func dd(r io.Reader, w io.Writer, inBufSize int64, t *Transfer) error {
+	if inBufSize == 0 {
+		return fmt.Errorf("input buffer size is zero")
+	}
+	buf := alignedBuffer(inBufSize)
+	empty := 0
+	for {
+		n, err := r.Read(buf)
+		if n == 0 && err == nil {
+			if empty++; empty == maxEmptyReads {
+				return &transferError{classRead, fmt.Errorf("error reading: %w (try iflag=eof-on-short)", io.ErrNoProgress)}
+			}
+			continue
+		}
+		empty = 0
+		// io.Writer may write less than asked without an error, so
+		// keep writing the rest and count only what was written
+		for off := 0; off < n; {
+			m, writeErr := w.Write(buf[off:n])
+			off += m
+			// the progress display reads it while the copy runs
+			t.Mutex.Lock()
+			t.Transferred += int64(m)
+			t.Mutex.Unlock()
+			if writeErr == nil && m == 0 {
+				writeErr = io.ErrShortWrite
+			}
+			if writeErr != nil {
+				return &transferError{classWrite, fmt.Errorf("error writing: %w", writeErr)}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return &transferError{classRead, fmt.Errorf("error reading: %w", err)}
+		}
+	}
+	return nil
+}
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of
+// directAlign, which O_DIRECT needs
+func alignedBuffer(size int64) []byte {
+	buf := make([]byte, size+directAlign)
+	off := int(-uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1))
+	return buf[off : off+int(size)]
+}
+
+// directReader and directWriter implement iflag=direct and oflag=direct.
+// O_DIRECT rejects requests whose buffer, length or file offset isn't
+// aligned to the device's blocks with EINVAL; this happens for the short
+// last block, a count or skip that isn't a whole number of sectors, and
+// on some filesystems. They then turn O_DIRECT off for the rest of the
+// transfer and try again, as dd does.
+type directReader struct {
+	r   io.Reader
+	f   *os.File
+	off bool
+}
+
+func (d *directReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n == 0 && !d.off && errors.Is(err, syscall.EINVAL) {
+		d.off = true
+		if cerr := clearDirect(d.f); cerr != nil {
+			return 0, err
+		}
+		return d.r.Read(p)
+	}
+	return n, err
+}
+
+type directWriter struct {
+	w   io.Writer
+	f   *os.File
+	off bool
+}
+
+func (d *directWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if n == 0 && !d.off && errors.Is(err, syscall.EINVAL) {
+		d.off = true
+		if cerr := clearDirect(d.f); cerr != nil {
+			return 0, err
+		}
+		return d.w.Write(p)
+	}
+	return n, err
+}
+
+// limitReader is like io.LimitReader, but the limit can be raised or
+// lowered while the transfer is running.
+type limitReader struct {
+	r     io.Reader
+	c     io.Closer // the opened input, nil for stdin
+	mu    sync.Mutex
+	limit int64
+	read  int64
+}
+
+func newLimitReader(r io.Reader, limit int64, c io.Closer) *limitReader {
+	return &limitReader{r: r, c: c, limit: limit}
+}
+
+// Close closes the underlying input, if inFile opened one
+func (l *limitReader) Close() error {
+	if l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	remain := l.limit - l.read
+	l.mu.Unlock()
+	if remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	n, err := l.r.Read(p)
+	l.mu.Lock()
+	l.read += int64(n)
+	l.mu.Unlock()
+	return n, err
+}
+
+// skip counts n bytes that were skipped instead of read towards the
+// limit and returns how many are left
+func (l *limitReader) skip(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.read += n
+	return l.limit - l.read
+}
+
+// SetLimit changes the total number of bytes the reader will return.
+func (l *limitReader) SetLimit(n int64) {
+	l.mu.Lock()
+	l.limit = n
+	l.mu.Unlock()
+}
+
+// SetLimit adjusts the byte limit of a running transfer. Lowering it below
+// what was already read ends the transfer at its next read.
+func (t *Transfer) SetLimit(n int64) {
+	t.Mutex.Lock()
+	t.Total = n
+	lr := t.limiter
+	t.Mutex.Unlock()
+	if lr != nil {
+		lr.SetLimit(n)
+	}
+}
+
+// controlHandler answers -control requests. The only one is
+//
+//	POST /transfers/N/limit?bytes=B
+//
+// which sets the byte limit of transfer N to B (see SetLimit).
+func controlHandler(transfers []*Transfer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var index int
+		var action string
+		if _, err := fmt.Sscanf(r.URL.Path, "/transfers/%d/%s", &index, &action); err != nil || action != "limit" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var t *Transfer
+		for _, tr := range transfers {
+			if tr.Index == index {
+				t = tr
+			}
+		}
+		if t == nil {
+			http.Error(w, fmt.Sprintf("no transfer #%d", index), http.StatusNotFound)
+			return
+		}
+		n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "bytes must be a number of bytes", http.StatusBadRequest)
+			return
+		}
+		t.Mutex.Lock()
+		running := t.limiter != nil && !t.Finished
+		t.Mutex.Unlock()
+		if !running {
+			http.Error(w, fmt.Sprintf("transfer #%d isn't running", index), http.StatusConflict)
+			return
+		}
+		t.SetLimit(n)
+		fmt.Fprintf(w, "transfer #%d limited to %d bytes\n", index, n)
+	})
+}
+
+// inFile sets up the input with skip & limit. skipOff is in bytes and
+// limit is the number of bytes to copy, or -1 to copy until EOF.
+func inFile(stdin io.Reader, name string, skipOff, limit int64, flags int, followStop <-chan struct{}, totalOut *int64) (*limitReader, error) {
+	if limit < 0 {
+		limit = math.MaxInt64
+	} else {
+		*totalOut = limit
+	}
+
+	if name == "" {
+		r := stdin
+		if skipOff > 0 {
+			_, err := io.CopyN(io.Discard, r, skipOff)
+			if err != nil {
+				return nil, fmt.Errorf("error skipping stdin: %w", err)
+			}
+		}
+		return newLimitReader(r, limit, nil), nil
+	}
+
+	if isURL(name) {
+		r, length, err := openHTTP(name, skipOff)
+		if err != nil {
+			return nil, err
+		}
+		if limit == math.MaxInt64 && length >= 0 {
+			*totalOut = length
+		}
+		return newLimitReader(r, limit, r), nil
+	}
+
+	in, err := openInput(name, flags&allowedInFlags)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input %q: %w", name, err)
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return nil, fmt.Errorf("error stating %q: %w", name, err)
+	}
+	if fi.Mode().IsRegular() {
+		_, err := in.Seek(skipOff, io.SeekStart)
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("error seeking %q: %w", name, err)
+		}
+		var r io.Reader = in
+		if followStop != nil {
+			r = &followReader{r: in, stop: followStop}
+		} else if limit == math.MaxInt64 {
+			*totalOut = fi.Size() - skipOff
+		}
+		// a followed input keeps growing, so its total stays unknown
+		return newLimitReader(r, limit, in), nil
+	}
+	// Disks report their size, so the copy stops exactly at the end even
+	// when it isn't a multiple of bs, and count/size can't overshoot it.
+	if fi.Mode()&os.ModeDevice != 0 {
+		if devSize := deviceSizeOf(in); devSize > 0 {
+			if _, err := in.Seek(skipOff, io.SeekStart); err != nil {
+				in.Close()
+				return nil, fmt.Errorf("error seeking %q: %w", name, err)
+			}
+			remain := devSize - skipOff
+			if remain < 0 {
+				remain = 0
+			}
+			if limit > remain {
+				limit = remain
+			}
+			*totalOut = limit
+			return newLimitReader(in, limit, in), nil
+		}
+	}
+	// non-regular
+	r := in
+	if skipOff > 0 {
+		_, err := io.CopyN(io.Discard, r, skipOff)
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("error skipping in %q: %w", name, err)
+		}
+	}
+	return newLimitReader(r, limit, in), nil
+}
+
+// sharedSource reads one input for several transfers (-shareSource):
+// each block read is handed to every member in turn through a pipe, so
+// the input is read once however many outputs it is copied to. Reading
+// starts once every member has joined or given up; a member that stops
+// early is dropped and the rest carry on.
+type sharedSource struct {
+	name       string
+	skipOff    int64
+	limit      int64
+	flags      int
+	followStop <-chan struct{}
+	bs         int64
+
+	mu      sync.Mutex
+	waiting int
+	joined  map[int]bool
+	members []sharedMember
+	opened  bool
+	in      *limitReader
+	total   int64
+	err     error
+}
+
+type sharedMember struct {
+	index int
+	pw    *io.PipeWriter
+}
+
+func newSharedSource(t *Transfer, limit int64, members int) *sharedSource {
+	return &sharedSource{
+		name:       t.InputFilename,
+		skipOff:    t.SkipOff,
+		limit:      limit,
+		flags:      t.Iflag,
+		followStop: t.followStop,
+		bs:         t.Bs,
+		waiting:    members,
+		joined:     map[int]bool{},
+	}
+}
+
+// open joins transfer t to the source, opening the input for the first
+// member. The returned reader gets every block of the input.
+func (s *sharedSource) open(t *Transfer, stdin io.Reader) (*limitReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened {
+		s.opened = true
+		s.in, s.err = inFile(stdin, s.name, s.skipOff, s.limit, s.flags, s.followStop, &s.total)
+	}
+	s.joined[t.Index] = true
+	s.waiting--
+	if s.err != nil {
+		return nil, s.err
+	}
+	pr, pw := io.Pipe()
+	s.members = append(s.members, sharedMember{t.Index, pw})
+	t.Mutex.Lock()
+	t.Total = s.total
+	t.Mutex.Unlock()
+	if s.waiting == 0 {
+		go s.pump()
+	}
+	return newLimitReader(pr, math.MaxInt64, pr), nil
+}
+
+// leave gives up the place of a transfer that never got to open the
+// source, e.g. because it was canceled before it started
+func (s *sharedSource) leave(t *Transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.joined[t.Index] {
+		return
+	}
+	s.joined[t.Index] = true
+	s.waiting--
+	if s.waiting == 0 && s.in != nil {
+		go s.pump()
+	}
+}
+
+func (s *sharedSource) pump() {
+	defer s.in.Close()
+	members := s.members
+	buf := make([]byte, s.bs)
+	for len(members) > 0 {
+		n, err := s.in.Read(buf)
+		if n > 0 {
+			kept := members[:0]
+			for _, m := range members {
+				// a member that closed its end has stopped copying
+				if _, werr := m.pw.Write(buf[:n]); werr == nil {
+					kept = append(kept, m)
+				}
+			}
+			members = kept
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			for _, m := range members {
+				m.pw.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
+
+// isURL reports whether an input name is an http(s) URL
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// inputClient fetches URL inputs; -sockBuf replaces it with one whose
+// connections have larger socket buffers
+var inputClient = http.DefaultClient
+
+// sockBufClient returns an HTTP client that sets SO_RCVBUF and SO_SNDBUF
+// to size on every connection it dials, for high-latency links
+func sockBufClient(size int) *http.Client {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setSockBufs(fd, size)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("error setting socket buffers: %w", serr)
+			}
+			return nil
+		},
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = d.DialContext
+	return &http.Client{Transport: tr}
+}
+
+// openHTTP starts downloading url at byte offset off and returns the body
+// and the number of bytes it will deliver (-1 if unknown). A non-zero
+// offset is requested with a Range header; the server has to honor it,
+// since silently restarting from byte 0 would corrupt a resumed output.
+func openHTTP(url string, off int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening input %q: %w", url, err)
+	}
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening input %q: %w", url, err)
+	}
+
+	switch {
+	case off == 0 && resp.StatusCode == http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case off > 0 && resp.StatusCode == http.StatusPartialContent:
+		var start, end, total int64
+		cr := resp.Header.Get("Content-Range")
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("input %q: bad Content-Range %q", url, cr)
+		}
+		if start != off || end+1 != total || (resp.ContentLength >= 0 && resp.ContentLength != total-off) {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("input %q: server sent range %q, wanted bytes %d- of the whole file", url, cr, off)
+		}
+		return resp.Body, total - off, nil
+	case off > 0 && resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			return nil, 0, fmt.Errorf("input %q: server doesn't support range requests, can't start at byte %d", url, off)
+		}
+		return nil, 0, fmt.Errorf("input %q: server ignored the range request for byte %d", url, off)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		// a resumed download that was already complete
+		var total int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total); err == nil && total == off {
+			return http.NoBody, 0, nil
+		}
+		return nil, 0, fmt.Errorf("input %q: offset %d is past the end of the file", url, off)
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("error opening input %q: %s", url, resp.Status)
+	}
+}
+
+// followPoll is how often a followed input is checked for new data
+const followPoll = 500 * time.Millisecond
+
+// followReader reads a growing file like tail -f: at EOF it waits for more
+// data instead of ending, until stop is closed.
+type followReader struct {
+	r    io.Reader
+	stop <-chan struct{}
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-f.stop:
+			return 0, io.EOF
+		case <-time.After(followPoll):
+		}
+	}
+}
+
+// openRetries and openRetryDelay make retryOpen try again when a
+// device is busy or not ready (-openRetries, -openRetryDelay)
+var (
+	openRetries    int
+	openRetryDelay = time.Second
+)
+
+// linuxENOMEDIUM is what opening a removable drive without media
+// returns on Linux; FreeBSD uses ENXIO
+const linuxENOMEDIUM = syscall.Errno(123)
+
+// openNotReady reports whether an open error is likely to go away by
+// itself: the device is still in use (e.g. just unmounted) or not ready
+func openNotReady(err error) bool {
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ENXIO) {
+		return true
+	}
+	return runtime.GOOS == "linux" && errors.Is(err, linuxENOMEDIUM)
+}
+
+// retryOpen calls open, retrying up to openRetries times while the
+// file is busy or not ready, waiting openRetryDelay and then twice as
+// long each time
+func retryOpen(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+	delay := openRetryDelay
+	for attempt := 1; ; attempt++ {
+		f, err := open(name, flag, perm)
+		if err == nil || attempt > openRetries || !openNotReady(err) {
+			return f, err
+		}
+		log.Printf("%v; retry %d of %d in %s", err, attempt, openRetries, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// readonlyInputs (-readonlyInputs) makes openInput check that every
+// input it opens really is read-only
+var readonlyInputs bool
+
+// openInput opens name read-only with the given iflag bits. O_NOATIME is
+// only allowed for the file's owner, so on EPERM we retry without it;
+// likewise without O_DIRECT where the filesystem rejects it with EINVAL.
+func openInput(name string, flags int) (*os.File, error) {
+	if isFD(name) {
+		return fdFile(name, false)
+	}
+	in, err := retryOpen(openFile, name, os.O_RDONLY|flags, 0)
+	if err != nil && flags&oNoatime != 0 && errors.Is(err, syscall.EPERM) {
+		log.Printf("Warning: O_NOATIME not permitted on %q, opening without it", name)
+		flags &^= oNoatime
+		in, err = openFile(name, os.O_RDONLY|flags, 0)
+	}
+	if err != nil && flags&oDirect != 0 && errors.Is(err, syscall.EINVAL) {
+		log.Printf("Warning: O_DIRECT not supported on %q, opening without it", name)
+		in, err = openFile(name, os.O_RDONLY|(flags&^oDirect), 0)
+	}
+	if err == nil && readonlyInputs {
+		if err = checkReadOnly(in); err != nil {
+			in.Close()
+			return nil, err
+		}
+	}
+	return in, err
+}
+
+// isFD reports whether a name is an inherited descriptor, "fd:N"
+func isFD(name string) bool {
+	return strings.HasPrefix(name, "fd:")
+}
+
+// outFile sets up output with seek & flags; seekOff is in bytes
+func outFile(stdout io.WriteSeeker, name string, seekOff int64, flags int, fullAlloc bool) (io.Writer, error) {
+	if name == "" {
+		return stdout, nil
+	}
+	// O_TRUNC is never passed to open: devices and pipes can't be
+	// truncated, and a regular file is cut at the seek offset like dd does.
+	perm := os.O_WRONLY | (flags & allowedFlags &^ os.O_TRUNC)
+	var f *os.File
+	var err error
+	if isFD(name) {
+		f, err = fdFile(name, true)
+	} else {
+		f, err = retryOpen(openFile, name, perm, 0o666)
+		if err != nil && perm&oDirect != 0 && errors.Is(err, syscall.EINVAL) {
+			log.Printf("Warning: O_DIRECT not supported on %q, opening without it", name)
+			f, err = openFile(name, perm&^oDirect, 0o666)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening output %q: %w", name, err)
+	}
+	if flags&os.O_APPEND != 0 {
+		// every write goes to the end anyway; move there so the offset
+		// says where the appended data starts (pipes can't seek)
+		f.Seek(0, io.SeekEnd)
+		return f, nil
+	}
+	// allocate before truncating, which would extend the file with a hole
+	if fullAlloc {
+		if err := fillZeros(f, seekOff); err != nil {
+			return nil, fmt.Errorf("error allocating %q: %w", name, err)
+		}
+	}
+	if flags&os.O_TRUNC != 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("error stating %q: %w", name, err)
+		}
+		if fi.Mode().IsRegular() {
+			if err := f.Truncate(seekOff); err != nil {
+				return nil, fmt.Errorf("error truncating %q: %w", name, err)
+			}
+		}
+	}
+	if seekOff != 0 {
+		if _, err := f.Seek(seekOff, io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("error seeking %q: %w", name, err)
+		}
+	}
+	return f, nil
+}
+
+// fillZeros writes zeros from the end of a regular file up to off, so
+// seeking there afterwards doesn't leave a hole (conv=fullalloc).
+func fillZeros(f *os.File, off int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() >= off {
+		return nil
+	}
+	if _, err := f.Seek(fi.Size(), io.SeekStart); err != nil {
+		return err
+	}
+	zeros := make([]byte, 64*1024)
+	for remain := off - fi.Size(); remain > 0; {
+		n := int64(len(zeros))
+		if n > remain {
+			n = remain
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		remain -= n
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// ioctl requests for a device's physical sector size, total size and
+// optimal I/O size (stripe size on FreeBSD)
+const (
+	linuxBLKPBSZGET        = 0x127b     // _IO(0x12, 123)
+	linuxBLKGETSIZE64      = 0x80081272 // _IOR(0x12, 114, size_t)
+	linuxBLKIOOPT          = 0x1279     // _IO(0x12, 121)
+	freebsdDIOCGSECTORSIZE = 0x40046480 // _IOR('d', 128, u_int)
+	freebsdDIOCGMEDIASIZE  = 0x40086481 // _IOR('d', 129, off_t)
+	freebsdDIOCGSTRIPESIZE = 0x4008648b // _IOR('d', 139, off_t)
+)
+
+// sectorSize returns the physical sector size of the device at name, or 0
+// if name isn't a device or the size can't be queried on this platform.
+func sectorSize(name string) int64 {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeDevice == 0 {
+		return 0
+	}
+	var sz uint32
+	if devIoctl(f, linuxBLKPBSZGET, freebsdDIOCGSECTORSIZE, unsafe.Pointer(&sz)) != nil {
+		return 0
+	}
+	return int64(sz)
+}
+
+// autoBlockSizeMin keeps bs=auto from picking a size too small for good
+// throughput (filesystems often report 4K)
+const autoBlockSizeMin = 64 * 1024
+
+// autoBlockSize picks bs=auto from the optimal I/O size of the output,
+// or failing that the input: the device's BLKIOOPT (stripe size on
+// FreeBSD) or the filesystem's block size. It also says where the size
+// came from.
+func autoBlockSize(names ...string) (int64, string) {
+	for _, name := range names {
+		if name == "" || isURL(name) {
+			continue
+		}
+		if sz := optimalIOSizeOf(name); sz > 0 {
+			if sz < autoBlockSizeMin {
+				return autoBlockSizeMin, fmt.Sprintf("%s reports %d, raised to the minimum", name, sz)
+			}
+			return sz, "optimal I/O size of " + name
+		}
+	}
+	return autoBlockSizeMin, "no optimal I/O size reported, using the minimum"
+}
+
+func optimalIOSize(name string) int64 {
+	if fi, err := os.Stat(name); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0
+		}
+		defer f.Close()
+		if runtime.GOOS == "freebsd" {
+			var sz int64
+			if devIoctl(f, 0, freebsdDIOCGSTRIPESIZE, unsafe.Pointer(&sz)) != nil {
+				return 0
+			}
+			return sz
+		}
+		var sz uint32
+		if devIoctl(f, linuxBLKIOOPT, 0, unsafe.Pointer(&sz)) != nil {
+			return 0
+		}
+		return int64(sz)
+	} else if err != nil {
+		// outputs may not exist yet; ask their directory's filesystem
+		name = filepath.Dir(name)
+	}
+	return fsBlockSize(name)
+}
+
+// deviceSize returns the size in bytes of the disk device f, or 0 if f
+// isn't one or the size can't be queried.
+func deviceSize(f *os.File) int64 {
+	var sz int64
+	if devIoctl(f, linuxBLKGETSIZE64, freebsdDIOCGMEDIASIZE, unsafe.Pointer(&sz)) != nil {
+		return 0
+	}
+	return sz
+}
+
+// checkAlignment warns when a transfer's skip or seek byte offset isn't a
+// multiple of the device's physical sector size, which means slow
+// read-modify-write cycles (or failures with O_DIRECT). With strict it's an
+// error instead; with round the offset is rounded down and reported.
+func checkAlignment(t *Transfer, strict, round bool) error {
+	check := func(what, name string, off *int64) error {
+		if name == "" || *off == 0 {
+			return nil
+		}
+		sector := alignSectorSize(name)
+		if sector <= 0 || *off%sector == 0 {
+			return nil
+		}
+		msg := fmt.Sprintf("transfer #%d: %s offset %d is not a multiple of %s's %d-byte physical sectors",
+			t.Index, what, *off, name, sector)
+		switch {
+		case round:
+			adjusted := *off - *off%sector
+			log.Printf("%s; rounded down to %d (%d bytes)", msg, adjusted, adjusted-*off)
+			*off = adjusted
+		case strict:
+			return errors.New(msg)
+		default:
+			log.Printf("Warning: %s", msg)
+		}
+		return nil
+	}
+	if err := check("skip", t.InputFilename, &t.SkipOff); err != nil {
+		return err
+	}
+	return check("seek", t.OutputFilename, &t.SeekOff)
+}
+
+func usage() {
+	log.Fatal(`Multi-Transfer dd. Use -numTransfers=N to specify how many sets of numbered options are used.
+Example:
+ ./dd_multi_n -numTransfers=3 \
+   -if1=/dev/zero -of1=file1.img -bs1=4M -size1=1G ...
+   -if2=/dev/urandom -of2=file2.img -bs2=1M -size2=2G ...
+   -if3=input.iso -of3=device -count3=700 ...
+A single transfer can also be given like dd:
+ ./dd_multi_n if=input.iso of=device bs=4M
+`)
+}
+
+// Convert x=y to -x y for the flag package
+func convertArgs(osArgs []string) []string {
+	var args []string
+	for i, v := range osArgs {
+		// -flag=value is already flag syntax; splitting it would break
+		// boolean-style flags such as -resume=verify
+		if strings.HasPrefix(v, "-") {
+			args = append(args, v)
+			continue
+		}
+		// a -transfer spec is one value, whatever = it contains
+		if i > 0 && strings.TrimLeft(osArgs[i-1], "-") == "transfer" {
+			args = append(args, v)
+			continue
+		}
+		l := strings.SplitN(v, "=", 2)
+		if len(l) == 2 {
+			l[0] = "-" + l[0]
+		}
+		args = append(args, l...)
+	}
+	return args
+}
+
+// transferSpecs collects the -transfer options, each one transfer given
+// as dd operands, e.g. "if=/dev/zero of=a.img bs=4M size=1G"
+type transferSpecs []string
+
+func (t *transferSpecs) String() string {
+	if t == nil {
+		return ""
+	}
+	return strings.Join(*t, "; ")
+}
+
+func (t *transferSpecs) Set(s string) error {
+	*t = append(*t, s)
+	return nil
+}
+
+// applyTransferSpecs turns each -transfer spec into the numbered options
+// of a transfer after the numTransfers already given, and counts them in
+func applyTransferSpecs(tfs *transferFlagSet, specs transferSpecs, numTransfers *int) error {
+	base := *numTransfers
+	for k, spec := range specs {
+		for _, field := range strings.Fields(spec) {
+			name, val, ok := strings.Cut(strings.TrimLeft(field, "-"), "=")
+			if !ok {
+				return fmt.Errorf("-transfer %q: %q is not a transfer option (if=, of=, bs= ...)", spec, field)
+			}
+			if err := tfs.set(base+k+1, name, val); err != nil {
+				return fmt.Errorf("-transfer %q: %w", spec, err)
+			}
+		}
+	}
+	*numTransfers = base + len(specs)
+	return nil
+}
+
+// transferFlags holds the numbered flags of one transfer
+type transferFlags struct {
+	in, out, name, bs, ibs, obs, conv, oflag, iflag string
+	hash, expect, until, after, phase               string
+	ioclass, ioprio, nice, mapFile, rescue, fill    string
+	partition, readRetries, prio, iopslimit, weight int
+	count, skip, seek, size                         int64
+	bwlimit                                         string
+	delay                                           time.Duration
+}
+
+// transferFlagSet defines the numbered flags of transfers 1, 2, ... in f
+// as they are needed, so there is no fixed limit on their number
+type transferFlagSet struct {
+	f *flag.FlagSet
+	t []*transferFlags
+}
+
+// define makes sure transfers 1 to n have their flags
+func (s *transferFlagSet) define(n int) {
+	for i := len(s.t) + 1; i <= n; i++ {
+		tv := &transferFlags{}
+		f := s.f
+		f.StringVar(&tv.in, fmt.Sprintf("if%d", i), "",
+			fmt.Sprintf("Input file #%d", i))
+		f.StringVar(&tv.out, fmt.Sprintf("of%d", i), "",
+			fmt.Sprintf("Output file #%d", i))
+		f.StringVar(&tv.name, fmt.Sprintf("name%d", i), "",
+			fmt.Sprintf("Name of transfer #%d in the display and summary", i))
+		f.StringVar(&tv.bs, fmt.Sprintf("bs%d", i), "",
+			fmt.Sprintf("Block size #%d", i))
+		f.StringVar(&tv.ibs, fmt.Sprintf("ibs%d", i), "",
+			fmt.Sprintf("Input block size #%d, if bs%d isn't given", i, i))
+		f.StringVar(&tv.obs, fmt.Sprintf("obs%d", i), "",
+			fmt.Sprintf("Output block size #%d, if bs%d isn't given", i, i))
+		f.StringVar(&tv.conv, fmt.Sprintf("conv%d", i), "none",
+			fmt.Sprintf("Conversions #%d", i))
+		f.StringVar(&tv.oflag, fmt.Sprintf("oflag%d", i), "none",
+			fmt.Sprintf("Output flags #%d", i))
+		f.StringVar(&tv.iflag, fmt.Sprintf("iflag%d", i), "none",
+			fmt.Sprintf("Input flags #%d", i))
+		f.IntVar(&tv.partition, fmt.Sprintf("partition%d", i), 0,
+			fmt.Sprintf("Copy only this partition of input #%d (MBR or GPT)", i))
+		f.StringVar(&tv.hash, fmt.Sprintf("hash%d", i), "",
+			fmt.Sprintf("Digest to compute for #%d (md5, sha1, sha256, sha512)", i))
+		f.StringVar(&tv.expect, fmt.Sprintf("expect%d", i), "",
+			fmt.Sprintf("Expected hex digest of #%d", i))
+		f.StringVar(&tv.bwlimit, fmt.Sprintf("bwlimit%d", i), "",
+			fmt.Sprintf("Copy #%d at most this many bytes per second (e.g. 50M)", i))
+		f.IntVar(&tv.weight, fmt.Sprintf("weight%d", i), 1,
+			fmt.Sprintf("Share of -bwlimitTotal #%d gets relative to the other running transfers' weights", i))
+		f.StringVar(&tv.mapFile, fmt.Sprintf("map%d", i), "",
+			fmt.Sprintf("With conv%d=noerror, record the read and unreadable input ranges of #%d in this ddrescue mapfile", i, i))
+		f.StringVar(&tv.rescue, fmt.Sprintf("rescue%d", i), "",
+			fmt.Sprintf("Re-read only the ranges this ddrescue mapfile marks unreadable into the existing output #%d, in ever smaller blocks", i))
+		f.StringVar(&tv.fill, fmt.Sprintf("fill%d", i), "",
+			fmt.Sprintf("With rescue%d, overwrite what stays unreadable with these hex bytes, repeated", i))
+		f.IntVar(&tv.readRetries, fmt.Sprintf("retries%d", i), 0,
+			fmt.Sprintf("With conv=noerror, read a bad block of #%d this many more times before skipping it", i))
+		f.StringVar(&tv.until, fmt.Sprintf("until%d", i), "",
+			fmt.Sprintf("Stop input #%d at the first occurrence of these hex bytes", i))
+		f.StringVar(&tv.after, fmt.Sprintf("after%d", i), "",
+			fmt.Sprintf("Start #%d only after these transfers (e.g. 1,2) finished successfully", i))
+		f.StringVar(&tv.phase, fmt.Sprintf("phase%d", i), "",
+			fmt.Sprintf("Phase of #%d; phases run one after another in order of first use", i))
+		f.IntVar(&tv.prio, fmt.Sprintf("prio%d", i), 0,
+			fmt.Sprintf("Priority of #%d: higher ones take a free slot first (start order only; see weight%d for bandwidth)", i, i))
+		f.IntVar(&tv.iopslimit, fmt.Sprintf("iopslimit%d", i), 0,
+			fmt.Sprintf("Read #%d at most this many blocks per second", i))
+		f.StringVar(&tv.ioclass, fmt.Sprintf("ioclass%d", i), "",
+			fmt.Sprintf("I/O scheduling class of #%d (rt, be, idle), overriding -ioclass", i))
+		f.StringVar(&tv.ioprio, fmt.Sprintf("ioprio%d", i), "",
+			fmt.Sprintf("I/O priority of #%d within its class (0-7), overriding -ioprio", i))
+		f.StringVar(&tv.nice, fmt.Sprintf("nice%d", i), "",
+			fmt.Sprintf("CPU nice value of #%d (-20 to 19), overriding -nice", i))
+		f.DurationVar(&tv.delay, fmt.Sprintf("delay%d", i), 0,
+			fmt.Sprintf("Start #%d only this long (e.g. 30s) after the copying begins", i))
+
+		f.Int64Var(&tv.count, fmt.Sprintf("count%d", i), math.MaxInt64,
+			fmt.Sprintf("Blocks #%d (bytes with iflag%d=count_bytes)", i, i))
+		f.Int64Var(&tv.skip, fmt.Sprintf("skip%d", i), 0,
+			fmt.Sprintf("Skip #%d blocks (bytes with iflag%d=skip_bytes)", i, i))
+		f.Int64Var(&tv.seek, fmt.Sprintf("seek%d", i), 0,
+			fmt.Sprintf("Seek #%d blocks (bytes with oflag%d=seek_bytes)", i, i))
+		f.Int64Var(&tv.size, fmt.Sprintf("size%d", i), 0,
+			fmt.Sprintf("Total bytes #%d", i))
+		s.t = append(s.t, tv)
+	}
+}
+
+// set sets the per-transfer option name (e.g. "bs") of transfer i
+func (s *transferFlagSet) set(i int, name, val string) error {
+	if s.f.Lookup(name+"1") == nil {
+		return fmt.Errorf("%q is not a transfer option (if, of, bs ...)", name)
+	}
+	s.define(i)
+	if err := s.f.Set(name+strconv.Itoa(i), val); err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	return nil
+}
+
+// highestTransfer is the highest transfer number in args' numbered
+// options (e.g. 72 for -of72=/dev/sdbt), which must be defined before
+// they are parsed
+func highestTransfer(f *flag.FlagSet, args []string) int {
+	n := 0
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		full, _, _ := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		name := strings.TrimRight(full, "0123456789")
+		if name == full || f.Lookup(name+"1") == nil {
+			continue
+		}
+		if i, err := strconv.Atoi(full[len(name):]); err == nil && i > n {
+			n = i
+		}
+	}
+	return n
+}
+
+// manifest is a -config file: global options and a list of transfers,
+// each with the per-transfer options without their number, e.g.
+//
+//	{"options": {"verify": true},
+//	 "transfers": [{"name": "boot", "if": "disk.img", "of": "/dev/sdb", "bs": "4M"}]}
+type manifest struct {
+	Options   map[string]any   `json:"options"`
+	Transfers []map[string]any `json:"transfers"`
+}
+
+// manifestValue formats a JSON value as a flag value
+func manifestValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		// a list, such as "after": [1, 2], is given comma-separated
+		parts := make([]string, len(v))
+		for i, e := range v {
+			p, err := manifestValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = p
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("want a string, number, boolean or list, not %v", v)
+}
+
+// manifestOption is the value of fl for a manifest: typed where the
+// flag has a plain type, else its string form
+func manifestOption(fl *flag.Flag) any {
+	if g, ok := fl.Value.(flag.Getter); ok {
+		switch v := g.Get().(type) {
+		case bool, int, int64, float64, string:
+			return v
+		}
+	}
+	return fl.Value.String()
+}
+
+// notInManifest are the options a manifest can't hold or that only make
+// sense on the command line
+var notInManifest = map[string]bool{"config": true, "dumpConfig": true, "transfer": true, "numTransfers": true, "jobStdin": true}
+
+// writeConfig writes the options set in f, and those of transfers 1 to
+// n, as a -config manifest to path, or to stdout for "-" (-dumpConfig)
+func writeConfig(f *flag.FlagSet, path string, n int, stdout io.Writer) error {
+	m := manifest{Options: map[string]any{}, Transfers: make([]map[string]any, n)}
+	for i := range m.Transfers {
+		m.Transfers[i] = map[string]any{}
+	}
+	f.Visit(func(fl *flag.Flag) {
+		if notInManifest[fl.Name] {
+			return
+		}
+		name := strings.TrimRight(fl.Name, "0123456789")
+		if name != fl.Name && f.Lookup(name+"1") != nil {
+			if i, err := strconv.Atoi(fl.Name[len(name):]); err == nil && i >= 1 && i <= n {
+				m.Transfers[i-1][name] = manifestOption(fl)
+			}
+			return
+		}
+		m.Options[fl.Name] = manifestOption(fl)
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0o666)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing -dumpConfig: %w", err)
+	}
+	return nil
+}
+
+// loadConfig applies the -config manifest at path: its options unless
+// the command line set them too, and its transfers after the
+// numTransfers already given
+func loadConfig(tfs *transferFlagSet, path string, numTransfers *int) error {
+	f := tfs.f
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading -config: %w", err)
+	}
+	var m manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return fmt.Errorf("error parsing -config %s: %w", path, err)
+	}
+	given := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+	for name, v := range m.Options {
+		if name == "config" || name == "numTransfers" || f.Lookup(name) == nil {
+			return fmt.Errorf("-config %s: %q is not a global option", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		val, err := manifestValue(v)
+		if err == nil {
+			err = f.Set(name, val)
+		}
+		if err != nil {
+			return fmt.Errorf("-config %s: option %s: %w", path, name, err)
+		}
+	}
+	base := *numTransfers
+	for k, tr := range m.Transfers {
+		for name, v := range tr {
+			if name == "depends_on" {
+				name = "after"
+			}
+			val, err := manifestValue(v)
+			if err == nil {
+				err = tfs.set(base+k+1, name, val)
+			}
+			if err != nil {
+				return fmt.Errorf("-config %s: transfer %d: %s: %w", path, k+1, name, err)
+			}
+		}
+	}
+	*numTransfers = base + len(m.Transfers)
+	return nil
+}
+
+// ddCompatArgs lets dd-style operands without a transfer number (if=,
+// of=, bs=, count= ...) stand for those of transfer 1, so dd-multi can be
+// used in place of dd. It reports whether there were any.
+func ddCompatArgs(f *flag.FlagSet, args []string) ([]string, bool) {
+	used := false
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = a
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name, val, hasVal := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if f.Lookup(name) != nil || f.Lookup(name+"1") == nil {
+			continue
+		}
+		out[i] = "-" + name + "1"
+		if hasVal {
+			out[i] += "=" + val
+		}
+		used = true
+	}
+	return out, used
+}
+
+func main() {
+	if err := run(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runOptions holds the global, unnumbered flags of a run
+type runOptions struct {
+	numTransfers, maxConcurrent, maxOpenFiles, outputWrap      int
+	hookStep, retries, openRetries, perDevice                  int
+	fullscreen, singleLine, aggregate, summaryOnly, fast       bool
+	atomic, keepPartial, verify, strict, alignRound, follow    bool
+	webhookEach, jobStdin, failFast, pickDevice, absPos        bool
+	readonlyInputs, shareSource, nullio, checkSpace            bool
+	appendChecksum, verifyAppended, untilInclusive, emitDd     bool
+	collapseFinished, finalChart, deviceInfo                   bool
+	control, traceFile, inputEncoding, verifyBs, config        string
+	dumpConfig, checkpoint, resumeMismatch, sampleVerify       string
+	outputEncoding, overwriteMode, progressHook, webhook       string
+	sockBuf, onError, progressSocket, ioclass, ioprio, nice    string
+	oomScoreAdj, cgroup, statsCsv, record, replay, labelFormat string
+	status, bwlimitTotal                                       string
+	specs                                                      transferSpecs
+	resume                                                     resumeFlag
+	checkpointInterval, openRetryDelay, retryBackoff           time.Duration
+	maxBackoff, warmup, statsInterval                          time.Duration
+	sampleSeed, retrySeed                                      int64
+	maxLoad                                                    float64
+}
+
+// define registers the global flags on f
+func (o *runOptions) define(f *flag.FlagSet) {
+	f.IntVar(&o.numTransfers, "numTransfers", 0, "Number of parallel transfers")
+	f.BoolVar(&o.fullscreen, "fullscreen", false, "Center progress bar(s) in fullscreen mode")
+	f.BoolVar(&o.singleLine, "singleLine", false, "Update a single-transfer progress line in place (dd style)")
+	f.StringVar(&o.control, "control", "", "Serve HTTP control requests on this address, e.g. localhost:8080: POST /transfers/N/limit?bytes=B changes transfer N's byte limit while it runs")
+	f.BoolVar(&o.aggregate, "aggregate", false, "Show one combined progress line on stderr, rewritten with \\r (default when stderr isn't a terminal)")
+	f.IntVar(&o.maxConcurrent, "maxConcurrent", 0, "Run at most this many transfers at once; the rest queue and start in order as others finish (0 = all at once)")
+	f.IntVar(&o.maxOpenFiles, "maxOpenFiles", 0, "Cap the file descriptors held by transfers; the rest wait for a free slot (0 = no cap)")
+	f.StringVar(&o.traceFile, "traceFile", "", "Write a runtime execution trace of the run to this file (see go tool trace)")
+	f.BoolVar(&o.summaryOnly, "summaryOnly", false, "Skip the live progress display and only print the final summary")
+	f.BoolVar(&o.fast, "fast", false, "Run without any progress sampling or rendering; only report final bytes, time and rate")
+	f.StringVar(&o.inputEncoding, "inputEncoding", "", "Decode text input before writing: hex or base64")
+	f.StringVar(&o.verifyBs, "verifyBs", "", "Read buffer size for the -verify pass (e.g. 16M; default: the transfer's bs)")
+	f.BoolVar(&o.atomic, "atomic", false, "Write regular-file outputs to <of>.tmp and rename them into place only on success")
+	f.BoolVar(&o.keepPartial, "keepPartial", false, "With -atomic, keep the .tmp file of a failed transfer")
+	f.StringVar(&o.config, "config", "", "Read global options and transfers from this JSON manifest (see README)")
+	f.StringVar(&o.dumpConfig, "dumpConfig", "", "Write the options and transfers of this command line as a -config manifest to this file (- for stdout) and exit")
+	f.Var(&o.specs, "transfer", "One more transfer given as dd operands, e.g. \"if=/dev/zero of=a.img bs=4M size=1G\" (repeatable)")
+	f.Var(&o.resume, "resume", "Continue interrupted transfers from the end of their existing output files; =verify first checks that the existing output matches the input, and =FILE continues from where a -checkpoint file says they got to")
+	f.StringVar(&o.checkpoint, "checkpoint", "", "Save each transfer's progress to this JSON file every -checkpointInterval and at the end, for -resume=FILE")
+	f.DurationVar(&o.checkpointInterval, "checkpointInterval", 10*time.Second, "Time between -checkpoint saves")
+	f.StringVar(&o.resumeMismatch, "resumeMismatch", "restart", "With -resume=verify, what to do if the existing output doesn't match: restart or fail")
+	f.StringVar(&o.sampleVerify, "sampleVerify", "", "After copying, compare this percentage of randomly chosen blocks of input and output (e.g. 1%)")
+	f.Int64Var(&o.sampleSeed, "sampleSeed", 0, "Seed for -sampleVerify's block choice (default: time-based, reported in the summary)")
+	f.BoolVar(&o.verify, "verify", false, "Read each output back after copying and compare it with what was written")
+	f.StringVar(&o.outputEncoding, "outputEncoding", "", "Encode output as text: hex or base64")
+	f.IntVar(&o.outputWrap, "outputWrap", 76, "Wrap -outputEncoding text after this many characters (0 = no wrapping)")
+	f.StringVar(&o.overwriteMode, "overwriteMode", "truncate", "Existing regular-file outputs: truncate (like dd, unless conv=notrunc) or inplace")
+	f.BoolVar(&o.strict, "strict", false, "Treat warnings such as misaligned skip/seek offsets as errors")
+	f.BoolVar(&o.alignRound, "alignRound", false, "Round misaligned skip/seek offsets down to the device's physical sector size")
+	f.BoolVar(&o.follow, "follow", false, "Keep copying as regular-file inputs grow (like tail -f) until count/size or a signal")
+	f.StringVar(&o.progressHook, "progressHook", "", "Command run with the percentage and transfer number at each progress milestone")
+	f.IntVar(&o.hookStep, "progressHookStep", 5, "Percentage between -progressHook milestones")
+	f.StringVar(&o.webhook, "webhook", "", "URL to POST a JSON summary of the results to when the run completes")
+	f.BoolVar(&o.webhookEach, "webhookEach", false, "With -webhook, also POST each transfer's result as it finishes")
+	f.StringVar(&o.sockBuf, "sockBuf", "", "SO_RCVBUF/SO_SNDBUF size for network (URL) inputs, e.g. 4M (default: system)")
+	f.BoolVar(&o.jobStdin, "jobStdin", false, "Read one transfer as a JSON job from stdin and write its result as JSON to stdout")
+	f.BoolVar(&o.failFast, "failFast", false, "Deprecated: use -onError=abort, which it is the same as")
+	f.StringVar(&o.onError, "onError", "continue", "When a transfer fails: abort (cancel all the others) or continue (let them finish); either way the exit status is 1")
+	f.IntVar(&o.retries, "retries", 0, "Start a transfer over up to this many times when reading its input fails (not for stdin)")
+	f.IntVar(&o.openRetries, "openRetries", 0, "Retry opening an input or output up to this many times while the device is busy (EBUSY) or not ready")
+	f.DurationVar(&o.openRetryDelay, "openRetryDelay", time.Second, "Wait before the first -openRetries attempt; doubled for each further one")
+	f.DurationVar(&o.retryBackoff, "retryBackoff", time.Second, "Wait before the first -retries attempt; doubled for each further one")
+	f.DurationVar(&o.maxBackoff, "maxBackoff", 30*time.Second, "Longest wait between -retries attempts")
+	f.Int64Var(&o.retrySeed, "retrySeed", 0, "Seed for the random jitter of -retries waits (default: time-based)")
+	f.StringVar(&o.progressSocket, "progressSocket", "", "Serve newline-delimited JSON progress events to clients of this Unix socket")
+	f.BoolVar(&o.pickDevice, "pickDevice", false, "Choose the output of each transfer that has an if but no of from a numbered list of block devices (Linux)")
+	f.BoolVar(&o.absPos, "absPos", false, "Draw progress lines at absolute screen rows (anchored to the 24-row screen) instead of moving the cursor up, so stray output can't shift them")
+	f.Float64Var(&o.maxLoad, "maxLoad", 0, "Pause all transfers while the 1-minute load average is above this, e.g. 4.0 (Linux; 0 = never)")
+	f.BoolVar(&o.readonlyInputs, "readonlyInputs", false, "Refuse to start if any output is also an input, and check that every input is opened read-only")
+	f.StringVar(&o.ioclass, "ioclass", "", "I/O scheduling class of every transfer: rt, be or idle (Linux; rt needs root)")
+	f.StringVar(&o.ioprio, "ioprio", "", "I/O priority of every transfer within its class, 0 (highest) to 7 (Linux)")
+	f.StringVar(&o.nice, "nice", "", "CPU nice value of every transfer, -20 to 19 (per transfer on Linux, the whole process elsewhere)")
+	f.StringVar(&o.oomScoreAdj, "oomScoreAdj", "", "Set the process's oom_score_adj, -1000 (never OOM-kill) to 1000 (kill first); lowering it needs root (Linux)")
+	f.IntVar(&o.perDevice, "perDevice", 0, "Run at most this many transfers at once on each physical disk, so transfers on the same spinning disk don't seek against each other (0 = no limit)")
+	f.BoolVar(&o.shareSource, "shareSource", false, "Read an input once for all transfers copying the same data from it (same if, skip, count/size and iflag)")
+	f.BoolVar(&o.nullio, "nullio", false, "Benchmark the copy loop alone: read zeros and discard the output without any I/O (needs countN or sizeN; if/of are ignored)")
+	f.BoolVar(&o.checkSpace, "checkSpace", false, "Before copying, fail if an output filesystem lacks the free space or inodes the outputs are expected to need")
+	f.StringVar(&o.cgroup, "cgroup", "", "Run each transfer's copy in this cgroup directory, e.g. /sys/fs/cgroup/dd.slice/io (Linux; needs a threaded cgroup v2 or cgroup v1)")
+	f.DurationVar(&o.warmup, "warmup", 0, "Leave the first part of each copy (e.g. 2s) out of an extra steady-state rate in the summary")
+	f.StringVar(&o.statsCsv, "statsCsv", "", "Write a CSV row per transfer (time, bytes, rate, percent) to this file every -statsInterval")
+	f.DurationVar(&o.statsInterval, "statsInterval", time.Second, "Time between -statsCsv rows")
+	f.StringVar(&o.record, "record", "", "Log every read and write of each transfer to this JSON file, for -replay")
+	f.StringVar(&o.replay, "replay", "", "Re-run the copy loop against the reads and writes of a -record file instead of real files")
+	f.StringVar(&o.labelFormat, "labelFormat", "", "Go template for each transfer's banner; fields: Name Input Output Percent Rate ETA Bytes Total")
+	f.BoolVar(&o.appendChecksum, "appendChecksum", false, "Append a trailer with the digest (hashN, default sha256) and length of the data to regular-file outputs")
+	f.BoolVar(&o.verifyAppended, "verifyAppended", false, "Check inputs written with -appendChecksum against their trailer, copying the data without it")
+	f.BoolVar(&o.untilInclusive, "untilInclusive", false, "Copy the untilN byte sequence too instead of stopping just before it")
+	f.BoolVar(&o.emitDd, "emitDd", false, "Print the equivalent GNU dd command of each transfer instead of running them")
+	f.BoolVar(&o.collapseFinished, "collapseFinished", false, "Drop finished transfers from the live display, showing how many finished on one line instead")
+	f.StringVar(&o.status, "status", "progress", "What to report on stderr: progress (live display and summary), noxfer (no summary), none (only errors and warnings) or json (JSON progress lines and summary)")
+	f.BoolVar(&o.finalChart, "finalChart", false, "After the summary, draw each transfer's throughput over time as an ASCII chart")
+	f.BoolVar(&o.deviceInfo, "deviceInfo", false, "Include input/output device identity (by-id, model, serial, filesystem) in the summary")
+	f.StringVar(&o.bwlimitTotal, "bwlimitTotal", "", "Copy at most this many bytes per second (e.g. 200M) across all transfers together")
+}
+
+func run(stdin io.Reader, stdout io.WriteSeeker) error {
+	f := flag.NewFlagSet("dd_multi_n", flag.ExitOnError)
+	o := &runOptions{}
+	o.define(f)
+
+	// Each transfer's numbered flags are defined on demand, for as many
+	// transfers as the command line, -transfer and -config name
+	tfs := &transferFlagSet{f: f}
+	tfs.define(1)
+
+	// Parse
+	args, ddStyle := ddCompatArgs(f, convertArgs(os.Args[1:]))
+	tfs.define(highestTransfer(f, args))
+	f.Parse(args)
+	if ddStyle && o.numTransfers == 0 {
+		// plain dd operands describe a single transfer
+		o.numTransfers = 1
+	}
+	if o.config != "" {
+		if err := loadConfig(tfs, o.config, &o.numTransfers); err != nil {
+			return err
+		}
+	}
+	if err := applyTransferSpecs(tfs, o.specs, &o.numTransfers); err != nil {
+		return err
+	}
+	if o.jobStdin {
+		if err := loadJob(f, stdin); err != nil {
+			return err
+		}
+		// stdout carries the result
+		o.summaryOnly = true
+	}
+
+	if o.dumpConfig != "" {
+		return writeConfig(f, o.dumpConfig, o.numTransfers, stdout)
+	}
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if o.failFast {
+		log.Printf("Warning: -failFast is deprecated; use -onError=abort")
+	}
+
+	// If -fullscreen is set, we don't detect real terminal size;
+	// we just keep 80x24, but do a full-screen effect anyway.
+	if o.fullscreen {
+		fullscreen = true
+	}
+
+	if o.replay != "" {
+		return replayRecording(o.replay)
+	}
+	if o.pickDevice {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("-pickDevice is only supported on Linux")
+		}
+		// the data may be coming in on stdin, so ask on the terminal
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("-pickDevice needs a terminal: %w", err)
+		}
+		defer tty.Close()
+		if err := pickOutputs(bufio.NewReader(tty), tty, listBlockDevices("/sys/block"), tfs.t, o.numTransfers); err != nil {
+			return err
+		}
+	}
+	if o.numTransfers <= 0 {
+		usage()
+	}
+	tfs.define(o.numTransfers)
+	cgroupPath, err := o.setup()
+	if err != nil {
+		return err
+	}
+	transfers, skipped, err := o.newTransfers(tfs)
+	if err != nil {
+		return err
+	}
+	if err := o.validateTransfers(transfers); err != nil {
+		return err
+	}
+	var label *template.Template
+	if o.labelFormat != "" {
+		if label, err = parseLabelFormat(o.labelFormat); err != nil {
+			return err
+		}
+	}
+
+	var controlListener net.Listener
+	if o.control != "" {
+		if controlListener, err = net.Listen("tcp", o.control); err != nil {
+			return fmt.Errorf("error listening on -control address: %w", err)
+		}
+	}
+
+	// With -follow, the first signal stops following and lets the
+	// transfers finish normally instead of exiting.
+	var stopFollow chan struct{}
+	if o.follow {
+		stopFollow = make(chan struct{})
+		for _, t := range transfers {
+			t.followStop = stopFollow
+		}
+	}
+
+	if o.emitDd {
+		for _, t := range transfers {
+			cmd, missing := ddCommand(t)
+			for _, m := range missing {
+				log.Printf("Warning: transfer #%d: %s has no dd equivalent", t.Index, m)
+			}
+			fmt.Fprintln(stdout, cmd)
+		}
+		return nil
+	}
+
+	// execution trace for go tool trace; stopped on return or on a signal
+	stopTrace := func() {}
+	if o.traceFile != "" {
+		tf, err := os.Create(o.traceFile)
+		if err != nil {
+			return fmt.Errorf("error creating trace file: %w", err)
+		}
+		if err := trace.Start(tf); err != nil {
+			tf.Close()
+			return fmt.Errorf("error starting trace: %w", err)
+		}
+		var once sync.Once
+		stopTrace = func() {
+			once.Do(func() {
+				trace.Stop()
+				tf.Close()
+			})
+		}
+		defer stopTrace()
+	}
+
+	// concurrency, bounded by -maxConcurrent and the descriptor budget
+	concurrent := len(transfers)
+	if o.maxConcurrent > 0 && o.maxConcurrent < concurrent {
+		concurrent = o.maxConcurrent
+	}
+	if o.maxOpenFiles > 0 {
+		if n := o.maxOpenFiles / fdsPerTransfer; n < concurrent {
+			concurrent = n
+		}
+	}
+	if err := checkFdLimit(concurrent); err != nil {
+		return err
+	}
+	if o.shareSource {
+		if concurrent < len(transfers) || o.perDevice > 0 {
+			log.Printf("Warning: -shareSource ignored: the transfers can't all run at once with -maxConcurrent, -maxOpenFiles or -perDevice")
+		} else {
+			shareSources(transfers)
+		}
+	}
+	var progressListener net.Listener
+	if o.progressSocket != "" {
+		if progressListener, err = listenProgress(o.progressSocket); err != nil {
+			return err
+		}
+	}
+
+	var sf *os.File
+	if o.statsCsv != "" {
+		if sf, err = os.Create(o.statsCsv); err != nil {
+			return fmt.Errorf("error creating -statsCsv file: %w", err)
+		}
+	}
+
+	var bwTotal *sharedLimiter
+	if n := parseBlockSize(o.bwlimitTotal, 0); n > 0 {
+		bwTotal = newSharedLimiter(n)
+	}
+	// -onError=abort cancels ctx on the first failure, which stops the
+	// transfers still copying and those still waiting for a slot
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var gate *loadGate
+	if o.maxLoad > 0 {
+		if runtime.GOOS != "linux" {
+			log.Printf("Warning: -maxLoad ignored: the load average is only read on Linux")
+		} else {
+			gate = newLoadGate()
+			gate.check(o.maxLoad, loadAverage)
+		}
+	}
+	// the first bytes a transfer writes are drawn without waiting for
+	// the display's next tick
+	moved := make(chan struct{}, 1)
+
+	// FIX: add "range" here
+	for _, t := range transfers {
+		t.bwTotal = bwTotal
+		t.ctx = ctx
+		t.moved = moved
+		t.gate = gate
+	}
+	sched := &scheduler{
+		o:            o,
+		stdin:        stdin,
+		slots:        make(chan struct{}, concurrent),
+		disks:        newDiskLimit(o.perDevice, transfers),
+		finished:     make(chan struct{}, len(transfers)),
+		ctx:          ctx,
+		cancel:       cancel,
+		abortOnError: o.failFast || o.onError == "abort",
+		cgroupPath:   cgroupPath,
+	}
+	sched.start(transfers)
+
+	// control endpoint, until run returns
+	if controlListener != nil {
+		srv := &http.Server{Handler: controlHandler(transfers)}
+		go srv.Serve(controlListener)
+		defer srv.Close()
+	}
+
+	// closed once every transfer has finished
+	transfersDone := make(chan struct{})
+	waitProgress := o.startProgress(transfers, label, moved, progressListener, gate, sf, transfersDone)
+
+	// SIGUSR1 (and SIGINFO, Ctrl-T, on the BSDs) prints where every
+	// transfer is, like dd
+	infoChan := make(chan os.Signal, 1)
+	if len(infoSignals) > 0 {
+		// with no signals Notify would relay all of them
+		signal.Notify(infoChan, infoSignals...)
+		defer signal.Stop(infoChan)
+	}
+	go func() {
+		for {
+			select {
+			case <-infoChan:
+				printSnapshot(os.Stderr, transfers)
+			case <-transfersDone:
+				return
+			}
+		}
+	}()
+
+	// handle signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigChan
+		if stopFollow != nil {
+			fmt.Fprintf(os.Stderr, "\nReceived signal: %s. Finishing followed transfers...\n", s)
+			close(stopFollow)
+			s = <-sigChan
+		}
+		fmt.Fprintf(os.Stderr, "\nReceived signal: %s. Terminating gracefully...\n", s)
+		if o.checkpoint != "" {
+			// before the transfers are marked finished below
+			if err := writeCheckpoint(o.checkpoint, transfers); err != nil {
+				log.Printf("Error writing -checkpoint: %v", err)
+			}
+		}
+		for _, tr := range transfers {
+			tr.Mutex.Lock()
+			tr.Finished = true
+			tr.EndTime = time.Now()
+			tr.Mutex.Unlock()
+		}
+		stopTrace()
+		os.Exit(1)
+	}()
+
+	sched.wg.Wait()
+	close(transfersDone)
+	waitProgress()
+	switch o.status {
+	case "progress":
+		printSummary(os.Stderr, transfers, skipped, o.deviceInfo)
+	case "json":
+		if err := json.NewEncoder(os.Stderr).Encode(newWebhookPayload("complete", transfers, skipped)); err != nil {
+			return fmt.Errorf("error writing JSON summary: %w", err)
+		}
+	}
+	if o.finalChart && o.status == "progress" {
+		for _, t := range transfers {
+			fmt.Fprintf(os.Stderr, "\n#%d %s, MB/s:\n", t.Index, t.title())
+			for _, line := range renderChart(t.rates, chartInterval, terminalCols-12, 6) {
+				fmt.Fprintln(os.Stderr, line)
+			}
+		}
+	}
+	if o.record != "" {
+		if err := writeRecording(o.record, transfers); err != nil {
+			return err
+		}
+	}
+	if o.webhook != "" {
+		sched.webhookWg.Wait()
+		postWebhook(o.webhook, newWebhookPayload("complete", transfers, skipped))
+	}
+	if o.jobStdin {
+		result := newWebhookPayload("job", transfers, skipped).Transfers[0]
+		if err := json.NewEncoder(stdout).Encode(result); err != nil {
+			return fmt.Errorf("error writing job result: %w", err)
+		}
+	}
+	if sched.firstErr != nil {
+		return sched.firstErr
+	}
+	// with -onError=continue the others ran to the end, but the run
+	// still failed
+	failed := 0
+	for _, t := range transfers {
+		if t.Err != nil {
+			failed++
+		}
+	}
+	if failed+skipped > 0 {
+		return fmt.Errorf("%d of %d transfer(s) failed or were skipped", failed+skipped, len(transfers)+skipped)
+	}
+	return nil
+}
+
+// validate checks the global flags on their own, before any transfer is
+// set up
+func (o *runOptions) validate() error {
+	if !statusModes[o.status] {
+		return fmt.Errorf("unknown -status %q: use progress, noxfer, none or json", o.status)
+	}
+	if o.onError != "abort" && o.onError != "continue" {
+		return fmt.Errorf("unknown -onError %q: use abort or continue", o.onError)
+	}
+	if o.inputEncoding != "" && o.inputEncoding != "hex" && o.inputEncoding != "base64" {
+		return fmt.Errorf("unknown -inputEncoding=%s (want hex or base64)", o.inputEncoding)
+	}
+	if o.outputEncoding != "" && o.outputEncoding != "hex" && o.outputEncoding != "base64" {
+		return fmt.Errorf("unknown -outputEncoding=%s (want hex or base64)", o.outputEncoding)
+	}
+	if o.outputWrap < 0 {
+		return fmt.Errorf("-outputWrap must not be negative")
+	}
+	if o.overwriteMode != "truncate" && o.overwriteMode != "inplace" {
+		return fmt.Errorf("unknown -overwriteMode=%s (want truncate or inplace)", o.overwriteMode)
+	}
+	if o.openRetries < 0 || o.openRetryDelay <= 0 {
+		return fmt.Errorf("-openRetries must not be negative and -openRetryDelay must be positive")
+	}
+	if o.statsCsv != "" && o.statsInterval <= 0 {
+		return fmt.Errorf("-statsInterval must be positive")
+	}
+	if o.checkpoint != "" && o.checkpointInterval <= 0 {
+		return fmt.Errorf("-checkpointInterval must be positive")
+	}
+	if o.resumeMismatch != "restart" && o.resumeMismatch != "fail" {
+		return fmt.Errorf("unknown -resumeMismatch=%s (want restart or fail)", o.resumeMismatch)
+	}
+	if o.retries < 0 || o.retryBackoff <= 0 || o.maxBackoff < o.retryBackoff {
+		return fmt.Errorf("-retries must not be negative and -maxBackoff must be at least -retryBackoff, which must be positive")
+	}
+	if o.maxConcurrent < 0 {
+		return fmt.Errorf("-maxConcurrent must not be negative")
+	}
+	if o.maxOpenFiles > 0 && o.maxOpenFiles < fdsPerTransfer {
+		return fmt.Errorf("-maxOpenFiles must be at least %d", fdsPerTransfer)
+	}
+	if o.perDevice < 0 {
+		return fmt.Errorf("-perDevice must not be negative")
+	}
+	if o.progressHook != "" && strings.TrimSpace(o.progressHook) == "" {
+		return fmt.Errorf("-progressHook must name a command")
+	}
+	if o.progressHook != "" && (o.hookStep <= 0 || o.hookStep > 100) {
+		return fmt.Errorf("-progressHookStep must be between 1 and 100")
+	}
+	return nil
+}
+
+// setup applies the global flags that change the whole process and
+// returns the cgroup file each transfer's thread joins, if any
+func (o *runOptions) setup() (string, error) {
+	if o.sockBuf != "" {
+		inputClient = sockBufClient(int(parseBlockSize(o.sockBuf, 0)))
+	}
+	openRetries, openRetryDelay = o.openRetries, o.openRetryDelay
+	var cgroupPath string
+	if o.cgroup != "" {
+		if runtime.GOOS != "linux" {
+			log.Printf("Warning: -cgroup ignored: cgroups are Linux-only")
+		} else {
+			var err error
+			if cgroupPath, err = cgroupFile(o.cgroup); err != nil {
+				return "", err
+			}
+		}
+	}
+	if o.oomScoreAdj != "" {
+		adj, err := strconv.Atoi(o.oomScoreAdj)
+		if err != nil || adj < -1000 || adj > 1000 {
+			return "", fmt.Errorf("-oomScoreAdj must be a number from -1000 to 1000")
+		}
+		if runtime.GOOS != "linux" {
+			log.Printf("Warning: -oomScoreAdj ignored: oom_score_adj is Linux-only")
+		} else if err := setOOMScoreAdj(oomScoreAdjPath, adj); err != nil {
+			return "", err
+		}
+	}
+	if runtime.GOOS != "linux" {
+		if o.ioclass != "" || o.ioprio != "" {
+			log.Printf("Warning: -ioclass and -ioprio ignored: I/O priorities are Linux-only")
+		}
+		if o.nice != "" {
+			// no per-thread priorities here, so it goes for the process
+			sp, err := parseSchedPrio("", "", o.nice)
+			if err != nil {
+				return "", err
+			}
+			if err := setProcessNice(sp.nice); err != nil {
+				return "", fmt.Errorf("error setting -nice: %w", err)
+			}
+		}
+	}
+	if o.retrySeed == 0 {
+		o.retrySeed = time.Now().UnixNano()
+	}
+	return cgroupPath, nil
+}
+
+// newTransfers builds the transfers of the numbered flags in tfs. Those
+// with bad options are logged and left out; the count of them is
+// returned with the others.
+func (o *runOptions) newTransfers(tfs *transferFlagSet) ([]*Transfer, int, error) {
+	var resumeState map[int]checkpointEntry
+	if o.resume.state != "" {
+		var err error
+		if resumeState, err = readCheckpoint(o.resume.state); err != nil {
+			return nil, 0, err
+		}
+	}
+	var sampleFraction float64
+	if o.sampleVerify != "" {
+		var err error
+		if sampleFraction, err = parseSampleFraction(o.sampleVerify); err != nil {
+			return nil, 0, err
+		}
+		if o.sampleSeed == 0 {
+			o.sampleSeed = time.Now().UnixNano()
+		}
+	}
+
+	var transfers []*Transfer
+	skipped := 0
+	for i := 1; i <= o.numTransfers; i++ {
+		tv := tfs.t[i-1]
+		inName := tv.in
+		outName := tv.out
+		bsStr := tv.bs
+		convStr := tv.conv
+		oflagStr := tv.oflag
+		iflagStr := tv.iflag
+
+		countVal := tv.count
+		skipVal := tv.skip
+		seekVal := tv.seek
+		sizeVal := tv.size
+
+		// If both inName/outName are empty, skip, unless it's the only
+		// transfer: then it's a plain stdin->stdout pipe
+		if inName == "" && outName == "" && o.numTransfers > 1 && !o.nullio {
+			continue
+		}
+
+		var bsVal int64
+		if bsStr == "auto" {
+			var from string
+			bsVal, from = autoBlockSize(outName, inName)
+			log.Printf("Transfer #%d: bs=auto uses %d bytes (%s)", i, bsVal, from)
+		} else {
+			bsVal = parseBlockSize(bsStr, 512)
+		}
+		// like dd, bs= sets both sizes and overrides ibs= and obs=
+		obsVal := bsVal
+		if bsStr == "" {
+			bsVal = parseBlockSize(tv.ibs, 512)
+			obsVal = parseBlockSize(tv.obs, 512)
+		}
+		flags, err := parseConvOflag(convStr, oflagStr)
+		if err != nil {
+			log.Printf("Error parsing conv/oflag for transfer #%d: %v", i, err)
+			skipped++
+			continue
+		}
+		if o.overwriteMode == "inplace" {
+			flags &^= os.O_TRUNC
+		}
+		iflags, err := parseIflag(iflagStr)
+		if err != nil {
+			log.Printf("Error parsing iflag for transfer #%d: %v", i, err)
+			skipped++
+			continue
+		}
+		hashAlg, err := parseHash(tv.hash, strings.ToLower(tv.expect))
+		if err != nil {
+			log.Printf("Error parsing hash/expect for transfer #%d: %v", i, err)
+			skipped++
+			continue
+		}
+		if tv.weight < 1 {
+			log.Printf("Error parsing weight for transfer #%d: must be at least 1, not %d", i, tv.weight)
+			skipped++
+			continue
+		}
+		sched, err := parseSchedPrio(orDefault(tv.ioclass, o.ioclass), orDefault(tv.ioprio, o.ioprio), orDefault(tv.nice, o.nice))
+		if err != nil {
+			log.Printf("Error parsing ioclass/ioprio/nice for transfer #%d: %v", i, err)
+			skipped++
+			continue
+		}
+		after, err := parseAfter(tv.after, i)
+		if err != nil {
+			log.Printf("Error parsing after for transfer #%d: %v", i, err)
+			skipped++
+			continue
+		}
+		var until []byte
+		if tv.until != "" {
+			if until, err = hex.DecodeString(tv.until); err != nil {
+				log.Printf("Error parsing until for transfer #%d: %v", i, err)
+				skipped++
+				continue
+			}
+		}
+		if iflags&oNoatime == 0 && strings.Contains(iflagStr, "noatime") {
+			log.Printf("Warning: iflag=noatime is only supported on Linux (transfer #%d)", i)
+		}
+		if oDirect == 0 && (hasOption(iflagStr, "direct") || hasOption(oflagStr, "direct")) {
+			log.Printf("Warning: direct I/O is only supported on Linux and FreeBSD (transfer #%d)", i)
+		}
+		if flags&os.O_APPEND != 0 && seekVal != 0 {
+			log.Printf("Warning: seek%d ignored: oflag=append always writes at the end of the output", i)
+			seekVal = 0
+		}
+		// skip, seek and count are in blocks unless given in bytes
+		skipOff, seekOff := skipVal*bsVal, seekVal*obsVal
+		if hasOption(iflagStr, "skip_bytes") {
+			skipOff = skipVal
+		}
+		if hasOption(oflagStr, "seek_bytes") {
+			seekOff = seekVal
+		}
+		if hasOption(iflagStr, "count_bytes") && countVal != math.MaxInt64 {
+			// size is the byte count
+			sizeVal, countVal = countVal, math.MaxInt64
+		}
+
+		t := &Transfer{
+			Index:          i,
+			InputFilename:  inName,
+			OutputFilename: outName,
+			Name:           tv.name,
+			Bs:             bsVal,
+			Obs:            obsVal,
+			Count:          countVal,
+			Size:           sizeVal,
+			Skip:           skipVal,
+			Seek:           seekVal,
+			SkipOff:        skipOff,
+			SeekOff:        seekOff,
+			Conv:           convStr,
+			Oflag:          flags,
+			Iflag:          iflags,
+			OflagStr:       oflagStr,
+			IflagStr:       iflagStr,
+			InputEncoding:  o.inputEncoding,
+			OutputEncoding: o.outputEncoding,
+			OutputWrap:     o.outputWrap,
+			Verify:         o.verify && outName != "" && !isFD(outName),
+			VerifyBs:       parseBlockSize(o.verifyBs, bsVal),
+			Resume:         o.resume.on && o.resume.state == "",
+			HashAlg:        hashAlg,
+			Partition:      tv.partition,
+			Until:          until,
+			UntilInclusive: o.untilInclusive,
+			Warmup:         o.warmup,
+			RetryBackoff:   o.retryBackoff,
+			MaxBackoff:     o.maxBackoff,
+			RetrySeed:      o.retrySeed,
+			Expect:         strings.ToLower(tv.expect),
+			BwLimit:        parseBlockSize(tv.bwlimit, 0),
+			Weight:         tv.weight,
+			After:          after,
+			Phase:          tv.phase,
+			Prio:           tv.prio,
+			Delay:          tv.delay,
+			IopsLimit:      tv.iopslimit,
+			Sched:          sched,
+		}
+		if inName != "" {
+			// stdin can't be read again
+			t.Retries = o.retries
+		}
+		if hasOption(convStr, "noerror") {
+			t.ReadRetries = tv.readRetries
+			t.MapFile = tv.mapFile
+		} else {
+			if tv.readRetries != 0 && tv.rescue == "" {
+				log.Printf("Warning: retries%d ignored: it only applies with conv%d=noerror or rescue%d", i, i, i)
+			}
+			if tv.mapFile != "" {
+				log.Printf("Warning: map%d ignored: it only applies with conv%d=noerror", i, i)
+			}
+		}
+		if tv.rescue != "" {
+			if inName == "" || outName == "" || (tv.mapFile != "" && tv.mapFile != tv.rescue) {
+				log.Printf("Error in transfer #%d: rescue%d needs a named input and output, and no other map%d", i, i, i)
+				skipped++
+				continue
+			}
+			if t.RescueFill, err = hex.DecodeString(tv.fill); err != nil {
+				log.Printf("Error parsing fill for transfer #%d: %v", i, err)
+				skipped++
+				continue
+			}
+			t.Rescue, t.MapFile = true, tv.rescue
+			t.ReadRetries = tv.readRetries
+			// the rest of the output is left alone, so there is nothing
+			// to verify against or rename into place
+			t.Verify = false
+		} else if tv.fill != "" {
+			log.Printf("Warning: fill%d ignored: it only applies with rescue%d", i, i)
+		}
+		if o.resume.state != "" {
+			if c, ok := resumeState[i]; !ok {
+				log.Printf("Transfer #%d: not in %s, starting from the beginning", i, o.resume.state)
+			} else if c.Input != inName || c.Output != outName {
+				log.Printf("Warning: transfer #%d was %s --> %s in %s; starting from the beginning", i, c.Input, c.Output, o.resume.state)
+			} else {
+				t.Resume, t.FromCheckpoint, t.Checkpointed = true, true, c.Offset
+			}
+		}
+		if o.resume.verify {
+			if inName == "" || t.InputEncoding != "" || t.OutputEncoding != "" || changesData(t.Conv) {
+				log.Printf("Warning: transfer #%d can't compare its output with the input; -resume=verify resumes it by size", i)
+			} else {
+				t.ResumeVerify = true
+				t.ResumeFailOnMismatch = o.resumeMismatch == "fail"
+			}
+		}
+		if o.nullio {
+			if t.Count == math.MaxInt64 && t.Size <= 0 {
+				log.Printf("Error in transfer #%d: -nullio needs count%d or size%d to end", i, i, i)
+				skipped++
+				continue
+			}
+			t.NullIO = true
+			// names for the display only; nothing is opened
+			t.InputFilename, t.OutputFilename = "(zeros)", "(discard)"
+			t.InputEncoding = ""
+			t.Verify, t.Resume, t.Partition = false, false, 0
+		}
+		if o.record != "" {
+			t.recording = &transferTrace{Index: i, Input: inName, Output: outName, Bs: bsVal, Events: []traceEvent{}}
+		}
+		if sampleFraction > 0 && !t.NullIO {
+			if reason := sampleUnsupported(t, o.follow); reason != "" {
+				log.Printf("Warning: -sampleVerify ignored for transfer #%d: %s", i, reason)
+			} else {
+				t.SampleFraction = sampleFraction
+				t.SampleSeed = o.sampleSeed
+			}
+		}
+		if hasOption(convStr, "sparse") {
+			if reason := sparseUnsupported(t); reason != "" {
+				log.Printf("Warning: conv=sparse ignored for transfer #%d: %s", i, reason)
+			} else {
+				t.Sparse = true
+			}
+		}
+		if o.verifyAppended && !t.NullIO {
+			if reason := verifyAppendedUnsupported(t); reason != "" {
+				log.Printf("Warning: -verifyAppended ignored for transfer #%d: %s", i, reason)
+			} else {
+				t.VerifyAppended = true
+			}
+		}
+		if o.appendChecksum && !t.NullIO {
+			if reason := appendUnsupported(t); reason != "" {
+				log.Printf("Warning: -appendChecksum ignored for transfer #%d: %s", i, reason)
+			} else {
+				t.AppendChecksum = true
+				if t.HashAlg == "" {
+					t.HashAlg = "sha256"
+				}
+			}
+		}
+		if o.atomic && !t.NullIO && !t.Rescue {
+			if reason := atomicUnsupported(outName, t.SeekOff, o.resume.on, flags&os.O_APPEND != 0); reason != "" {
+				log.Printf("Warning: -atomic ignored for transfer #%d: %s", i, reason)
+			} else {
+				t.Atomic = true
+				t.KeepPartial = o.keepPartial
+			}
+		}
+		transfers = append(transfers, t)
+	}
+
+	if len(transfers) == 0 {
+		usage()
+	}
+	return transfers, skipped, nil
+}
+
+// validateTransfers checks the transfers against each other and their
+// inputs and outputs before any of them starts
+func (o *runOptions) validateTransfers(transfers []*Transfer) error {
+	phaseDeps(transfers)
+	if err := resolveDeps(transfers); err != nil {
+		return err
+	}
+	for _, t := range transfers {
+		if err := checkAlignment(t, o.strict, o.alignRound); err != nil {
+			return err
+		}
+	}
+	if o.readonlyInputs {
+		if err := checkInputsNotOutputs(transfers); err != nil {
+			return err
+		}
+		readonlyInputs = true
+	}
+	if o.checkSpace {
+		if err := checkSpace(transfers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduler starts transfers in a pool of concurrent slots and finishes
+// each one when its copy is done
+type scheduler struct {
+	o     *runOptions
+	stdin io.Reader
+	slots chan struct{}
+	disks *diskLimit
+	// finished gets a value as each transfer finishes; it never blocks
+	finished  chan struct{}
+	wg        sync.WaitGroup // the transfers
+	webhookWg sync.WaitGroup // -webhookEach posts
+	// -onError=abort cancels ctx on the first failure, which is kept in
+	// firstErr
+	ctx          context.Context
+	cancel       context.CancelFunc
+	abortOnError bool
+	firstErr     error
+	firstErrOnce sync.Once
+	cgroupPath   string
+}
+
+// runTransfer copies, verifies and finishes one transfer in its slot
+func (s *scheduler) runTransfer(tr *Transfer) {
+	defer s.wg.Done()
+	defer func() { <-s.slots }()
+	var err error
+	if s.ctx.Err() != nil {
+		err = &transferError{classOther, fmt.Errorf("not started: %w", s.ctx.Err())}
+	} else if d := failedDep(tr); d != nil {
+		err = &transferError{classOther, fmt.Errorf("not started: transfer #%d failed", d.Index)}
+	} else if s.cgroupPath != "" {
+		if cerr := joinCgroup(s.cgroupPath); cerr != nil {
+			err = &transferError{classOther, cerr}
+		}
+	}
+	if err == nil && runtime.GOOS == "linux" {
+		if serr := tr.Sched.apply(); serr != nil {
+			err = &transferError{classOther, serr}
+		}
+	}
+	tr.Mutex.Lock()
+	tr.StartTime = time.Now()
+	tr.Mutex.Unlock()
+	if tr.Warmup > 0 {
+		warm := time.AfterFunc(tr.Warmup, func() {
+			tr.Mutex.Lock()
+			tr.WarmupBytes = tr.Transferred
+			tr.WarmupEnd = time.Now()
+			tr.Mutex.Unlock()
+		})
+		defer warm.Stop()
+	}
+
+	if err == nil {
+		if tr.Rescue {
+			err = rescueTransfer(tr)
+		} else {
+			err = copyWithRetries(tr, s.stdin)
+		}
+	}
+	if tr.shared != nil {
+		tr.shared.leave(tr)
+	}
+	tr.Mutex.Lock()
+	tr.EndTime = time.Now()
+	tr.Mutex.Unlock()
+	if err == nil && tr.Verify {
+		err = verifyTransfer(tr)
+	}
+	if err == nil && tr.SampleFraction > 0 {
+		err = sampleVerify(tr)
+	}
+	err = finishAtomic(tr, err)
+	if err != nil {
+		log.Printf("Error in transfer %s->%s: %v", tr.InputFilename, tr.OutputFilename, err)
+		if s.abortOnError && classifyError(err) != classCanceled {
+			s.firstErrOnce.Do(func() {
+				s.firstErr = fmt.Errorf("transfer #%d failed: %w", tr.Index, err)
+				s.cancel()
+			})
+		}
+	}
+	tr.Mutex.Lock()
+	tr.Err = err
+	tr.Finished = true
+	tr.Mutex.Unlock()
+	s.disks.release(tr)
+	s.finished <- struct{}{}
+	if s.o.webhook != "" && s.o.webhookEach {
+		s.webhookWg.Add(1)
+		go func() {
+			defer s.webhookWg.Done()
+			postWebhook(s.o.webhook, newWebhookPayload("transfer", []*Transfer{tr}, 0))
+		}()
+	}
+}
+
+// start runs transfers from a pool of concurrent slots: transfers take
+// one by priority, then in order, and the rest queue until a running one
+// finishes. A transfer waiting for others (afterN) is passed over until
+// they have finished, one on a disk already busy with -perDevice
+// transfers until one is done, and one with a delayN until it is over.
+func (s *scheduler) start(transfers []*Transfer) {
+	s.wg.Add(len(transfers))
+	go func() {
+		begin := time.Now()
+		for _, t := range transfers {
+			t.notBefore = begin.Add(t.Delay)
+		}
+		canceled := s.ctx.Done()
+		pending := append([]*Transfer(nil), transfers...)
+		for len(pending) > 0 {
+			// wait for a free slot before choosing, so a transfer that
+			// becomes ready meanwhile can still go first
+			s.slots <- struct{}{}
+			i := -1
+			for k, t := range pending {
+				if (i < 0 || t.Prio > pending[i].Prio) && t.ready() && s.disks.fits(t) {
+					i = k
+				}
+			}
+			if i < 0 {
+				<-s.slots
+				var next time.Time
+				for _, t := range pending {
+					if time.Now().Before(t.notBefore) && (next.IsZero() || t.notBefore.Before(next)) {
+						next = t.notBefore
+					}
+				}
+				var wake <-chan time.Time
+				if !next.IsZero() {
+					wake = time.After(time.Until(next))
+				}
+				select {
+				case <-s.finished:
+				case <-wake:
+				case <-canceled:
+					// the delayed ones start at once, only to be
+					// reported as not started
+					for _, t := range pending {
+						t.notBefore = time.Time{}
+					}
+					canceled = nil
+				}
+				continue
+			}
+			t := pending[i]
+			s.disks.acquire(t)
+			pending = append(pending[:i], pending[i+1:]...)
+			go s.runTransfer(t)
+		}
+	}()
+}
+
+// startProgress starts what reports on the transfers while they run, until
+// done is closed: the live display or -status=json lines, -progressHook,
+// -progressSocket (on ln), the -maxLoad gate, -finalChart samples,
+// -statsCsv rows (to sf) and -checkpoint saves. The returned function
+// waits for all of them to finish.
+func (o *runOptions) startProgress(transfers []*Transfer, label *template.Template, moved chan struct{}, ln net.Listener, gate *loadGate, sf *os.File, done chan struct{}) func() {
+	var wg sync.WaitGroup
+	// The live display is drawn on stdout (all but the -aggregate line,
+	// which goes to stderr), so it would corrupt the data of any transfer
+	// writing there (e.g. dd-multi in a pipeline)
+	toStdout := false
+	for _, t := range transfers {
+		if t.OutputFilename == "" || t.OutputFilename == "fd:1" {
+			toStdout = true
+		}
+	}
+
+	// progress goroutine; -fast and -summaryOnly never start it, so the
+	// copy loops run without anything polling their counters
+	if !o.summaryOnly && !o.fast && !toStdout && (o.status == "progress" || o.status == "noxfer") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mp := &MultiProgress{
+				Transfers:  transfers,
+				Fullscreen: fullscreen,
+				SingleLine: o.singleLine && len(transfers) == 1 && !fullscreen,
+				Aggregate:  !fullscreen && !o.singleLine && (o.aggregate || !isTerminal(os.Stderr)),
+				Out:        os.Stderr,
+				Label:      label,
+				Done:       done,
+				Moved:      moved,
+				TermCols:   terminalCols,
+				TermRows:   terminalRows,
+				AbsPos:     o.absPos,
+				Collapse:   o.collapseFinished,
+			}
+			mp.startProgress()
+		}()
+	}
+
+	// -status=json lines
+	if o.status == "json" && !o.fast {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writeProgressJSON(os.Stderr, transfers, progressInterval, done)
+		}()
+	}
+
+	// milestone hook
+	if o.progressHook != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchMilestones(transfers, o.hookStep, commandHook(o.progressHook), done)
+		}()
+	}
+
+	// progress socket
+	if ln != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveProgress(ln, transfers, done)
+		}()
+	}
+
+	// -maxLoad
+	if gate != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchLoad(gate, o.maxLoad, loadPollInterval, loadAverage, done)
+		}()
+	}
+
+	// -finalChart samples
+	if o.finalChart {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sampleRates(transfers, chartInterval, done)
+		}()
+	}
+
+	// stats CSV
+	if sf != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := writeStats(sf, transfers, o.statsInterval, done)
+			if cerr := sf.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				log.Printf("Error writing %s: %v", o.statsCsv, err)
+			}
+		}()
+	}
+
+	if o.checkpoint != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(o.checkpointInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-done:
+					if err := writeCheckpoint(o.checkpoint, transfers); err != nil {
+						log.Printf("Error writing -checkpoint: %v", err)
+					}
+					return
+				}
+				if err := writeCheckpoint(o.checkpoint, transfers); err != nil {
+					log.Printf("Error writing -checkpoint: %v", err)
+				}
+			}
+		}()
+	}
+	return wg.Wait
+}
+
+// milestoneFunc is called when a transfer reaches another pct milestone
+type milestoneFunc func(tr *Transfer, pct int)
+
+// commandHook returns a milestoneFunc that runs cmd (split on spaces) with
+// the percentage and transfer number appended as arguments.
+func commandHook(cmd string) milestoneFunc {
+	args := strings.Fields(cmd)
+	return func(tr *Transfer, pct int) {
+		c := exec.Command(args[0], append(args[1:], strconv.Itoa(pct), strconv.Itoa(tr.Index))...)
+		c.Stdout = os.Stderr
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			log.Printf("progress hook for transfer #%d at %d%%: %v", tr.Index, pct, err)
+		}
+	}
+}
+
+// watchMilestones polls the transfers and calls fn once for every step
+// percent each of them crosses, until done is closed. A final check after
+// done catches the last milestones of transfers that just finished.
+func watchMilestones(transfers []*Transfer, step int, fn milestoneFunc, done <-chan struct{}) {
+	reached := make([]int, len(transfers))
+	check := func() {
+		for i, tr := range transfers {
+			tr.Mutex.Lock()
+			transferred, total := tr.Transferred, tr.Total
+			tr.Mutex.Unlock()
+			if total <= 0 {
+				continue
+			}
+			pct := int(transferred * 100 / total)
+			if pct > 100 {
+				pct = 100
+			}
+			for next := reached[i] + step; next <= pct; next += step {
+				fn(tr, next)
+				reached[i] = next
+			}
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-done:
+			check()
+			return
+		}
+	}
+}
+
+// parseAfter parses afterN, the comma-separated numbers of the
+// transfers that transfer self waits for
+func parseAfter(s string, self int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var after []int
+	for _, a := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(a))
+		if err != nil || n < 1 || n == self {
+			return nil, fmt.Errorf("%q is not another transfer's number", a)
+		}
+		after = append(after, n)
+	}
+	return after, nil
+}
+
+// phaseDeps makes each transfer of a phase (phaseN) wait for all those of
+// the phase before it. Phases run in the order they are first used, and
+// transfers without a phase aren't held back.
+func phaseDeps(transfers []*Transfer) {
+	var order []string
+	members := map[string][]int{}
+	for _, t := range transfers {
+		if t.Phase == "" {
+			continue
+		}
+		if _, ok := members[t.Phase]; !ok {
+			order = append(order, t.Phase)
+		}
+		members[t.Phase] = append(members[t.Phase], t.Index)
+	}
+	for k := 1; k < len(order); k++ {
+		prev := members[order[k-1]]
+		for _, t := range transfers {
+			if t.Phase == order[k] {
+				t.After = append(t.After, prev...)
+			}
+		}
+	}
+}
+
+// resolveDeps links each transfer to the ones it waits for (afterN) and
+// rejects waits for missing transfers and circular ones
+func resolveDeps(transfers []*Transfer) error {
+	byIndex := map[int]*Transfer{}
+	for _, t := range transfers {
+		byIndex[t.Index] = t
+	}
+	for _, t := range transfers {
+		for _, n := range t.After {
+			d := byIndex[n]
+			if d == nil {
+				return fmt.Errorf("transfer #%d: after%d=%d: there is no transfer #%d to wait for", t.Index, t.Index, n, n)
+			}
+			t.deps = append(t.deps, d)
+		}
+	}
+	// depth-first search for a transfer that (indirectly) waits for itself
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := map[*Transfer]int{}
+	var visit func(t *Transfer) error
+	visit = func(t *Transfer) error {
+		switch state[t] {
+		case visiting:
+			return fmt.Errorf("transfer #%d waits for itself through afterN", t.Index)
+		case done:
+			return nil
+		}
+		state[t] = visiting
+		for _, d := range t.deps {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[t] = done
+		return nil
+	}
+	for _, t := range transfers {
+		if err := visit(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failedDep returns a transfer t waited for that failed, or nil
+func failedDep(t *Transfer) *Transfer {
+	for _, d := range t.deps {
+		d.Mutex.Lock()
+		err := d.Err
+		d.Mutex.Unlock()
+		if err != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// ready reports whether t's delay is over and every transfer it waits
+// for has finished
+func (t *Transfer) ready() bool {
+	if time.Now().Before(t.notBefore) {
+		return false
+	}
+	for _, d := range t.deps {
+		d.Mutex.Lock()
+		finished := d.Finished
+		d.Mutex.Unlock()
+		if !finished {
+			return false
+		}
+	}
+	return true
+}
+
+// shareSources groups the transfers that copy the same data from the
+// same input so that it is read only once
+func shareSources(transfers []*Transfer) {
+	type sourceKey struct {
+		name           string
+		skipOff, limit int64
+		flags          int
+	}
+	groups := map[sourceKey][]*Transfer{}
+	var keys []sourceKey
+	for _, t := range transfers {
+		// a transfer waiting for -after or delayN would hold up the others
+		if t.NullIO || t.Partition > 0 || t.Resume || t.VerifyAppended || len(t.deps) > 0 || t.Delay > 0 {
+			continue
+		}
+		k := sourceKey{t.InputFilename, t.SkipOff, t.byteLimit(), t.Iflag}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], t)
+	}
+	for _, k := range keys {
+		group := groups[k]
+		if len(group) < 2 {
+			continue
+		}
+		src := newSharedSource(group[0], k.limit, len(group))
+		var nums []string
+		for _, t := range group {
+			t.shared = src
+			// the input can't be read again for just one of them
+			t.Retries = 0
+			if t.Bs > src.bs {
+				src.bs = t.Bs
+			}
+			nums = append(nums, fmt.Sprintf("#%d", t.Index))
+		}
+		name := k.name
+		if name == "" {
+			name = "stdin"
+		}
+		log.Printf("Transfers %s share one read of %s", strings.Join(nums, ", "), name)
+	}
+}
+
+// fdsPerTransfer is the most descriptors a running transfer holds: its
+// input and output. The verify pass reopens the output only after the copy
+// closed it.
+const fdsPerTransfer = 2
+
+// fdReserve is left for stdio, hooks, trace files and the like
+const fdReserve = 16
+
+// ddOptions are the conv=, oflag= and iflag= options GNU dd has too
+var ddOptions = map[string]bool{
+	"notrunc": true, "ascii": true, "ebcdic": true, "ibm": true,
+	"sync": true, "noatime": true, "noerror": true,
+	"fsync": true, "fdatasync": true, "sparse": true,
+	"lcase": true, "ucase": true, "swab": true, "nocreat": true, "excl": true,
+	"append": true, "direct": true, "fullblock": true,
+}
+
+// byteUnitFlags are the iflag= and oflag= options that only change the
+// unit of skip, seek and count
+var byteUnitFlags = map[string]bool{"skip_bytes": true, "seek_bytes": true, "count_bytes": true}
+
+// ddCommand returns the GNU dd command that does what t does, and the
+// settings of t it can't express
+func ddCommand(t *Transfer) (string, []string) {
+	var missing []string
+	args := []string{"dd"}
+	add := func(name, val string) {
+		args = append(args, name+"="+shellQuote(val))
+	}
+	if t.NullIO {
+		add("if", "/dev/zero")
+		add("of", "/dev/null")
+	} else {
+		if isURL(t.InputFilename) {
+			missing = append(missing, "URL input (pipe it in with curl)")
+		} else if t.InputFilename != "" {
+			add("if", t.InputFilename)
+		}
+		if t.OutputFilename != "" {
+			add("of", t.OutputFilename)
+		}
+	}
+	if t.outBs() == t.Bs {
+		add("bs", strconv.FormatInt(t.Bs, 10))
+	} else {
+		add("ibs", strconv.FormatInt(t.Bs, 10))
+		add("obs", strconv.FormatInt(t.Obs, 10))
+	}
+
+	var iflags, oflags, convs []string
+	skip, count, size := t.SkipOff, t.Count, t.Size
+	if t.Partition > 0 {
+		// dd can't read partition tables; give their offsets in bytes
+		start, psize, err := partitionRange(t.InputFilename, t.Partition)
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("partition%d (%v)", t.Index, err))
+		} else {
+			skip = start + t.SkipOff
+			if count == math.MaxInt64 && size <= 0 {
+				size = psize - t.SkipOff
+			}
+		}
+	}
+	// offsets and sizes in whole blocks are given in blocks, others in
+	// bytes with the *_bytes flags
+	if count != math.MaxInt64 {
+		add("count", strconv.FormatInt(count, 10))
+	} else if size > 0 {
+		if size%t.Bs == 0 {
+			add("count", strconv.FormatInt(size/t.Bs, 10))
+		} else {
+			add("count", strconv.FormatInt(size, 10))
+			iflags = append(iflags, "count_bytes")
+		}
+	}
+	if skip%t.Bs != 0 {
+		add("skip", strconv.FormatInt(skip, 10))
+		iflags = append(iflags, "skip_bytes")
+	} else if skip != 0 {
+		add("skip", strconv.FormatInt(skip/t.Bs, 10))
+	}
+	if t.SeekOff%t.outBs() != 0 {
+		add("seek", strconv.FormatInt(t.SeekOff, 10))
+		oflags = append(oflags, "seek_bytes")
+	} else if t.SeekOff != 0 {
+		add("seek", strconv.FormatInt(t.SeekOff/t.outBs(), 10))
+	}
+
+	options := func(list, what string, to *[]string) {
+		if list == "none" {
+			return
+		}
+		for _, o := range strings.Split(list, ",") {
+			if byteUnitFlags[o] {
+				// already in the offsets above
+				continue
+			}
+			if ddOptions[o] {
+				*to = append(*to, o)
+			} else {
+				missing = append(missing, what+"="+o)
+			}
+		}
+	}
+	options(t.Conv, "conv", &convs)
+	options(t.OflagStr, "oflag", &oflags)
+	options(t.IflagStr, "iflag", &iflags)
+	// -overwriteMode=inplace turns truncation off without conv=notrunc
+	if t.Oflag&os.O_TRUNC == 0 && !hasOption(t.Conv, "notrunc") {
+		convs = append(convs, "notrunc")
+	}
+	if len(convs) > 0 {
+		add("conv", strings.Join(convs, ","))
+	}
+	if len(iflags) > 0 {
+		add("iflag", strings.Join(iflags, ","))
+	}
+	if len(oflags) > 0 {
+		add("oflag", strings.Join(oflags, ","))
+	}
+
+	// everything else dd-multi does around the copy
+	features := []struct {
+		on   bool
+		name string
+	}{
+		{t.HashAlg != "" && !t.AppendChecksum, "hash" + strconv.Itoa(t.Index) + " (pipe through " + t.HashAlg + "sum)"},
+		{t.InputEncoding != "", "-inputEncoding"},
+		{t.OutputEncoding != "", "-outputEncoding"},
+		{t.Until != nil, "until" + strconv.Itoa(t.Index)},
+		{t.Verify, "-verify"},
+		{t.SampleFraction > 0, "-sampleVerify"},
+		{t.Atomic, "-atomic"},
+		{t.Resume, "-resume"},
+		{t.Retries > 0, "-retries"},
+		{t.ReadRetries > 0, "retries" + strconv.Itoa(t.Index)},
+		{t.followStop != nil, "-follow"},
+		{t.AppendChecksum, "-appendChecksum"},
+		{t.VerifyAppended, "-verifyAppended"},
+	}
+	for _, f := range features {
+		if f.on {
+			missing = append(missing, f.name)
+		}
+	}
+	return strings.Join(args, " "), missing
+}
+
+// shellQuote quotes s for a POSIX shell if it needs it
+func shellQuote(s string) string {
+	safe := s != ""
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_./:=@%+,-", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// webhookTransfer is one transfer's result in a -webhook payload
+type webhookTransfer struct {
+	Index   int     `json:"index"`
+	Input   string  `json:"input"`
+	Output  string  `json:"output"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Status  string  `json:"status"` // ok or failed
+	Error   string  `json:"error,omitempty"`
+	Class   string  `json:"errorClass,omitempty"`
+	Digest  string  `json:"digest,omitempty"`
+	// Rate is the average copy rate in MB/s, next to the caps requested
+	// with bwlimitN and -bwlimitTotal
+	Rate         float64 `json:"rate"`
+	BwLimit      float64 `json:"bwlimit,omitempty"`
+	BwLimitTotal float64 `json:"bwlimitTotal,omitempty"`
+}
+
+// webhookPayload is POSTed to -webhook when a transfer (event
+// "transfer", with -webhookEach) or the whole run (event "complete")
+// finishes
+type webhookPayload struct {
+	Event     string            `json:"event"`
+	Transfers []webhookTransfer `json:"transfers"`
+	OK        int               `json:"ok"`
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"`
+	Bytes     int64             `json:"bytes"`
+}
+
+func newWebhookPayload(event string, transfers []*Transfer, skipped int) webhookPayload {
+	p := webhookPayload{Event: event, Transfers: []webhookTransfer{}, Skipped: skipped}
+	for _, tr := range transfers {
+		tr.Mutex.Lock()
+		wt := webhookTransfer{
+			Index:   tr.Index,
+			Input:   tr.InputFilename,
+			Output:  tr.OutputFilename,
+			Bytes:   tr.Transferred,
+			Seconds: tr.EndTime.Sub(tr.StartTime).Seconds(),
+			Status:  "ok",
+			Digest:  tr.Digest,
+			BwLimit: float64(tr.BwLimit) / (1024 * 1024),
+		}
+		if wt.Seconds > 0 {
+			wt.Rate = float64(wt.Bytes) / (1024 * 1024) / wt.Seconds
+		}
+		if tr.bwTotal != nil {
+			wt.BwLimitTotal = float64(tr.bwTotal.rate) / (1024 * 1024)
+		}
+		if tr.Err != nil {
+			wt.Status = "failed"
+			wt.Error = tr.Err.Error()
+			wt.Class = errClassNames[classifyError(tr.Err)][0]
+			p.Failed++
+		} else {
+			p.OK++
+		}
+		tr.Mutex.Unlock()
+		p.Bytes += wt.Bytes
+		p.Transfers = append(p.Transfers, wt)
+	}
+	return p
+}
+
+// job is the JSON object -jobStdin reads: one transfer, given with the
+// same names and values as its numbered flags, plus any global options.
+// The result written back is a webhookTransfer.
+type job struct {
+	If        string            `json:"if"`
+	Of        string            `json:"of"`
+	Bs        string            `json:"bs,omitempty"`
+	Count     int64             `json:"count,omitempty"`
+	Skip      int64             `json:"skip,omitempty"`
+	Seek      int64             `json:"seek,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Conv      string            `json:"conv,omitempty"`
+	Oflag     string            `json:"oflag,omitempty"`
+	Iflag     string            `json:"iflag,omitempty"`
+	Hash      string            `json:"hash,omitempty"`
+	Expect    string            `json:"expect,omitempty"`
+	Partition int               `json:"partition,omitempty"`
+	Until     string            `json:"until,omitempty"`
+	Options   map[string]string `json:"options,omitempty"` // e.g. {"verify": "true"}
+}
+
+// loadJob reads a job from r and applies it to f as transfer #1
+func loadJob(f *flag.FlagSet, r io.Reader) error {
+	var j job
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&j); err != nil {
+		return fmt.Errorf("error reading job: %w", err)
+	}
+	if j.If == "" || j.Of == "" {
+		return errors.New("job needs both if and of; stdin and stdout carry the job and its result")
+	}
+	set := map[string]string{"numTransfers": "1", "if1": j.If, "of1": j.Of}
+	strs := map[string]string{"bs1": j.Bs, "conv1": j.Conv, "oflag1": j.Oflag, "iflag1": j.Iflag, "hash1": j.Hash, "expect1": j.Expect, "until1": j.Until}
+	for name, v := range strs {
+		if v != "" {
+			set[name] = v
+		}
+	}
+	nums := map[string]int64{"count1": j.Count, "skip1": j.Skip, "seek1": j.Seek, "size1": j.Size, "partition1": int64(j.Partition)}
+	for name, v := range nums {
+		if v != 0 {
+			set[name] = strconv.FormatInt(v, 10)
+		}
+	}
+	for name, v := range j.Options {
+		if strings.HasSuffix(name, "1") || name == "numTransfers" || name == "jobStdin" {
+			return fmt.Errorf("job option %q: give the transfer's own settings as job fields", name)
+		}
+		set[name] = v
+	}
+	for name, v := range set {
+		if err := f.Set(name, v); err != nil {
+			return fmt.Errorf("job: invalid %s %q: %w", name, v, err)
+		}
+	}
+	return nil
+}
+
+// webhook delivery; failures are only logged and never affect the
+// transfers or the exit status
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+func postWebhook(url string, payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; ; attempt++ {
+		err = func() error {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("server returned %s", resp.Status)
+			}
+			return nil
+		}()
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("webhook %s event failed after %d attempts: %v", payload.Event, attempt, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// writeStats appends a CSV row per transfer to w every interval until
+// done is closed, then a final row for each and flushes. rate is the
+// throughput since the previous row.
+func writeStats(w io.Writer, transfers []*Transfer, interval time.Duration, done <-chan struct{}) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "transfer", "bytes", "rate_mbps", "percent"})
+	last := make([]int64, len(transfers))
+	lastTime := time.Now()
+	sample := func() {
+		now := time.Now()
+		secs := now.Sub(lastTime).Seconds()
+		lastTime = now
+		for i, tr := range transfers {
+			tr.Mutex.Lock()
+			transferred, total := tr.Transferred, tr.Total
+			if tr.Finished && tr.Err == nil {
+				total = transferred
+			}
+			tr.Mutex.Unlock()
+			var rate, pct float64
+			if secs > 0 {
+				rate = float64(transferred-last[i]) / (1024 * 1024) / secs
+			}
+			if total > 0 {
+				pct = math.Min(float64(transferred)/float64(total)*100, 100)
+			}
+			last[i] = transferred
+			cw.Write([]string{
+				now.Format(time.RFC3339Nano),
+				strconv.Itoa(tr.Index),
+				strconv.FormatInt(transferred, 10),
+				strconv.FormatFloat(rate, 'f', 2, 64),
+				strconv.FormatFloat(pct, 'f', 1, 64),
+			})
+		}
+		cw.Flush()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case <-done:
+			sample()
+			return cw.Error()
+		}
+	}
+}
+
+// chartInterval is how often -finalChart samples the transfer rates
+const chartInterval = 500 * time.Millisecond
+
+// sampleRates records each transfer's rate in its rates every interval
+// until done is closed
+func sampleRates(transfers []*Transfer, interval time.Duration, done <-chan struct{}) {
+	last := make([]int64, len(transfers))
+	lastTime := time.Now()
+	sample := func() {
+		now := time.Now()
+		secs := now.Sub(lastTime).Seconds()
+		lastTime = now
+		for i, tr := range transfers {
+			tr.Mutex.Lock()
+			transferred := tr.Transferred
+			tr.Mutex.Unlock()
+			var rate float64
+			if secs > 0 {
+				rate = float64(transferred-last[i]) / (1024 * 1024) / secs
+			}
+			last[i] = transferred
+			tr.rates = append(tr.rates, rate)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case <-done:
+			sample()
+			return
+		}
+	}
+}
+
+// renderChart draws rates, sampled every interval, as a bar chart of
+// height rows and at most width columns, averaging samples into columns
+// when there are more of them, e.g.
+//
+//	210.50 |   ###
+//	       | ######
+//	  0.00 +------
+//	        0s   3s
+func renderChart(rates []float64, interval time.Duration, width, height int) []string {
+	cols := rates
+	if len(rates) > width {
+		cols = make([]float64, width)
+		for c := range cols {
+			from, to := c*len(rates)/width, (c+1)*len(rates)/width
+			var sum float64
+			for _, r := range rates[from:to] {
+				sum += r
+			}
+			cols[c] = sum / float64(to-from)
+		}
+	}
+	var max float64
+	for _, r := range cols {
+		max = math.Max(max, r)
+	}
+	var lines []string
+	for row := height; row >= 1; row-- {
+		label := ""
+		if row == height {
+			label = fmt.Sprintf("%.2f", max)
+		}
+		var b strings.Builder
+		for _, r := range cols {
+			// a column is as tall as its share of the fastest one
+			if max > 0 && math.Round(r/max*float64(height)) >= float64(row) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%8s |%s", label, strings.TrimRight(b.String(), " ")))
+	}
+	lines = append(lines, fmt.Sprintf("%8s +%s", "0.00", strings.Repeat("-", len(cols))))
+	end := (time.Duration(len(rates)) * interval).Round(time.Second).String()
+	axis := "0s"
+	if pad := len(cols) - len(axis) - len(end); pad > 0 {
+		axis += strings.Repeat(" ", pad) + end
+	} else {
+		axis += " " + end
+	}
+	lines = append(lines, strings.Repeat(" ", 10)+axis)
+	return lines
+}
+
+// schedPrio is an I/O scheduling class and level and a nice value for a
+// transfer's thread; the zero value changes nothing
+type schedPrio struct {
+	ioClass int // ioprioClasses value, 0 for unchanged
+	ioLevel int
+	nice    int
+	setNice bool
+}
+
+// ioprioClasses maps -ioclass names to the kernel's IOPRIO_CLASS_* values
+var ioprioClasses = map[string]int{"rt": 1, "be": 2, "idle": 3}
+
+// orDefault returns s, or def if s is empty
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// parseSchedPrio interprets ioclass, ioprio and nice values, any of them
+// empty for unchanged. A level without a class is for best-effort, like
+// ionice.
+func parseSchedPrio(class, level, nice string) (schedPrio, error) {
+	var sp schedPrio
+	if class != "" {
+		c, ok := ioprioClasses[class]
+		if !ok {
+			return sp, fmt.Errorf("unknown ioclass %q (want rt, be or idle)", class)
+		}
+		sp.ioClass = c
+	}
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return sp, fmt.Errorf("ioprio must be a number from 0 to 7, not %q", level)
+		}
+		if sp.ioClass == 0 {
+			sp.ioClass = ioprioClasses["be"]
+		}
+		sp.ioLevel = n
+	} else if sp.ioClass != ioprioClasses["idle"] {
+		// the kernel's default level
+		sp.ioLevel = 4
+	}
+	if nice != "" {
+		n, err := strconv.Atoi(nice)
+		if err != nil || n < -20 || n > 19 {
+			return sp, fmt.Errorf("nice must be a number from -20 to 19, not %q", nice)
+		}
+		sp.nice, sp.setNice = n, true
 	}
+	return sp, nil
+}
 
-	if len(transfers) == 0 {
-		usage()
+const oomScoreAdjPath = "/proc/self/oom_score_adj"
+
+// setOOMScoreAdj writes adj to the oom_score_adj file at path, making
+// the OOM killer more (positive) or less (negative) likely to pick this
+// process. Raising it is always allowed; lowering it below its current
+// value needs CAP_SYS_RESOURCE.
+func setOOMScoreAdj(path string, adj int) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(adj)), 0); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("no permission to set oom_score_adj to %d (lowering it needs root or CAP_SYS_RESOURCE): %w", adj, err)
+		}
+		return fmt.Errorf("error setting oom_score_adj: %w", err)
 	}
+	return nil
+}
 
-	// concurrency
-	var ddWg sync.WaitGroup
+// checkInputsNotOutputs fails if a transfer would write to a file that
+// is (or will be, with -atomic) the input of any transfer, e.g. because
+// a script swapped if and of
+func checkInputsNotOutputs(transfers []*Transfer) error {
+	for _, in := range transfers {
+		if in.InputFilename == "" || in.NullIO || isURL(in.InputFilename) {
+			continue
+		}
+		inInfo, inErr := os.Stat(in.InputFilename)
+		for _, out := range transfers {
+			if out.OutputFilename == "" || out.NullIO {
+				continue
+			}
+			same := filepath.Clean(in.InputFilename) == filepath.Clean(out.OutputFilename)
+			if !same && inErr == nil {
+				if outInfo, err := os.Stat(out.OutputFilename); err == nil {
+					same = os.SameFile(inInfo, outInfo)
+				}
+			}
+			if same {
+				return fmt.Errorf("-readonlyInputs: transfer #%d would write to %q, the input of transfer #%d", out.Index, out.OutputFilename, in.Index)
+			}
+		}
+	}
+	return nil
+}
 
-	// FIX: add "range" here
-	for _, t := range transfers {
-		ddWg.Add(1)
-		go func(tr *Transfer) {
-			defer ddWg.Done()
-			err := doOneTransfer(tr, stdin)
-			if err != nil {
-				log.Printf("Error in transfer %s->%s: %v", tr.InputFilename, tr.OutputFilename, err)
+// estimateOutput guesses how many bytes t will write from its count or
+// size and its input's size, or returns -1 if it can't tell
+func estimateOutput(t *Transfer) int64 {
+	n := int64(-1)
+	if t.Count != math.MaxInt64 {
+		n = t.Count * t.Bs
+	} else if t.Size > 0 {
+		n = t.Size
+	}
+	if t.InputFilename != "" && !isURL(t.InputFilename) && t.Partition == 0 {
+		var avail int64 = -1
+		if fi, err := os.Stat(t.InputFilename); err == nil && fi.Mode().IsRegular() {
+			avail = fi.Size() - t.SkipOff
+		} else if err == nil && fi.Mode()&os.ModeDevice != 0 {
+			if f, err := os.Open(t.InputFilename); err == nil {
+				if sz := deviceSizeOf(f); sz > 0 {
+					avail = sz - t.SkipOff
+				}
+				f.Close()
 			}
-			tr.Mutex.Lock()
-			tr.Finished = true
-			tr.EndTime = time.Now()
-			tr.Mutex.Unlock()
-		}(t)
+		}
+		if avail >= 0 && (n < 0 || avail < n) {
+			n = avail
+		}
+	}
+	if n < 0 {
+		return -1
+	}
+	switch t.OutputEncoding {
+	case "hex":
+		n *= 2
+	case "base64":
+		n = (n + 2) / 3 * 4
+	}
+	return n
+}
+
+// checkSpace makes sure each filesystem receiving regular-file outputs
+// has the free space and inodes those outputs are expected to need.
+// Outputs of unknown size only count for their inode.
+func checkSpace(transfers []*Transfer) error {
+	type need struct {
+		dir    string
+		bytes  int64
+		inodes int64
+	}
+	needs := make(map[uint64]*need)
+	var devs []uint64
+	for _, t := range transfers {
+		if t.OutputFilename == "" || t.NullIO {
+			continue
+		}
+		var nbytes, inodes int64
+		dir := filepath.Dir(t.OutputFilename)
+		est := estimateOutput(t)
+		if est < 0 {
+			est = 0
+		}
+		fi, err := os.Stat(t.OutputFilename)
+		switch {
+		case err == nil && !fi.Mode().IsRegular():
+			continue
+		case err == nil && t.Oflag&os.O_APPEND != 0:
+			dir = t.OutputFilename
+			nbytes = est
+		case err == nil && !t.Atomic:
+			// an existing file only grows past its current end
+			dir = t.OutputFilename
+			nbytes = t.SeekOff + est - fi.Size()
+		default:
+			// a new file, or the .tmp of an atomic one
+			inodes = 1
+			nbytes = t.SeekOff + est
+		}
+		dfi, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+		dev, _, ok := devNumbers(dfi)
+		if !ok {
+			continue
+		}
+		if needs[dev] == nil {
+			needs[dev] = &need{dir: dir}
+			devs = append(devs, dev)
+		}
+		if nbytes > 0 {
+			needs[dev].bytes += nbytes
+		}
+		needs[dev].inodes += inodes
+	}
+
+	for _, dev := range devs {
+		n := needs[dev]
+		free, files, ffree, err := fsFreeOf(n.dir)
+		if err != nil {
+			return fmt.Errorf("error checking free space for %q: %w", n.dir, err)
+		}
+		if n.bytes > free {
+			return fmt.Errorf("not enough space for the outputs on the filesystem of %q: need %d bytes, %d free", n.dir, n.bytes, free)
+		}
+		// filesystems without an inode limit report 0 total
+		if files > 0 && n.inodes > ffree {
+			return fmt.Errorf("not enough inodes for the outputs on the filesystem of %q: need %d, %d free", n.dir, n.inodes, ffree)
+		}
+	}
+	return nil
+}
+
+// loadGate pauses all transfers while the system load is above
+// -maxLoad: open is closed while they may run
+type loadGate struct {
+	mu     sync.Mutex
+	paused bool
+	open   chan struct{}
+}
+
+func newLoadGate() *loadGate {
+	g := &loadGate{open: make(chan struct{})}
+	close(g.open)
+	return g
+}
+
+func (g *loadGate) setPaused(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if paused == g.paused {
+		return
+	}
+	g.paused = paused
+	if paused {
+		g.open = make(chan struct{})
+	} else {
+		close(g.open)
+	}
+}
+
+// wait blocks while the gate is paused or until ctx is canceled, and
+// returns how long it blocked
+func (g *loadGate) wait(ctx context.Context) (time.Duration, error) {
+	g.mu.Lock()
+	open := g.open
+	g.mu.Unlock()
+	select {
+	case <-open:
+		return 0, nil
+	default:
+	}
+	var canceled <-chan struct{}
+	if ctx != nil {
+		canceled = ctx.Done()
+	}
+	start := time.Now()
+	select {
+	case <-open:
+		return time.Since(start), nil
+	case <-canceled:
+		return time.Since(start), ctx.Err()
+	}
+}
+
+// loadPollInterval is how often -maxLoad checks the load average; Linux
+// updates it every 5 seconds
+const loadPollInterval = 5 * time.Second
+
+// check pauses or resumes g as load is above max or not
+func (g *loadGate) check(max float64, load func() (float64, error)) {
+	l, err := load()
+	if err != nil {
+		log.Printf("Warning: -maxLoad: %v", err)
+		return
+	}
+	over := l > max
+	g.mu.Lock()
+	changed := over != g.paused
+	g.mu.Unlock()
+	if !changed {
+		return
+	}
+	if over {
+		log.Printf("Load average %.2f is above -maxLoad=%g, pausing transfers", l, max)
+	} else {
+		log.Printf("Load average %.2f is back under -maxLoad=%g, resuming transfers", l, max)
+	}
+	g.setPaused(over)
+}
+
+// watchLoad checks the load every interval until done is closed; the
+// caller checks it once before the transfers start
+func watchLoad(g *loadGate, max float64, interval time.Duration, load func() (float64, error), done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.check(max, load)
+		case <-done:
+			g.setPaused(false)
+			return
+		}
+	}
+}
+
+// loadAverage returns the 1-minute load average from /proc/loadavg
+func loadAverage() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, fmt.Errorf("error reading load average: %w", err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg contents %q", b)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// statusModes are the -status values
+var statusModes = map[string]bool{"progress": true, "noxfer": true, "none": true, "json": true}
+
+// progressEvent is one line of -progressSocket and -status=json output
+type progressEvent struct {
+	Time      time.Time               `json:"time"`
+	Done      bool                    `json:"done"`
+	Transfers []progressEventTransfer `json:"transfers"`
+}
+
+type progressEventTransfer struct {
+	Index    int     `json:"index"`
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	Bytes    int64   `json:"bytes"`
+	Total    int64   `json:"total"`
+	Percent  float64 `json:"percent"`
+	Rate     float64 `json:"rate"` // MB/s
+	Waiting  bool    `json:"waiting,omitempty"`
+	Finished bool    `json:"finished"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func newProgressEvent(transfers []*Transfer, done bool) progressEvent {
+	ev := progressEvent{Time: time.Now(), Done: done}
+	for _, tr := range transfers {
+		ps := readProgress(tr)
+		et := progressEventTransfer{
+			Index:    tr.Index,
+			Input:    tr.InputFilename,
+			Output:   tr.OutputFilename,
+			Bytes:    ps.transferred,
+			Total:    ps.total,
+			Percent:  ps.pct,
+			Rate:     ps.rate,
+			Waiting:  ps.waiting,
+			Finished: ps.finished,
+		}
+		tr.Mutex.Lock()
+		if tr.Err != nil {
+			et.Error = tr.Err.Error()
+		}
+		tr.Mutex.Unlock()
+		ev.Transfers = append(ev.Transfers, et)
+	}
+	return ev
+}
+
+// writeProgressJSON writes a progressEvent line to w every interval
+// until done (-status=json)
+func writeProgressJSON(w io.Writer, transfers []*Transfer, interval time.Duration, done <-chan struct{}) {
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			enc.Encode(newProgressEvent(transfers, false))
+		case <-done:
+			return
+		}
+	}
+}
+
+// listenProgress creates the -progressSocket listener, replacing a stale
+// socket left by an earlier run
+func listenProgress(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating -progressSocket: %w", err)
 	}
+	return l, nil
+}
 
-	// progress goroutine
-	var progressWg sync.WaitGroup
-	progressWg.Add(1)
+// serveProgress sends every client of l a newline-delimited JSON
+// progressEvent every 500ms until done is closed, then a final one with
+// "done": true, and closes the clients and the socket. Clients that don't
+// keep up are dropped.
+func serveProgress(l net.Listener, transfers []*Transfer, done <-chan struct{}) {
+	var mu sync.Mutex
+	clients := make(map[net.Conn]bool)
 	go func() {
-		defer progressWg.Done()
-		mp := &MultiProgress{
-			Transfers:  transfers,
-			Fullscreen: fullscreen,
-			TermCols:   terminalCols,
-			TermRows:   terminalRows,
-		}
-		mp.startProgress()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			clients[c] = true
+			mu.Unlock()
+		}
 	}()
 
-	// handle signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		s := <-sigChan
-		fmt.Fprintf(os.Stderr, "\nReceived signal: %s. Terminating gracefully...\n", s)
-		for _, tr := range transfers {
-			tr.Mutex.Lock()
-			tr.Finished = true
-			tr.EndTime = time.Now()
-			tr.Mutex.Unlock()
+	send := func(final bool) {
+		line, err := json.Marshal(newProgressEvent(transfers, final))
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+		mu.Lock()
+		defer mu.Unlock()
+		for c := range clients {
+			c.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := c.Write(line); err != nil || final {
+				c.Close()
+				delete(clients, c)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			send(false)
+		case <-done:
+			// stop accepting first so nobody joins after the last event
+			l.Close()
+			send(true)
+			return
+		}
+	}
+}
+
+// printSnapshot writes how far each transfer has got, for infoSignals
+func printSnapshot(w io.Writer, transfers []*Transfer) {
+	var b strings.Builder
+	b.WriteString("\n")
+	for _, tr := range transfers {
+		fmt.Fprintf(&b, "#%d %s: ", tr.Index, tr.title())
+		ps := readProgress(tr)
+		if ps.waiting {
+			b.WriteString("waiting\n")
+			continue
+		}
+		state := ""
+		if ps.finished {
+			state = " (finished)"
+		}
+		fmt.Fprintf(&b, "%d bytes (%.2f MB) copied, %.3f s, %.2f MB/s%s\n",
+			ps.transferred, float64(ps.transferred)/(1024*1024), ps.elapsed, ps.rate, state)
+	}
+	io.WriteString(w, b.String())
+}
+
+// printSummary writes the final stats for each transfer and a grand total
+func printSummary(w io.Writer, transfers []*Transfer, skipped int, devices bool) {
+	var totalBytes, steadyBytes int64
+	var first, last, steadyFirst time.Time
+	failed := make(map[errClass]int)
+	nFailed := 0
+	for _, tr := range transfers {
+		tr.Mutex.Lock()
+		transferred := tr.Transferred
+		st := tr.StartTime
+		et := tr.EndTime
+		trErr := tr.Err
+		vstart, vend, verified := tr.VerifyStart, tr.VerifyEnd, tr.Verified
+		warmBytes, warmEnd := tr.WarmupBytes, tr.WarmupEnd
+		tr.Mutex.Unlock()
+
+		elapsed := et.Sub(st).Seconds()
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(transferred) / (1024 * 1024) / elapsed
+		}
+		status := ""
+		if tr.Resumed > 0 {
+			status = fmt.Sprintf(" (resumed after %d bytes)", tr.Resumed)
+		}
+		if trErr != nil {
+			class := classifyError(trErr)
+			failed[class]++
+			nFailed++
+			status += fmt.Sprintf(" [failed: %s]", errClassNames[class][0])
+		}
+		fmt.Fprintf(w, "#%d %s: %d bytes (%.2f MB) copied, %.3f s, %.2f MB/s%s\n",
+			tr.Index, tr.title(), transferred, float64(transferred)/(1024*1024), elapsed, rate, status)
+		if tr.Warmup > 0 {
+			// a timer can fire between the copy's end and Stop
+			if warmEnd.IsZero() || !warmEnd.Before(et) {
+				fmt.Fprintf(w, "   after %s warmup: finished within the warmup\n", tr.Warmup)
+			} else {
+				b := transferred - warmBytes
+				secs := et.Sub(warmEnd).Seconds()
+				fmt.Fprintf(w, "   after %s warmup: %d bytes, %.3f s, %.2f MB/s\n",
+					tr.Warmup, b, secs, float64(b)/(1024*1024)/secs)
+				steadyBytes += b
+				if steadyFirst.IsZero() || warmEnd.Before(steadyFirst) {
+					steadyFirst = warmEnd
+				}
+			}
+		}
+		if tr.BwLimit > 0 {
+			fmt.Fprintf(w, "   bwlimit: %.2f MB/s requested, %.2f MB/s achieved\n",
+				float64(tr.BwLimit)/(1024*1024), rate)
+		}
+		if !tr.SyncStart.IsZero() {
+			fmt.Fprintf(w, "   sync: %.3f s\n", tr.SyncEnd.Sub(tr.SyncStart).Seconds())
+		}
+		if tr.Holes > 0 {
+			fmt.Fprintf(w, "   conv=sparse: %d bytes left as holes\n", tr.Holes)
+		}
+		if tr.BadBlocks > 0 {
+			fmt.Fprintf(w, "   conv=noerror: %d unreadable block(s) skipped\n", tr.BadBlocks)
+		}
+		if tr.Rescue {
+			fmt.Fprintf(w, "   rescue: %d bytes recovered, %d still unreadable\n", transferred, tr.Unreadable)
+		}
+		if tr.Paused > 0 {
+			fmt.Fprintf(w, "   paused %.3f s for -maxLoad\n", tr.Paused.Seconds())
+		}
+		if tr.Digest != "" {
+			fmt.Fprintf(w, "   %s: %s\n", tr.HashAlg, tr.Digest)
+		}
+		if !vstart.IsZero() {
+			velapsed := vend.Sub(vstart).Seconds()
+			var vrate float64
+			if velapsed > 0 {
+				vrate = float64(verified) / (1024 * 1024) / velapsed
+			}
+			result := "SHA-256 matches"
+			if trErr != nil {
+				result = "failed"
+			}
+			fmt.Fprintf(w, "   verify: %d bytes read back, %.3f s, %.2f MB/s, %s\n", verified, velapsed, vrate, result)
+		}
+		if tr.SampleFraction > 0 && (trErr == nil || len(tr.Mismatches) > 0) {
+			fmt.Fprintf(w, "   sample verify: %d blocks compared (%g%%, -sampleSeed=%d), %d differing\n",
+				tr.Sampled, tr.SampleFraction*100, tr.SampleSeed, len(tr.Mismatches))
+		}
+		if devices {
+			fmt.Fprintf(w, "   in:  %s\n", deviceInfoOf(tr.InputFilename, "stdin"))
+			fmt.Fprintf(w, "   out: %s\n", deviceInfoOf(tr.OutputFilename, "stdout"))
+		}
+
+		totalBytes += transferred
+		if first.IsZero() || st.Before(first) {
+			first = st
+		}
+		if et.After(last) {
+			last = et
+		}
+	}
+
+	elapsed := last.Sub(first).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(totalBytes) / (1024 * 1024) / elapsed
+	}
+	fmt.Fprintf(w, "total: %d bytes (%.2f MB) copied by %d transfer(s), %.3f s, %.2f MB/s\n",
+		totalBytes, float64(totalBytes)/(1024*1024), len(transfers), elapsed, rate)
+	if len(transfers) > 0 && transfers[0].bwTotal != nil {
+		fmt.Fprintf(w, "   bwlimitTotal: %.2f MB/s requested, %.2f MB/s achieved\n",
+			float64(transfers[0].bwTotal.rate)/(1024*1024), rate)
+	}
+	if !steadyFirst.IsZero() {
+		secs := last.Sub(steadyFirst).Seconds()
+		fmt.Fprintf(w, "total after warmup: %d bytes (%.2f MB), %.3f s, %.2f MB/s\n",
+			steadyBytes, float64(steadyBytes)/(1024*1024), secs, float64(steadyBytes)/(1024*1024)/secs)
+	}
+
+	line := fmt.Sprintf("Completed: %d ok, %d failed", len(transfers)-nFailed, nFailed)
+	if nFailed > 0 {
+		var classes []string
+		for c := classOther; c <= classCanceled; c++ {
+			if n := failed[c]; n > 0 {
+				name := errClassNames[c][0]
+				if n > 1 {
+					name = errClassNames[c][1]
+				}
+				classes = append(classes, fmt.Sprintf("%d %s", n, name))
+			}
+		}
+		line += " (" + strings.Join(classes, ", ") + ")"
+	}
+	fmt.Fprintf(w, "%s, %d skipped\n", line, skipped)
+}
+
+// MultiProgress prints lines for multiple Transfers
+type MultiProgress struct {
+	Transfers  []*Transfer
+	Fullscreen bool
+	SingleLine bool
+	Aggregate  bool               // one \r line for all transfers, for non-terminals
+	Out        io.Writer          // where the Aggregate line goes
+	Label      *template.Template // -labelFormat banner, if set
+	Done       <-chan struct{}    // closed when all transfers finish
+	Moved      <-chan struct{}    // a transfer wrote its first bytes
+	TermCols   int
+	TermRows   int
+	AbsPos     bool // address each line by row instead of moving up
+	Collapse   bool // hide finished transfers, counting them on one line
+	row        int  // with AbsPos, the row the next line goes to
+	lines      int  // how many lines drawPage drew last
+}
+
+// rewind moves the cursor back up over the lines drawn last time; with
+// AbsPos, drawPage positions every line itself instead
+func (mp *MultiProgress) rewind(lines int) {
+	if !mp.AbsPos {
+		fmt.Printf("\033[%dA", lines)
+	}
+}
+
+// emit draws one line of the display: at the next row with AbsPos, else
+// where the cursor is
+func (mp *MultiProgress) emit(line string) {
+	if mp.AbsPos {
+		fmt.Printf("\033[%d;1H%s\033[K", mp.row, line)
+		mp.row++
+		return
+	}
+	fmt.Print(line + "\033[K\n")
+}
+
+// leaveAbsPos puts the cursor on a new line below an AbsPos display, for
+// whatever is printed after it
+func (mp *MultiProgress) leaveAbsPos() {
+	if mp.AbsPos {
+		fmt.Printf("\033[%d;1H\n", mp.row-1)
+	}
+}
+
+// pageInterval is how long each page is shown when fullscreen transfers
+// don't fit on one screen.
+const pageInterval = 3 * time.Second
+
+// The display is redrawn every progressInterval, unless drawing takes
+// more than 1/renderBudget of that: then the interval is doubled, up to
+// maxProgressInterval, so that the display never takes much CPU from the
+// transfers. It shrinks back once drawing is quick again.
+const (
+	progressInterval    = 500 * time.Millisecond
+	maxProgressInterval = 8 * time.Second
+	renderBudget        = 10
+)
+
+// nextInterval adapts the redraw interval cur to a redraw that took took
+func nextInterval(cur, took time.Duration) time.Duration {
+	switch {
+	case took*renderBudget > cur && cur < maxProgressInterval:
+		cur *= 2
+		if cur > maxProgressInterval {
+			cur = maxProgressInterval
+		}
+	case took*renderBudget*4 < cur && cur > progressInterval:
+		cur /= 2
+		if cur < progressInterval {
+			cur = progressInterval
+		}
+	}
+	return cur
+}
+
+// redraw runs draw and, if it took too long or was quick, resets ticker
+// to the adapted interval
+func redraw(ticker *time.Ticker, interval *time.Duration, draw func()) {
+	start := time.Now()
+	draw()
+	if next := nextInterval(*interval, time.Since(start)); next != *interval {
+		*interval = next
+		ticker.Reset(next)
+	}
+}
+
+func (mp *MultiProgress) startProgress() {
+	if mp.SingleLine {
+		mp.startSingleLine()
+		return
+	}
+	if mp.Aggregate {
+		mp.startAggregate()
+		return
+	}
+
+	page := 0
+	pages := mp.pages()
+
+	// Initial print
+	totalLines := mp.drawPage(page, pages, true)
+
+	interval := progressInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pageShown := time.Now()
+
+	for {
+		select {
+		case <-mp.Moved:
+			// redraw early so the bars move from the start
+			mp.rewind(totalLines)
+			totalLines = mp.drawPage(page, pages, false)
+		case <-mp.Done:
+			// final frame, drawn as soon as the last transfer ends
+			mp.rewind(totalLines)
+			totalLines = mp.drawPage(page, mp.pages(), false)
+			mp.leaveAbsPos()
+			return
+		case <-ticker.C:
+			allDone := true
+			for _, tr := range mp.Transfers {
+				tr.Mutex.Lock()
+				done := tr.Finished
+				tr.Mutex.Unlock()
+				if !done {
+					allDone = false
+					break
+				}
+			}
+			redraw(ticker, &interval, func() {
+				// with Collapse the number of pages can shrink
+				if pages = mp.pages(); page >= pages {
+					page = 0
+				}
+				if pages > 1 && time.Since(pageShown) >= pageInterval {
+					// Next page: the line count may change, so start from a clear screen
+					page = (page + 1) % pages
+					pageShown = time.Now()
+					totalLines = mp.drawPage(page, pages, true)
+				} else {
+					// Move cursor up to re-print the same lines
+					mp.rewind(totalLines)
+					totalLines = mp.drawPage(page, pages, false)
+				}
+			})
+			if allDone {
+				mp.leaveAbsPos()
+				return
+			}
+		}
+	}
+}
+
+// visible returns the transfers the display shows: all of them, or
+// with Collapse those that haven't finished
+func (mp *MultiProgress) visible() []*Transfer {
+	if !mp.Collapse {
+		return mp.Transfers
+	}
+	var list []*Transfer
+	for _, tr := range mp.Transfers {
+		tr.Mutex.Lock()
+		done := tr.Finished
+		tr.Mutex.Unlock()
+		if !done {
+			list = append(list, tr)
 		}
-		os.Exit(1)
-	}()
+	}
+	return list
+}
 
-	ddWg.Wait()
-	progressWg.Wait()
-	return nil
+// pages returns how many pages the visible transfers take
+func (mp *MultiProgress) pages() int {
+	n := len(mp.visible())
+	if n == 0 {
+		return 1
+	}
+	perPage := mp.pageSize(n)
+	return (n + perPage - 1) / perPage
 }
 
-// MultiProgress prints lines for multiple Transfers
-type MultiProgress struct {
-	Transfers  []*Transfer
-	Fullscreen bool
-	TermCols   int
-	TermRows   int
+// pageSize returns how many of n transfers are shown at once. Outside
+// fullscreen that is all of them; in fullscreen it is as many as fit in
+// TermRows, with one row kept for the page indicator when paging is needed.
+func (mp *MultiProgress) pageSize(n int) int {
+	if !mp.Fullscreen || 2*n <= mp.TermRows {
+		return n
+	}
+	per := (mp.TermRows - 1) / 2
+	if per < 1 {
+		per = 1
+	}
+	return per
 }
 
-func (mp *MultiProgress) startProgress() {
+// drawPage prints one page of transfers plus a "page X/Y" line when there is
+// more than one page, and returns how many lines it printed. With clear set
+// in fullscreen mode the screen is cleared and the page centered vertically.
+func (mp *MultiProgress) drawPage(page, pages int, clear bool) int {
+	list := mp.visible()
+	perPage := mp.pageSize(len(list))
+	lo := page * perPage
+	if lo > len(list) {
+		lo = len(list)
+	}
+	hi := lo + perPage
+	if hi > len(list) {
+		hi = len(list)
+	}
+	shown := list[lo:hi]
+	collapsed := len(mp.Transfers) - len(list)
+
 	linesPerTransfer := 2
-	totalLines := linesPerTransfer * len(mp.Transfers)
+	totalLines := linesPerTransfer * len(shown)
+	if pages > 1 {
+		totalLines++
+	}
+	if collapsed > 0 {
+		totalLines++
+	}
+	// fewer lines than last time: fullscreen starts over to stay
+	// centered, otherwise the leftover lines are blanked below
+	shrunk := 0
+	if mp.lines > totalLines && !clear {
+		if mp.Fullscreen {
+			clear = true
+		} else {
+			shrunk = mp.lines - totalLines
+		}
+	}
+	mp.lines = totalLines
 
 	// If fullscreen, clear screen and vertically center for a 24-row terminal
-	if mp.Fullscreen {
+	if mp.Fullscreen && clear {
 		// Clear entire screen, move cursor to top-left
 		fmt.Print("\033[2J\033[H")
 
@@ -485,104 +6384,757 @@ func (mp *MultiProgress) startProgress() {
 		}
 	}
 
-	// Initial print
-	mp.printAll(false)
+	if mp.AbsPos {
+		// the display's top row: centered in fullscreen, else at the
+		// bottom of the screen, after scrolling room for it on first draw
+		mp.row = 1
+		if mp.Fullscreen && mp.TermRows > totalLines {
+			mp.row = (mp.TermRows-totalLines)/2 + 1
+		} else if !mp.Fullscreen {
+			if clear {
+				fmt.Print(strings.Repeat("\n", totalLines))
+			}
+			if mp.TermRows > totalLines {
+				mp.row = mp.TermRows - totalLines + 1
+			}
+			// blank the rows the display no longer reaches up to
+			for r := mp.row - shrunk; r < mp.row; r++ {
+				if r >= 1 {
+					fmt.Printf("\033[%d;1H\033[K", r)
+				}
+			}
+		}
+	}
+	if collapsed > 0 {
+		mp.emit(Grey + centerText(fmt.Sprintf("%d of %d transfers finished", collapsed, len(mp.Transfers)), mp.TermCols) + Reset)
+	}
+	mp.printAll(shown)
+	if pages > 1 {
+		indicator := fmt.Sprintf("page %d/%d", page+1, pages)
+		mp.emit(Grey + centerText(indicator, mp.TermCols) + Reset)
+	}
+	if shrunk > 0 && !mp.AbsPos {
+		fmt.Print(strings.Repeat("\033[K\n", shrunk))
+		fmt.Printf("\033[%dA", shrunk)
+	}
+	return totalLines
+}
 
-	ticker := time.NewTicker(500 * time.Millisecond)
+// startAggregate rewrites one combined status line for all transfers with
+// \r. It uses no cursor movement, so it works on any stream that honors a
+// carriage return.
+func (mp *MultiProgress) startAggregate() {
+	interval := progressInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			allDone := true
-			for _, tr := range mp.Transfers {
-				tr.Mutex.Lock()
-				done := tr.Finished
-				tr.Mutex.Unlock()
-				if !done {
-					allDone = false
-					break
-				}
-			}
-			// Move cursor up to re-print the same lines
-			fmt.Printf("\033[%dA", totalLines)
-			mp.printAll(allDone)
-			if allDone {
-				return
-			}
+		case <-mp.Moved:
+		case <-mp.Done:
+		}
+		var allDone bool
+		redraw(ticker, &interval, func() {
+			var line string
+			line, allDone = mp.aggregateLine()
+			fmt.Fprintf(mp.Out, "\r%s", padRight(line, mp.TermCols-1))
+		})
+		if allDone {
+			fmt.Fprintln(mp.Out)
+			return
 		}
 	}
 }
 
-// printAll prints exactly 2 lines per transfer
-func (mp *MultiProgress) printAll(finished bool) {
+// aggregateLine sums up all transfers, e.g.
+// "2/3 done, 512.00 of 1024.00 MB (50.0%), 210.50 MB/s, ETA 00:00:02"
+func (mp *MultiProgress) aggregateLine() (string, bool) {
+	var transferred, total int64
+	var start time.Time
+	known := true
+	done := 0
 	for _, tr := range mp.Transfers {
-		// line 1: banner
-		banner := fmt.Sprintf("%s --> %s", tr.InputFilename, tr.OutputFilename)
-		fmt.Println(centerText(banner, mp.TermCols))
+		tr.Mutex.Lock()
+		transferred += tr.Transferred
+		if tr.Finished && tr.Err == nil {
+			// complete, whatever its estimated total was
+			total += tr.Transferred
+		} else if tr.Total <= 0 {
+			known = false
+		} else {
+			total += tr.Total
+		}
+		if tr.Finished {
+			done++
+		}
+		if !tr.StartTime.IsZero() && (start.IsZero() || tr.StartTime.Before(start)) {
+			start = tr.StartTime
+		}
+		tr.Mutex.Unlock()
+	}
 
-		// line 2: progress
+	elapsed := time.Since(start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(transferred) / (1024 * 1024) / elapsed
+	}
+	line := fmt.Sprintf("%d/%d done, %.2f", done, len(mp.Transfers), float64(transferred)/(1024*1024))
+	if known && total > 0 {
+		pct := float64(transferred) / float64(total) * 100
+		line += fmt.Sprintf(" of %.2f MB (%.1f%%)", float64(total)/(1024*1024), pct)
+	} else {
+		line += " MB"
+		total = 0
+	}
+	line += fmt.Sprintf(", %.2f", rate)
+	if len(mp.Transfers) > 0 && mp.Transfers[0].bwTotal != nil {
+		// against the -bwlimitTotal cap, as progressLine does for bwlimitN
+		line += fmt.Sprintf("/%.2f", float64(mp.Transfers[0].bwTotal.rate)/(1024*1024))
+	}
+	line += fmt.Sprintf(" MB/s, ETA %s", computeETA(transferred, total, elapsed, rate))
+	return line, done == len(mp.Transfers)
+}
+
+// isTerminal reports whether f looks like a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startSingleLine prints the banner once and then rewrites one progress
+// line in place with \r, only moving to a new line when the transfer ends.
+func (mp *MultiProgress) startSingleLine() {
+	tr := mp.Transfers[0]
+	fmt.Println(centerText(mp.bannerText(tr), mp.TermCols))
+	wasVerifying := false
+	fmt.Printf("\r%s", mp.progressLine(tr))
+
+	interval := progressInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-mp.Moved:
+		case <-mp.Done:
+		}
 		tr.Mutex.Lock()
-		transferred := tr.Transferred
-		total := tr.Total
-		isFinished := tr.Finished
-		st := tr.StartTime
-		et := tr.EndTime
+		done := tr.Finished
+		verifying := tr.verifying()
 		tr.Mutex.Unlock()
+		// the verify pass gets its own banner and line below the copy's
+		if verifying != wasVerifying && !done {
+			wasVerifying = verifying
+			fmt.Printf("\n%s\n", centerText(mp.bannerText(tr), mp.TermCols))
+		}
+		redraw(ticker, &interval, func() {
+			fmt.Printf("\r%s", mp.progressLine(tr))
+		})
+		if done {
+			fmt.Println()
+			return
+		}
+	}
+}
 
-		var elapsed float64
-		if isFinished {
-			elapsed = et.Sub(st).Seconds()
-		} else {
-			elapsed = time.Since(st).Seconds()
+// printAll prints exactly 2 lines per transfer
+func (mp *MultiProgress) printAll(transfers []*Transfer) {
+	for _, tr := range transfers {
+		// line 1: banner
+		mp.emit(centerText(mp.bannerText(tr), mp.TermCols))
+
+		// line 2: progress
+		mp.emit(mp.progressLine(tr))
+	}
+}
+
+// labelData holds the fields a -labelFormat template can use
+type labelData struct {
+	Name    string
+	Input   string
+	Output  string
+	Percent float64 // 0-100
+	Rate    float64 // MB/s
+	ETA     string  // hh:mm:ss, or the elapsed time once finished
+	Bytes   int64
+	Total   int64 // 0 if unknown
+}
+
+// parseLabelFormat compiles a -labelFormat template and renders it once
+// so that references to unknown fields fail at startup
+func parseLabelFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("label").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -labelFormat: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, labelData{}); err != nil {
+		return nil, fmt.Errorf("error in -labelFormat: %w", err)
+	}
+	return tmpl, nil
+}
+
+// bannerText names a transfer (or renders mp.Label for it) and, during
+// -verify, its current phase
+func (mp *MultiProgress) bannerText(tr *Transfer) string {
+	banner := tr.title()
+	if mp.Label != nil {
+		st := readProgress(tr)
+		var b strings.Builder
+		err := mp.Label.Execute(&b, labelData{
+			Name:    tr.Name,
+			Input:   tr.InputFilename,
+			Output:  tr.OutputFilename,
+			Percent: st.pct,
+			Rate:    st.rate,
+			ETA:     st.timer(),
+			Bytes:   st.transferred,
+			Total:   st.total,
+		})
+		if err == nil {
+			banner = b.String()
 		}
+	}
+	tr.Mutex.Lock()
+	defer tr.Mutex.Unlock()
+	if tr.verifying() {
+		banner += " (verifying)"
+	} else if !tr.SyncStart.IsZero() && tr.SyncEnd.IsZero() {
+		banner += " (syncing)"
+	}
+	return banner
+}
 
-		var rate float64
-		if elapsed > 0 {
-			rate = float64(transferred) / (1024*1024) / elapsed
+// parseSampleFraction parses a -sampleVerify percentage such as "1%" or
+// "0.5"
+func parseSampleFraction(str string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return 0, fmt.Errorf("invalid -sampleVerify %q: want a percentage above 0 and at most 100", str)
+	}
+	return pct / 100, nil
+}
+
+// sampleUnsupported says why the input and output of t can't be compared
+// block by block, or returns ""
+func sampleUnsupported(t *Transfer, follow bool) string {
+	switch {
+	case t.InputFilename == "" || t.OutputFilename == "":
+		return "stdin and stdout can't be read back"
+	case isURL(t.InputFilename):
+		return "URL inputs can't be read back"
+	case isFD(t.InputFilename) || isFD(t.OutputFilename):
+		return "inherited file descriptors can't be opened again"
+	case t.InputEncoding != "" || t.OutputEncoding != "":
+		return "encoded data differs between input and output"
+	case changesData(t.Conv):
+		return "conv= conversions change the data"
+	case follow:
+		return "followed inputs keep changing"
+	}
+	if fi, err := os.Stat(t.InputFilename); err != nil || !(fi.Mode().IsRegular() || fi.Mode()&os.ModeDevice != 0) {
+		return "input is not a regular file or device"
+	}
+	return ""
+}
+
+// sampleVerify compares a random subset of the blocks copied by t. Each
+// block is picked with probability SampleFraction, by drawing geometric
+// gaps between picks, so it never walks every block of a huge copy. It's
+// a probabilistic check: blocks it doesn't pick aren't compared.
+func sampleVerify(t *Transfer) error {
+	in, err := os.Open(t.InputFilename)
+	if err != nil {
+		return &transferError{classVerify, fmt.Errorf("error opening %q for sample verify: %w", t.InputFilename, err)}
+	}
+	defer in.Close()
+	out, err := os.Open(t.writePath)
+	if err != nil {
+		return &transferError{classVerify, fmt.Errorf("error opening %q for sample verify: %w", t.writePath, err)}
+	}
+	defer out.Close()
+
+	t.Mutex.Lock()
+	n := t.Transferred
+	t.Mutex.Unlock()
+	blocks := (n + t.Bs - 1) / t.Bs
+	rng := rand.New(rand.NewSource(t.SampleSeed))
+	inBuf := make([]byte, t.Bs)
+	outBuf := make([]byte, t.Bs)
+	next := func() int64 {
+		if t.SampleFraction >= 1 {
+			return 1
 		}
-		var pct float64
-		if total > 0 {
-			pct = float64(transferred) / float64(total) * 100
-			if pct > 100 {
-				pct = 100
+		return 1 + int64(math.Log(1-rng.Float64())/math.Log(1-t.SampleFraction))
+	}
+	for b := next() - 1; b < blocks; b += next() {
+		off := b * t.Bs
+		size := t.Bs
+		if off+size > n {
+			size = n - off
+		}
+		if _, err := in.ReadAt(inBuf[:size], t.SkipOff+off); err != nil {
+			return &transferError{classVerify, fmt.Errorf("error reading %q at %d for sample verify: %w", t.InputFilename, t.SkipOff+off, err)}
+		}
+		if _, err := out.ReadAt(outBuf[:size], t.SeekOff+off); err != nil && err != io.EOF {
+			return &transferError{classVerify, fmt.Errorf("error reading %q at %d for sample verify: %w", t.writePath, t.SeekOff+off, err)}
+		} else if err == io.EOF || !bytes.Equal(inBuf[:size], outBuf[:size]) {
+			t.Mismatches = append(t.Mismatches, t.SeekOff+off)
+		}
+		t.Sampled++
+	}
+	if len(t.Mismatches) > 0 {
+		var offs []string
+		for i, off := range t.Mismatches {
+			if i == 10 {
+				offs = append(offs, "...")
+				break
 			}
+			offs = append(offs, strconv.FormatInt(off, 10))
 		}
+		return &transferError{classVerify, fmt.Errorf("sample verify of %q found %d of %d sampled blocks differing, at output offsets %s",
+			t.writePath, len(t.Mismatches), t.Sampled, strings.Join(offs, ", "))}
+	}
+	return nil
+}
 
-		// Timer: final if done, else ETA
-		var timerStr string
-		if isFinished && pct >= 100 {
-			h := int(elapsed / 3600)
-			m := int((int(elapsed) % 3600) / 60)
-			s := int(int(elapsed) % 60)
-			timerStr = fmt.Sprintf("%02d:%02d:%02d", h, m, s)
-		} else {
-			timerStr = computeETA(transferred, total, elapsed, rate)
+// verifying reports whether the copy is done and the verify pass is
+// running. The caller must hold Mutex.
+func (t *Transfer) verifying() bool {
+	return !t.VerifyStart.IsZero() && !t.Finished
+}
+
+// progressState is a snapshot of a transfer's (or its verify pass's)
+// progress
+type progressState struct {
+	transferred int64
+	total       int64
+	finished    bool
+	waiting     bool    // not started yet
+	elapsed     float64 // seconds
+	rate        float64 // MB/s
+	limit       float64 // MB/s, bwlimitN of the copy; 0 if none
+	pct         float64
+}
+
+func readProgress(tr *Transfer) progressState {
+	tr.Mutex.Lock()
+	ps := progressState{
+		transferred: tr.Transferred,
+		total:       tr.Total,
+		finished:    tr.Finished,
+	}
+	st := tr.StartTime
+	et := tr.EndTime
+	ps.waiting = st.IsZero()
+	if tr.verifying() {
+		ps.transferred = tr.Verified
+		ps.total = tr.written.n
+		st = tr.VerifyStart
+	} else if tr.BwLimit > 0 {
+		ps.limit = float64(tr.BwLimit) / (1024 * 1024)
+	}
+	// a successful transfer is complete, even if it ended short of an
+	// estimated total or between two samples of its counter
+	complete := tr.Finished && tr.Err == nil
+	tr.Mutex.Unlock()
+
+	switch {
+	case ps.waiting:
+	case ps.finished:
+		ps.elapsed = et.Sub(st).Seconds()
+	default:
+		ps.elapsed = time.Since(st).Seconds()
+	}
+	if ps.elapsed > 0 {
+		ps.rate = float64(ps.transferred) / (1024 * 1024) / ps.elapsed
+	}
+	if complete {
+		ps.total = ps.transferred
+		ps.pct = 100
+	} else if ps.total > 0 {
+		ps.pct = float64(ps.transferred) / float64(ps.total) * 100
+		if ps.pct > 100 {
+			ps.pct = 100
+		}
+	}
+	return ps
+}
+
+// timer is the final elapsed time if done, else the ETA
+func (ps progressState) timer() string {
+	if ps.waiting {
+		return "waiting"
+	}
+	if ps.finished && ps.pct >= 100 {
+		h := int(ps.elapsed / 3600)
+		m := int((int(ps.elapsed) % 3600) / 60)
+		s := int(int(ps.elapsed) % 60)
+		return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+	}
+	return computeETA(ps.transferred, ps.total, ps.elapsed, ps.rate)
+}
+
+// progressLine renders the timer, bar and rate for one transfer; during
+// the verify pass they describe the read-back instead of the copy
+func (mp *MultiProgress) progressLine(tr *Transfer) string {
+	ps := readProgress(tr)
+	pct := ps.pct
+	leftGrey := Grey + padRight(ps.timer(), 8) + Reset
+
+	barWidth := 50
+	filled := int((pct / 100) * float64(barWidth))
+	if filled > barWidth {
+		filled = barWidth
+	}
+	filledBar := LightGreen + strings.Repeat("-", filled)
+	unfilledBar := DarkGreen + strings.Repeat("-", barWidth-filled) + Reset
+	bar := filledBar + unfilledBar
+
+	rateStr := fmt.Sprintf("%.2f MB/s", ps.rate)
+	if ps.limit > 0 {
+		// the rate against its cap, e.g. "49.80/50.00 MB/s"
+		rateStr = fmt.Sprintf("%.2f/%.2f MB/s", ps.rate, ps.limit)
+	}
+	rateGrey := Grey + padLeft(rateStr, 12) + Reset
+
+	leftSide := leftGrey + " " + bar + " "
+	line := leftSide + rateGrey
+	totalUsed := len(stripANSI(leftSide)) + len(stripANSI(rateGrey))
+
+	extra := mp.TermCols - totalUsed
+	if extra > 0 {
+		line += strings.Repeat(" ", extra)
+	}
+	return line
+}
+
+// deviceInfo identifies an input or output for audit trails
+type deviceInfo struct {
+	Path   string
+	ByID   []string
+	ByUUID []string
+	Model  string
+	Serial string
+	FS     string
+}
+
+func (d deviceInfo) String() string {
+	var parts []string
+	if len(d.ByID) > 0 {
+		parts = append(parts, "by-id: "+strings.Join(d.ByID, ", "))
+	}
+	if len(d.ByUUID) > 0 {
+		parts = append(parts, "by-uuid: "+strings.Join(d.ByUUID, ", "))
+	}
+	if d.Model != "" {
+		parts = append(parts, "model: "+d.Model)
+	}
+	if d.Serial != "" {
+		parts = append(parts, "serial: "+d.Serial)
+	}
+	if d.FS != "" {
+		parts = append(parts, "fs: "+d.FS)
+	}
+	if len(parts) == 0 {
+		return d.Path
+	}
+	return d.Path + " (" + strings.Join(parts, "; ") + ")"
+}
+
+// lookupDeviceInfo gathers what we can find out about name. Block devices
+// get their /dev/disk symlinks and sysfs model/serial, regular files their
+// filesystem type; all of that is Linux only and elsewhere we fall back to
+// the absolute path. An empty name is reported as std.
+func lookupDeviceInfo(name, std string) deviceInfo {
+	if name == "" {
+		return deviceInfo{Path: std}
+	}
+	d := deviceInfo{Path: name}
+	if abs, err := filepath.Abs(name); err == nil {
+		d.Path = abs
+	}
+	if runtime.GOOS != "linux" {
+		return d
+	}
+	resolved, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return d
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return d
+	}
+
+	if fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0 {
+		d.ByID = diskLinks("/dev/disk/by-id", resolved)
+		d.ByUUID = diskLinks("/dev/disk/by-uuid", resolved)
+		// partitions keep their device/ directory on the parent disk
+		base := filepath.Join("/sys/class/block", filepath.Base(resolved))
+		for _, dir := range []string{base + "/device", base + "/../device"} {
+			if d.Model == "" {
+				d.Model = readSysfs(dir + "/model")
+			}
+			if d.Serial == "" {
+				d.Serial = readSysfs(dir + "/serial")
+			}
+		}
+	} else if fi.Mode().IsRegular() {
+		d.FS = mountFSType(resolved)
+	}
+	return d
+}
+
+// diskLinks returns the names in dir that are symlinks to target
+func diskLinks(dir, target string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		p, err := filepath.EvalSymlinks(filepath.Join(dir, e.Name()))
+		if err == nil && p == target {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// pickOutputs has the user pick an output from devs for each of the
+// first n transfers that has an input but no output
+func pickOutputs(in *bufio.Reader, out io.Writer, devs []blockDevice, tfs []*transferFlags, n int) error {
+	for i := 1; i <= n && i <= len(tfs); i++ {
+		tv := tfs[i-1]
+		if tv.in == "" || tv.out != "" {
+			continue
+		}
+		var err error
+		what := fmt.Sprintf("transfer #%d (%s)", i, tv.in)
+		if tv.out, err = pickDevice(in, out, devs, what); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockDevice is a disk offered by -pickDevice
+type blockDevice struct {
+	Path      string
+	Size      int64
+	Model     string
+	Removable bool
+}
+
+// listBlockDevices lists the disks under sysBlock (/sys/block), leaving
+// out empty ones such as unused loop and ram devices
+func listBlockDevices(sysBlock string) []blockDevice {
+	entries, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return nil
+	}
+	var devs []blockDevice
+	for _, e := range entries {
+		dir := filepath.Join(sysBlock, e.Name())
+		sectors, _ := strconv.ParseInt(readSysfs(dir+"/size"), 10, 64)
+		if sectors == 0 {
+			continue
+		}
+		devs = append(devs, blockDevice{
+			Path: "/dev/" + e.Name(),
+			// sysfs counts 512-byte sectors whatever the device uses
+			Size:      sectors * 512,
+			Model:     readSysfs(dir + "/device/model"),
+			Removable: readSysfs(dir+"/removable") == "1",
+		})
+	}
+	return devs
+}
+
+// pickDevice lists devs on out and reads the number of one from in,
+// asking again until it gets a valid choice
+func pickDevice(in *bufio.Reader, out io.Writer, devs []blockDevice, what string) (string, error) {
+	if len(devs) == 0 {
+		return "", errors.New("no block devices found")
+	}
+	fmt.Fprintf(out, "Block devices:\n")
+	for i, d := range devs {
+		extra := d.Model
+		if d.Removable {
+			extra += " (removable)"
+		}
+		fmt.Fprintf(out, "  %d) %-14s %10.1f GB  %s\n", i+1, d.Path, float64(d.Size)/1e9, strings.TrimSpace(extra))
+	}
+	for {
+		fmt.Fprintf(out, "Output for %s [1-%d]: ", what, len(devs))
+		line, err := in.ReadString('\n')
+		if n, perr := strconv.Atoi(strings.TrimSpace(line)); perr == nil && n >= 1 && n <= len(devs) {
+			return devs[n-1].Path, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("no device chosen for %s: %w", what, err)
+		}
+	}
+}
+
+// diskLimit caps the transfers running at once on each physical disk
+// (-perDevice)
+type diskLimit struct {
+	mu   sync.Mutex
+	max  int
+	busy map[uint64]int
+}
+
+// newDiskLimit finds the disks of transfers for a limit of max transfers
+// per disk; it returns nil, which never holds a transfer back, for 0
+func newDiskLimit(max int, transfers []*Transfer) *diskLimit {
+	if max <= 0 {
+		return nil
+	}
+	for _, t := range transfers {
+		if t.NullIO {
+			continue
+		}
+		for _, name := range []string{t.InputFilename, t.OutputFilename} {
+			d, ok := physicalDisk(name)
+			if ok && !containsDisk(t.disks, d) {
+				t.disks = append(t.disks, d)
+			}
+		}
+	}
+	return &diskLimit{max: max, busy: map[uint64]int{}}
+}
+
+// fits reports whether none of t's disks is at the limit
+func (l *diskLimit) fits(t *Transfer) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range t.disks {
+		if l.busy[d] >= l.max {
+			return false
 		}
-		leftGrey := Grey + padRight(timerStr, 8) + Reset
+	}
+	return true
+}
+
+// acquire counts t as running on its disks
+func (l *diskLimit) acquire(t *Transfer) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range t.disks {
+		l.busy[d]++
+	}
+}
+
+// release undoes acquire once t has finished
+func (l *diskLimit) release(t *Transfer) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range t.disks {
+		l.busy[d]--
+	}
+}
 
-		barWidth := 50
-		filled := int((pct / 100) * float64(barWidth))
-		if filled > barWidth {
-			filled = barWidth
+// containsDisk reports whether d is in disks
+func containsDisk(disks []uint64, d uint64) bool {
+	for _, x := range disks {
+		if x == d {
+			return true
 		}
-		filledBar := LightGreen + strings.Repeat("-", filled)
-		unfilledBar := DarkGreen + strings.Repeat("-", barWidth-filled) + Reset
-		bar := filledBar + unfilledBar
+	}
+	return false
+}
 
-		rateStr := fmt.Sprintf("%.2f MB/s", rate)
-		rateGrey := Grey + padLeft(rateStr, 12) + Reset
+// physicalDisk identifies the disk holding name: the device itself for a
+// block device, else the device of its filesystem (of its directory if it
+// doesn't exist yet). On Linux a partition is mapped to its whole disk
+// through /sys/dev/block, so two partitions of one disk share a limit.
+func physicalDisk(name string) (uint64, bool) {
+	if name == "" {
+		return 0, false
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		if fi, err = os.Stat(filepath.Dir(name)); err != nil {
+			return 0, false
+		}
+	}
+	dev, rdev, ok := devNumbers(fi)
+	if !ok {
+		return 0, false
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			// /dev/zero and the like aren't disks
+			return 0, false
+		}
+		dev = rdev
+	}
+	if runtime.GOOS != "linux" {
+		return dev, true
+	}
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	sys, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return dev, true
+	}
+	if _, err := os.Stat(sys + "/partition"); err == nil {
+		var maj, min uint64
+		if _, err := fmt.Sscanf(readSysfs(filepath.Dir(sys)+"/dev"), "%d:%d", &maj, &min); err == nil {
+			// the same encoding as above, backwards
+			return (maj&0xfff)<<8 | (maj&^0xfff)<<32 | min&0xff | (min&^0xff)<<12, true
+		}
+	}
+	return dev, true
+}
 
-		leftSide := leftGrey + " " + bar + " "
-		line := leftSide + rateGrey
-		totalUsed := len(stripANSI(leftSide)) + len(stripANSI(rateGrey))
+// readSysfs returns the trimmed contents of a sysfs attribute, or ""
+func readSysfs(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
 
-		extra := mp.TermCols - totalUsed
-		if extra > 0 {
-			line += strings.Repeat(" ", extra)
+// mountFSType finds the filesystem type of the mount containing path by
+// picking the longest matching mount point in /proc/self/mountinfo.
+func mountFSType(path string) string {
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	best, fstype := "", ""
+	for _, line := range strings.Split(string(b), "\n") {
+		// mount ID, parent, major:minor, root, mount point, options... - fstype source
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mp := fields[4]
+		if (path == mp || strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/")) && len(mp) > len(best) {
+			best, fstype = mp, fields[sep+1]
 		}
-		fmt.Printf("\r%s\n", line)
 	}
+	return fstype
 }
 
 // computeETA calculates time left or ?? if unknown
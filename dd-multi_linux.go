@@ -0,0 +1,107 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// oNoatime and oDirect are the open flags of iflag=noatime and
+// iflag/oflag=direct
+const (
+	oNoatime = syscall.O_NOATIME
+	oDirect  = syscall.O_DIRECT
+)
+
+// fdatasync flushes f's data, but not metadata such as times
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// apply sets sp for the calling goroutine's thread, which Linux schedules
+// on its own for both I/O and CPU priority
+func (sp schedPrio) apply() error {
+	if sp.ioClass == 0 && !sp.setNice {
+		return nil
+	}
+	tid := threadID()
+	if sp.ioClass != 0 {
+		const ioprioWhoProcess, ioprioClassShift = 1, 13
+		prio := uintptr(sp.ioClass<<ioprioClassShift | sp.ioLevel)
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio); errno != 0 {
+			return fmt.Errorf("error setting ioclass (rt needs root): %w", errno)
+		}
+	}
+	if sp.setNice {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, sp.nice); err != nil {
+			return fmt.Errorf("error setting nice (lowering it needs root): %w", err)
+		}
+	}
+	return nil
+}
+
+// cgroupFile returns the file of cgroup dir that takes thread IDs:
+// cgroup.threads for a threaded cgroup v2, tasks for cgroup v1
+func cgroupFile(dir string) (string, error) {
+	for _, name := range []string{"cgroup.threads", "tasks"} {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a threaded cgroup v2 or a cgroup v1 directory (no cgroup.threads or tasks)", dir)
+}
+
+// threadID returns the Linux thread ID of the calling goroutine's thread,
+// which it locks the goroutine to. The thread is never handed back, so
+// it ends with the goroutine rather than running other work with the
+// settings made for it.
+func threadID() int {
+	runtime.LockOSThread()
+	return syscall.Gettid()
+}
+
+// joinCgroup moves the calling goroutine's thread into the cgroup with
+// thread file path (see cgroupFile)
+func joinCgroup(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(threadID())), 0); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("no permission to join cgroup (%s needs to be writable, e.g. delegated to this user): %w", path, err)
+		}
+		return fmt.Errorf("error joining cgroup: %w", err)
+	}
+	return nil
+}
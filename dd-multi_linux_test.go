@@ -0,0 +1,86 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJoinCgroup(t *testing.T) {
+	root := t.TempDir()
+	v2 := filepath.Join(root, "v2")
+	v1 := filepath.Join(root, "v1")
+	for dir, file := range map[string]string{v2: "cgroup.threads", v1: "tasks"} {
+		os.Mkdir(dir, 0o755)
+		writeTestFile(t, dir, file, nil)
+	}
+	if _, err := cgroupFile(root); err == nil {
+		t.Error("directory without cgroup files accepted")
+	}
+
+	for _, dir := range []string{v2, v1} {
+		path, err := cgroupFile(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// joinCgroup keeps its thread, so give it a goroutine of its own
+		type result struct {
+			tid int
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			err := joinCgroup(path)
+			done <- result{threadID(), err}
+		}()
+		r := <-done
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		got, _ := os.ReadFile(path)
+		if string(got) != strconv.Itoa(r.tid) {
+			t.Errorf("%s holds %q, want the thread ID %d", path, got, r.tid)
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		path := filepath.Join(v2, "cgroup.threads")
+		os.Chmod(path, 0o444)
+		done := make(chan error)
+		go func() { done <- joinCgroup(path) }()
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "no permission to join cgroup") {
+			t.Errorf("read-only cgroup gave %v", err)
+		}
+	}
+}
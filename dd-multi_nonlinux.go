@@ -0,0 +1,63 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// oNoatime is 0 where there is no O_NOATIME; iflag=noatime is then
+// ignored with a warning
+const oNoatime = 0
+
+// fdatasync falls back to fsync where there is no fdatasync
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// apply fails unless sp changes nothing: only Linux schedules threads on
+// their own
+func (sp schedPrio) apply() error {
+	if sp.ioClass == 0 && !sp.setNice {
+		return nil
+	}
+	return errors.New("per-transfer ioclass and nice are Linux-only")
+}
+
+// cgroupFile and joinCgroup fail: run() warns -cgroup away before
+// using them anywhere but Linux
+func cgroupFile(dir string) (string, error) {
+	return "", errors.New("cgroups are Linux-only")
+}
+
+func joinCgroup(path string) error {
+	return errors.New("cgroups are Linux-only")
+}
@@ -0,0 +1,89 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+// errNotUnix is returned by what needs the Unix system calls of
+// dd-multi_unix.go
+var errNotUnix = errors.New("not supported on " + runtime.GOOS)
+
+func clearDirect(f *os.File) error {
+	return errNotUnix
+}
+
+func fdFile(name string, write bool) (*os.File, error) {
+	return nil, errNotUnix
+}
+
+// checkReadOnly has nothing to check: without fd:N names every input is
+// opened read-only here
+func checkReadOnly(f *os.File) error {
+	return nil
+}
+
+func devIoctl(f *os.File, linuxReq, freebsdReq uintptr, arg unsafe.Pointer) error {
+	return errNotUnix
+}
+
+func fsBlockSize(name string) int64 {
+	return 0
+}
+
+// devNumbers reports no devices, so -checkSpace and -perDevice have
+// nothing to check
+func devNumbers(fi os.FileInfo) (dev, rdev uint64, ok bool) {
+	return 0, 0, false
+}
+
+func fsFree(dir string) (free, files, ffree int64, err error) {
+	return 0, 0, 0, errNotUnix
+}
+
+func setSockBufs(fd uintptr, size int) error {
+	return errNotUnix
+}
+
+func setProcessNice(n int) error {
+	return errNotUnix
+}
+
+// checkFdLimit has no RLIMIT_NOFILE to check
+func checkFdLimit(concurrent int) error {
+	return nil
+}
+
+// infoSignals is empty: there is no SIGUSR1
+var infoSignals []os.Signal
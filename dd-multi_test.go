@@ -0,0 +1,3098 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs dd-multi itself instead of the tests when runMain starts
+// the test binary with DD_MULTI_ARGS set
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("DD_MULTI_ARGS"); ok {
+		os.Args = append([]string{"dd-multi"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs dd-multi with args in a child process and returns its exit
+// status and what it wrote to stdout and stderr
+func runMain(t *testing.T, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	return runMainStdin(t, nil, args...)
+}
+
+// runMainStdin is runMain with stdin read from in
+func runMainStdin(t *testing.T, in io.Reader, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DD_MULTI_ARGS="+strings.Join(args, "\n"))
+	cmd.Stdin = in
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return code, out.String(), errOut.String()
+}
+
+// runInProcess runs dd-multi with args in this process with its output
+// thrown away, for benchmarks
+func runInProcess(tb testing.TB, args ...string) error {
+	tb.Helper()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer null.Close()
+	oldArgs, oldStdout, oldStderr := os.Args, os.Stdout, os.Stderr
+	os.Args = append([]string{"dd-multi"}, args...)
+	os.Stdout, os.Stderr = null, null
+	log.SetOutput(null)
+	defer func() {
+		os.Args, os.Stdout, os.Stderr = oldArgs, oldStdout, oldStderr
+		log.SetOutput(os.Stderr)
+	}()
+	return run(strings.NewReader(""), null)
+}
+
+// newTestTransfer returns a transfer copying in to out with 512-byte
+// blocks and no count, as the command line would set it up
+func newTestTransfer(in, out string) *Transfer {
+	return &Transfer{
+		Index:          1,
+		InputFilename:  in,
+		OutputFilename: out,
+		Bs:             512,
+		Count:          math.MaxInt64,
+		Oflag:          os.O_CREATE | os.O_TRUNC,
+	}
+}
+
+// writeTestFile writes data to name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// fileSize returns the size of the file at path
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestInputEncodingHex(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in.hex", []byte("de ad\nBE EF\r\n00 ff\n"))
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer(in, out)
+	tr.InputEncoding = "hex"
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0xff}; !bytes.Equal(got, want) {
+		t.Errorf("decoded %x, want %x", got, want)
+	}
+}
+
+func TestInputEncodingKeepsLimits(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in.hex", bytes.Repeat([]byte("0123456789abcdef\n"), 400))
+	out := filepath.Join(dir, "out")
+
+	// a canceled transfer must stop, not decode past the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr := newTestTransfer(in, out)
+	tr.InputEncoding = "hex"
+	tr.ctx = ctx
+	if err := doOneTransfer(tr, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled transfer returned %v, want context.Canceled", err)
+	}
+
+	// 6800 encoded bytes at 20000 bytes/s take about a third of a second
+	tr = newTestTransfer(in, out)
+	tr.InputEncoding = "hex"
+	tr.BwLimit = 20000
+	start := time.Now()
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("bwlimit ignored with inputEncoding: copy took %v", d)
+	}
+	if n := fileSize(t, out); n != 3200 {
+		t.Errorf("output is %d bytes, want 3200", n)
+	}
+}
+
+// startPipedTransfer runs tr from stdin fed by the returned writer,
+// which is closed when the transfer ends; the channel gets its result
+func startPipedTransfer(tr *Transfer) (*io.PipeWriter, <-chan error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := doOneTransfer(tr, pr)
+		pr.CloseWithError(io.ErrClosedPipe)
+		done <- err
+	}()
+	return pw, done
+}
+
+// waitTransferred waits until tr has written n bytes
+func waitTransferred(t *testing.T, tr *Transfer, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.Mutex.Lock()
+		got := tr.Transferred
+		tr.Mutex.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer stuck at %d bytes, waiting for %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// feed writes zeros to w until the reader goes away
+func feed(w *io.PipeWriter) {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestControlLimit(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer("", out)
+	tr.Count = 16 // 8K
+	setLimit := func(tr *Transfer, n int) int {
+		srv := httptest.NewServer(controlHandler([]*Transfer{tr}))
+		defer srv.Close()
+		resp, err := http.Post(fmt.Sprintf("%s/transfers/1/limit?bytes=%d", srv.URL, n), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := setLimit(tr, 4096); code != http.StatusConflict {
+		t.Errorf("limiting a transfer that isn't running answered %d", code)
+	}
+
+	// raise the limit from 8K to 12K halfway through: the copy goes on
+	// past 8K
+	pw, done := startPipedTransfer(tr)
+	if _, err := pw.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	waitTransferred(t, tr, 4096)
+	if code := setLimit(tr, 12288); code != http.StatusOK {
+		t.Fatalf("raising the limit answered %d", code)
+	}
+	go feed(pw)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, out); n != 12288 {
+		t.Errorf("raised limit: output is %d bytes, want 12288", n)
+	}
+
+	// lower an unlimited transfer to 6K: it stops there
+	tr = newTestTransfer("", out)
+	pw, done = startPipedTransfer(tr)
+	if _, err := pw.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	waitTransferred(t, tr, 4096)
+	if code := setLimit(tr, 6144); code != http.StatusOK {
+		t.Fatalf("lowering the limit answered %d", code)
+	}
+	go feed(pw)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, out); n != 6144 {
+		t.Errorf("lowered limit: output is %d bytes, want 6144", n)
+	}
+}
+
+// zeroReader is an endless input of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestBwlimitTotalWeights(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	shared := newSharedLimiter(4 << 20)
+	heavy := newTestTransfer("", filepath.Join(dir, "heavy"))
+	light := newTestTransfer("", filepath.Join(dir, "light"))
+	heavy.Weight, light.Weight = 3, 1
+	done := make(chan error, 2)
+	for _, tr := range []*Transfer{heavy, light} {
+		tr.Bs = 4096
+		tr.ctx = ctx
+		tr.bwTotal = shared
+		go func(tr *Transfer) { done <- doOneTransfer(tr, zeroReader{}) }(tr)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("transfer ended with %v before the deadline", err)
+		}
+	}
+	total := heavy.Transferred + light.Transferred
+	// 0.6s at 4M/s, with some slack
+	if max := int64(7 * (4 << 20) / 10); total > max {
+		t.Errorf("copied %d bytes together, more than %d", total, max)
+	}
+	if ratio := float64(heavy.Transferred) / float64(light.Transferred); ratio < 2.4 || ratio > 3.6 {
+		t.Errorf("weights 3 and 1 copied %d and %d bytes, a ratio of %.2f", heavy.Transferred, light.Transferred, ratio)
+	}
+}
+
+func TestRateLimitReported(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 256<<10))
+	tr := newTestTransfer(in, filepath.Join(dir, "out"))
+	tr.BwLimit = 1 << 20
+	tr.StartTime = time.Now()
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	tr.EndTime = time.Now()
+	tr.Finished = true
+
+	var b bytes.Buffer
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	if !strings.Contains(b.String(), "bwlimit: 1.00 MB/s requested") {
+		t.Errorf("summary doesn't show the cap:\n%s", b.String())
+	}
+	wt := newWebhookPayload("complete", []*Transfer{tr}, 0).Transfers[0]
+	if wt.BwLimit != 1 {
+		t.Errorf("JSON bwlimit is %v, want 1", wt.BwLimit)
+	}
+	if wt.Rate <= 0 || wt.Rate > 1.01 {
+		t.Errorf("JSON rate is %v MB/s, want at most the 1 MB/s cap", wt.Rate)
+	}
+	if !strings.Contains(b.String(), fmt.Sprintf("%.2f MB/s achieved", wt.Rate)) {
+		t.Errorf("summary doesn't show the achieved rate %.2f:\n%s", wt.Rate, b.String())
+	}
+}
+
+func TestOnErrorExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	missing := filepath.Join(dir, "missing")
+	for _, onError := range []string{"continue", "abort"} {
+		code, _, stderr := runMain(t, "-status", "none", "-onError", onError, "-numTransfers", "2",
+			"-if1", missing, "-of1", filepath.Join(dir, "out1"),
+			"-if2", in, "-of2", filepath.Join(dir, "out2"))
+		if code != 1 {
+			t.Errorf("-onError=%s: exit status %d with a failed transfer, want 1\n%s", onError, code, stderr)
+		}
+	}
+	if code, _, stderr := runMain(t, "-status", "none", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out1")); code != 0 {
+		t.Errorf("exit status %d without failures, want 0\n%s", code, stderr)
+	}
+	code, _, stderr := runMain(t, "-status", "none", "-failFast", "-numTransfers", "1", "-if1", missing, "-of1", filepath.Join(dir, "out1"))
+	if code != 1 || !strings.Contains(stderr, "-failFast is deprecated") {
+		t.Errorf("-failFast: exit status %d, want 1 and a deprecation warning\n%s", code, stderr)
+	}
+}
+
+func TestSingleLineProgress(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 64<<10))
+	code, stdout, stderr := runMain(t, "-singleLine", "-numTransfers", "1",
+		"-if1", in, "-of1", filepath.Join(dir, "out"))
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	banner, progress, ok := strings.Cut(stdout, "\n")
+	if !ok || !strings.Contains(banner, "in --> ") {
+		t.Fatalf("no banner line first: %q", stdout)
+	}
+	// one line rewritten with \r, ended only once the transfer is done
+	if !strings.HasPrefix(progress, "\r") || strings.Count(progress, "\n") != 1 || !strings.HasSuffix(progress, "\n") {
+		t.Errorf("progress isn't a single line updated in place: %q", progress)
+	}
+	if regexp.MustCompile(`\033\[\d*A`).MatchString(progress) || strings.Contains(progress, "\033[K") {
+		t.Errorf("progress moves the cursor up or clears lines: %q", progress)
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 64<<10))
+	code, stdout, stderr := runMain(t, "-summaryOnly", "-numTransfers", "2",
+		"-if1", in, "-of1", filepath.Join(dir, "out1"),
+		"-if2", in, "-of2", filepath.Join(dir, "out2"))
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("progress drawn with -summaryOnly: %q", stdout)
+	}
+	if strings.Contains(stderr, "\r") || strings.Contains(stderr, "\033[") {
+		t.Errorf("progress line or cursor codes on stderr: %q", stderr)
+	}
+	for _, want := range []string{"#1 ", "#2 ", "total: 131072 bytes", "Completed: 2 ok, 0 failed, 0 skipped"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("summary is missing %q:\n%s", want, stderr)
+		}
+	}
+}
+
+// captureStdout returns what f prints to os.Stdout, where the progress
+// display draws
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	tmp, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	old := os.Stdout
+	os.Stdout = tmp
+	defer func() { os.Stdout = old }()
+	f()
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFullscreenPages(t *testing.T) {
+	var transfers []*Transfer
+	for i := 1; i <= 10; i++ {
+		transfers = append(transfers, &Transfer{Index: i, Name: fmt.Sprintf("t%d", i), InputFilename: "in", OutputFilename: "out"})
+	}
+	mp := &MultiProgress{Transfers: transfers, Fullscreen: true, TermCols: 80, TermRows: 10}
+	// 4 transfers of 2 lines each fit with the page indicator
+	if pages := mp.pages(); pages != 3 {
+		t.Fatalf("%d pages, want 3", pages)
+	}
+	var lines int
+	out := captureStdout(t, func() { lines = mp.drawPage(1, 3, true) })
+	if lines != 9 {
+		t.Errorf("drawPage reported %d lines, want 9", lines)
+	}
+	for i := 1; i <= 10; i++ {
+		if shown := strings.Contains(out, fmt.Sprintf("t%d: ", i)); shown != (i >= 5 && i <= 8) {
+			t.Errorf("transfer %d shown on page 2: %v", i, shown)
+		}
+	}
+	if !strings.Contains(out, "page 2/3") {
+		t.Errorf("no page indicator in %q", out)
+	}
+	// the last page has two transfers, centered below a cleared screen
+	out = captureStdout(t, func() { lines = mp.drawPage(2, 3, true) })
+	body, ok := strings.CutPrefix(out, "\033[2J\033[H")
+	if !ok {
+		t.Fatalf("page doesn't start by clearing the screen: %q", out)
+	}
+	if lines != 5 || strings.Count(body, "\n") != (10-5)/2+5 {
+		t.Errorf("%d lines reported and %d newlines drawn, want 5 and %d", lines, strings.Count(body, "\n"), (10-5)/2+5)
+	}
+	if !strings.Contains(out, "t9: ") || !strings.Contains(out, "t10: ") || !strings.Contains(out, "page 3/3") {
+		t.Errorf("last page is %q", out)
+	}
+}
+
+// fakeOpen replaces openFile for the test with open, which gets the
+// real os.OpenFile to call
+func fakeOpen(t *testing.T, open func(real func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error)) {
+	old := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return open(old, name, flag, perm)
+	}
+	t.Cleanup(func() { openFile = old })
+}
+
+func TestNoatimeFallback(t *testing.T) {
+	if oNoatime == 0 {
+		t.Skip("O_NOATIME is Linux-only")
+	}
+	in := writeTestFile(t, t.TempDir(), "in", []byte("data"))
+	var flags []int
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		flags = append(flags, flag)
+		if flag&oNoatime != 0 {
+			// as for a file owned by someone else
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+		}
+		return open(name, flag, perm)
+	})
+	f, err := openInput(in, oNoatime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if len(flags) != 2 || flags[0]&oNoatime == 0 || flags[1]&oNoatime != 0 {
+		t.Errorf("opened with flags %#x, want O_NOATIME and then without it", flags)
+	}
+}
+
+func TestFastReport(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 64<<10))
+	code, stdout, stderr := runMain(t, "-fast", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"))
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	if stdout != "" || strings.Contains(stderr, "\r") {
+		t.Errorf("progress drawn with -fast: %q, %q", stdout, stderr)
+	}
+	if !regexp.MustCompile(`#1 .* 65536 bytes \(0\.06 MB\) copied, [0-9.]+ s, [0-9.]+ MB/s`).MatchString(stderr) {
+		t.Errorf("no final bytes, time and rate in:\n%s", stderr)
+	}
+}
+
+func BenchmarkFast(b *testing.B) {
+	dir := b.TempDir()
+	in := filepath.Join(dir, "in")
+	if err := os.WriteFile(in, make([]byte, 32<<20), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, fast := range []string{"-fast=true", "-fast=false"} {
+		b.Run(fast, func(b *testing.B) {
+			b.SetBytes(32 << 20)
+			for i := 0; i < b.N; i++ {
+				if err := runInProcess(b, fast, "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"), "-bs1", "64K"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceInfoSummary(t *testing.T) {
+	old := deviceInfoOf
+	deviceInfoOf = func(name, std string) deviceInfo {
+		if name == "" {
+			return deviceInfo{Path: std}
+		}
+		return deviceInfo{
+			Path:   name,
+			ByID:   []string{"ata-DISK_SN123"},
+			ByUUID: []string{"0123-4567"},
+			Model:  "DISK",
+			Serial: "SN123",
+		}
+	}
+	t.Cleanup(func() { deviceInfoOf = old })
+
+	tr := newTestTransfer("/dev/sdx", "")
+	var buf bytes.Buffer
+	printSummary(&buf, []*Transfer{tr}, 0, true)
+	for _, want := range []string{
+		"in:  /dev/sdx (by-id: ata-DISK_SN123; by-uuid: 0123-4567; model: DISK; serial: SN123)",
+		"out: stdout\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("summary lacks %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	printSummary(&buf, []*Transfer{tr}, 0, false)
+	if strings.Contains(buf.String(), "by-id") {
+		t.Errorf("device info shown without -deviceInfo:\n%s", buf.String())
+	}
+
+	// without a device, the path is still recorded, made absolute
+	if d := lookupDeviceInfo("dd-multi.go", "stdin"); !filepath.IsAbs(d.Path) || filepath.Base(d.Path) != "dd-multi.go" {
+		t.Errorf("file recorded as %q, want its absolute path", d.Path)
+	}
+}
+
+func TestFollowMirrorsGrowth(t *testing.T) {
+	dir := t.TempDir()
+	first := bytes.Repeat([]byte("a"), 1000)
+	in := writeTestFile(t, dir, "in", first)
+	out := filepath.Join(dir, "out")
+	stop := make(chan struct{})
+	tr := newTestTransfer(in, out)
+	tr.followStop = stop
+	done := make(chan error, 1)
+	go func() { done <- doOneTransfer(tr, nil) }()
+	waitTransferred(t, tr, 1000)
+
+	more := bytes.Repeat([]byte("b"), 700)
+	f, err := os.OpenFile(in, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	waitTransferred(t, tr, 1700)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(first, more...); !bytes.Equal(got, want) {
+		t.Errorf("mirrored %d bytes, want the %d written to the input", len(got), len(want))
+	}
+}
+
+func TestProgressHookMilestones(t *testing.T) {
+	tr := newTestTransfer("in", "out")
+	tr.Total = 1000
+	tr.Transferred = 120
+	calls := make(chan int, 100)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		watchMilestones([]*Transfer{tr}, 5, func(_ *Transfer, pct int) { calls <- pct }, done)
+		close(finished)
+	}()
+	for _, want := range []int{5, 10} {
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("hook called with %d%%, want %d%%", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook not called for 12%")
+		}
+	}
+	tr.Mutex.Lock()
+	tr.Transferred = 149 // still short of 15%
+	tr.Mutex.Unlock()
+	time.Sleep(600 * time.Millisecond)
+	tr.Mutex.Lock()
+	tr.Transferred = 1000
+	tr.Mutex.Unlock()
+	close(done)
+	<-finished
+	close(calls)
+
+	want := 15
+	for got := range calls {
+		if got != want {
+			t.Fatalf("hook called with %d%%, want %d%%", got, want)
+		}
+		want += 5
+	}
+	if want != 105 {
+		t.Errorf("hook stopped before 100%%, at %d%%", want-5)
+	}
+}
+
+func TestProgressHookCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	script := writeTestFile(t, dir, "hook", []byte("#!/bin/sh\necho \"$@\" >> "+logPath+"\n"))
+	if err := os.Chmod(script, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tr := newTestTransfer("in", "out")
+	tr.Index = 3
+	commandHook(script)(tr, 25)
+	got, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "25 3\n" {
+		t.Errorf("hook run with %q, want the percentage and transfer number", got)
+	}
+
+	// a hook of only blanks has no command to run
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	err = runInProcess(t, "-progressHook", "  ", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"))
+	if err == nil || !strings.Contains(err.Error(), "must name a command") {
+		t.Errorf("blank -progressHook gave %v", err)
+	}
+}
+
+func TestTruncateOnlyRegularFiles(t *testing.T) {
+	var flags []int
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		flags = append(flags, flag)
+		return open(name, flag, perm)
+	})
+	dir := t.TempDir()
+	file := writeTestFile(t, dir, "out", make([]byte, 100))
+	for _, name := range []string{file, os.DevNull} {
+		w, err := outFile(nil, name, 10, os.O_CREATE|os.O_TRUNC, false)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		w.(*os.File).Close()
+	}
+	for _, flag := range flags {
+		if flag&os.O_TRUNC != 0 {
+			t.Errorf("opened with O_TRUNC (%#x); devices can't take it", flag)
+		}
+	}
+	if n := fileSize(t, file); n != 10 {
+		t.Errorf("regular file is %d bytes after truncating at 10", n)
+	}
+
+	// -overwriteMode=inplace leaves the rest of the file alone
+	in := writeTestFile(t, dir, "in", []byte("0123456789"))
+	file100 := writeTestFile(t, dir, "big", make([]byte, 100))
+	if err := runInProcess(t, "-overwriteMode=inplace", "-numTransfers", "1", "-if1", in, "-of1", file100); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, file100); n != 100 {
+		t.Errorf("-overwriteMode=inplace left %d bytes of 100", n)
+	}
+	if err := runInProcess(t, "-numTransfers", "1", "-if1", in, "-of1", file100); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, file100); n != 10 {
+		t.Errorf("-overwriteMode=truncate left %d bytes, want 10", n)
+	}
+}
+
+func TestCompletedLine(t *testing.T) {
+	errs := []error{
+		nil,
+		&transferError{classRead, errors.New("bad sector")},
+		nil,
+		&transferError{classWrite, fmt.Errorf("writing: %w", syscall.ENOSPC)},
+		&transferError{classRead, errors.New("bad sector")},
+	}
+	var transfers []*Transfer
+	for i, err := range errs {
+		tr := newTestTransfer("in", "out")
+		tr.Index = i + 1
+		tr.Err = err
+		transfers = append(transfers, tr)
+	}
+	var buf bytes.Buffer
+	printSummary(&buf, transfers, 2, false)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := "Completed: 2 ok, 3 failed (2 read errors, 1 out-of-space), 2 skipped"
+	if got := lines[len(lines)-1]; got != want {
+		t.Errorf("last line is %q, want %q", got, want)
+	}
+	if !strings.Contains(buf.String(), "#2 in --> out: 0 bytes (0.00 MB) copied, 0.000 s, 0.00 MB/s [failed: read error]") {
+		t.Errorf("failed transfer's line lacks its class:\n%s", buf.String())
+	}
+}
+
+// fixedBlockWriter is like a tape drive: it rejects writes that aren't
+// exactly bs bytes
+type fixedBlockWriter struct {
+	bs  int
+	buf bytes.Buffer
+}
+
+func (f *fixedBlockWriter) Write(p []byte) (int, error) {
+	if len(p) != f.bs {
+		return 0, syscall.EIO
+	}
+	return f.buf.Write(p)
+}
+
+func TestPadWrites(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	if _, err := (&fixedBlockWriter{bs: 512}).Write(data[:300]); err == nil {
+		t.Fatal("fixed-block writer took a short write")
+	}
+
+	dev := &fixedBlockWriter{bs: 512}
+	pw := newPadWriter(dev, 512)
+	for b := data; len(b) > 0; {
+		n := min(300, len(b))
+		if _, err := pw.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, data...), make([]byte, 24)...)
+	if !bytes.Equal(dev.buf.Bytes(), want) {
+		t.Errorf("wrote %d bytes, want the data zero-padded to 1024", dev.buf.Len())
+	}
+}
+
+func TestOutputEncodingBase64(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("hello, world!"))
+	for _, tc := range []struct {
+		wrap int
+		want string
+	}{
+		{8, "aGVsbG8s\nIHdvcmxk\nIQ==\n"},
+		{0, "aGVsbG8sIHdvcmxkIQ==\n"},
+	} {
+		out := filepath.Join(dir, "out")
+		tr := newTestTransfer(in, out)
+		tr.OutputEncoding = "base64"
+		tr.OutputWrap = tc.wrap
+		if err := doOneTransfer(tr, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("wrap %d: encoded %q, want %q", tc.wrap, got, tc.want)
+		}
+
+		// and -inputEncoding takes it back
+		back := filepath.Join(dir, "back")
+		tr = newTestTransfer(out, back)
+		tr.InputEncoding = "base64"
+		if err := doOneTransfer(tr, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(back); string(got) != "hello, world!" {
+			t.Errorf("wrap %d: round trip gave %q", tc.wrap, got)
+		}
+	}
+}
+
+func TestVerifyTimedSeparately(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", bytes.Repeat([]byte("0123456789abcdef"), 1<<14))
+	code, _, stderr := runMain(t, "-verify", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"))
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	write := regexp.MustCompile(`#1 .*: 262144 bytes \(0\.25 MB\) copied, ([0-9.]+) s, ([0-9.]+) MB/s`).FindStringSubmatch(stderr)
+	verify := regexp.MustCompile(`verify: 262144 bytes read back, ([0-9.]+) s, ([0-9.]+) MB/s, SHA-256 matches`).FindStringSubmatch(stderr)
+	if write == nil || verify == nil {
+		t.Fatalf("summary lacks the write or verify phase:\n%s", stderr)
+	}
+	for _, phase := range [][]string{write, verify} {
+		secs, _ := strconv.ParseFloat(phase[1], 64)
+		rate, _ := strconv.ParseFloat(phase[2], 64)
+		if secs > 10 || rate <= 0 {
+			t.Errorf("implausible %q", phase[0])
+		}
+	}
+
+	// the phases follow each other
+	tr := newTestTransfer(in, filepath.Join(dir, "out2"))
+	tr.Verify = true
+	tr.VerifyBs = 4096
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	copied := time.Now()
+	if err := verifyTransfer(tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.VerifyStart.Before(copied) || tr.VerifyEnd.Before(tr.VerifyStart) || tr.Verified != 262144 {
+		t.Errorf("verify timed %v to %v for %d bytes", tr.VerifyStart, tr.VerifyEnd, tr.Verified)
+	}
+}
+
+func TestStdinStdoutPassthrough(t *testing.T) {
+	data := bytes.Repeat([]byte("passthrough\n"), 20000)
+	// -singleLine would draw on stdout, and the bwlimit gives it time to
+	code, stdout, stderr := runMainStdin(t, bytes.NewReader(data), "-numTransfers", "1", "-bs1", "4K", "-singleLine", "-bwlimit1", "400K")
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	if stdout != string(data) {
+		t.Errorf("stdout has %d bytes, want only the %d piped in", len(stdout), len(data))
+	}
+}
+
+func TestCheckAlignment(t *testing.T) {
+	old := alignSectorSize
+	alignSectorSize = func(name string) int64 {
+		if name == "/dev/disk4k" {
+			return 4096
+		}
+		return 0
+	}
+	t.Cleanup(func() { alignSectorSize = old })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tr := newTestTransfer("/dev/disk4k", "/dev/disk4k")
+	tr.SkipOff, tr.SeekOff = 10000, 8192
+	if err := checkAlignment(tr, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Warning: transfer #1: skip offset 10000 is not a multiple of /dev/disk4k's 4096-byte physical sectors") ||
+		strings.Contains(logged.String(), "seek offset") {
+		t.Errorf("wrong warnings for skip 10000, seek 8192:\n%s", logged.String())
+	}
+	if tr.SkipOff != 10000 {
+		t.Errorf("offset changed to %d without -alignRound", tr.SkipOff)
+	}
+
+	if err := checkAlignment(tr, true, false); err == nil {
+		t.Error("misaligned offset accepted with -strict")
+	}
+
+	logged.Reset()
+	if err := checkAlignment(tr, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if tr.SkipOff != 8192 || !strings.Contains(logged.String(), "rounded down to 8192 (-1808 bytes)") {
+		t.Errorf("-alignRound gave offset %d, logged:\n%s", tr.SkipOff, logged.String())
+	}
+
+	// files have no sectors to be misaligned with
+	tr = newTestTransfer("file", "file")
+	tr.SkipOff = 10000
+	if err := checkAlignment(tr, true, false); err != nil {
+		t.Errorf("file offset rejected: %v", err)
+	}
+}
+
+func TestHTTPResume(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "img", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	out := writeTestFile(t, dir, "out", data[:30000])
+	tr := newTestTransfer(srv.URL, out)
+	tr.Resume = true
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("resumed output is %d bytes and differs from the download", len(got))
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=30000-" {
+		t.Errorf("requested ranges %q, want bytes=30000-", ranges)
+	}
+	if tr.Resumed != 30000 || tr.Transferred != 70000 {
+		t.Errorf("resumed after %d bytes and copied %d, want 30000 and 70000", tr.Resumed, tr.Transferred)
+	}
+
+	// a server that ignores Range would restart from byte 0
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer plain.Close()
+	out = writeTestFile(t, dir, "out2", data[:30000])
+	tr = newTestTransfer(plain.URL, out)
+	tr.Resume = true
+	if err := doOneTransfer(tr, nil); err == nil || !strings.Contains(err.Error(), "doesn't support range requests") {
+		t.Errorf("resuming from a server without ranges returned %v", err)
+	}
+}
+
+func TestAggregateLineWhenNotTerminal(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 256<<10))
+	// stdout is a pipe here, not a terminal
+	code, stdout, stderr := runMain(t, "-numTransfers", "2",
+		"-if1", in, "-of1", filepath.Join(dir, "out1"), "-bwlimit1", "1M",
+		"-if2", in, "-of2", filepath.Join(dir, "out2"), "-bwlimit2", "1M")
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("per-transfer progress drawn on stdout: %q", stdout)
+	}
+	progress, _, _ := strings.Cut(stderr, "#1 ")
+	if strings.Count(progress, "\r") < 2 || strings.Count(progress, "\n") != 1 || !strings.HasSuffix(progress, "\n") {
+		t.Errorf("progress isn't one line rewritten with \\r: %q", progress)
+	}
+	if strings.Contains(progress, "\033[") {
+		t.Errorf("progress uses cursor movement: %q", progress)
+	}
+	if !regexp.MustCompile(`\r2/2 done, 0\.50 of 0\.50 MB \(100\.0%\)`).MatchString(progress) {
+		t.Errorf("last aggregate line isn't for both transfers done: %q", progress)
+	}
+}
+
+func TestVerifyBs(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	in := writeTestFile(t, dir, "in", data)
+	for _, vbs := range []int64{100, 64 << 10, 1 << 20} {
+		out := filepath.Join(dir, "out")
+		tr := newTestTransfer(in, out)
+		tr.Verify = true
+		tr.VerifyBs = vbs
+		if err := doOneTransfer(tr, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyTransfer(tr); err != nil || tr.Verified != int64(len(data)) {
+			t.Errorf("verifyBs %d: verified %d bytes, %v", vbs, tr.Verified, err)
+		}
+
+		// a changed byte must still be caught whatever the read size
+		f, err := os.OpenFile(out, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff}, 150001)
+		f.Close()
+		tr.Verified = 0
+		if err := verifyTransfer(tr); classifyError(err) != classVerify {
+			t.Errorf("verifyBs %d: corrupted output verified: %v", vbs, err)
+		}
+	}
+}
+
+func TestVerifyProgressPhase(t *testing.T) {
+	tr := &Transfer{Index: 1, Name: "img", InputFilename: "in", OutputFilename: "out",
+		StartTime: time.Now(), Transferred: 500, Total: 1000}
+	moved, done := make(chan struct{}), make(chan struct{})
+	mp := &MultiProgress{Transfers: []*Transfer{tr}, SingleLine: true, TermCols: 100, Moved: moved, Done: done}
+	step := func(change func()) {
+		// the second send waits for the redraw after the first
+		moved <- struct{}{}
+		moved <- struct{}{}
+		tr.Mutex.Lock()
+		change()
+		tr.Mutex.Unlock()
+	}
+	out := captureStdout(t, func() {
+		finished := make(chan struct{})
+		go func() {
+			mp.startSingleLine()
+			close(finished)
+		}()
+		step(func() {
+			tr.Transferred = 1000
+			tr.EndTime = time.Now()
+			tr.VerifyStart = time.Now()
+			tr.written = &checksumWriter{n: 1000}
+			tr.Verified = 250
+		})
+		step(func() {
+			tr.Verified = 1000
+			tr.VerifyEnd = time.Now()
+			tr.Finished = true
+		})
+		close(done)
+		<-finished
+	})
+	copying, verifying, ok := strings.Cut(out, "img: in --> out (verifying)")
+	if !ok {
+		t.Fatalf("no verifying banner in %q", out)
+	}
+	// progress bars filled for 50%, then 25% and 100% of the verify pass
+	bar := func(filled int) string {
+		return LightGreen + strings.Repeat("-", filled) + DarkGreen + strings.Repeat("-", 50-filled)
+	}
+	if !strings.Contains(copying, bar(25)) {
+		t.Errorf("copy phase progress missing before verify: %q", copying)
+	}
+	if !strings.Contains(verifying, bar(12)) || !strings.Contains(verifying, bar(50)) {
+		t.Errorf("verify phase progress not drawn after its banner: %q", verifying)
+	}
+}
+
+func TestTraceFile(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 64<<10))
+	traceOut := filepath.Join(dir, "trace.out")
+	code, _, stderr := runMain(t, "-traceFile", traceOut, "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"))
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	data, err := os.ReadFile(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// runtime/trace files start with "go 1.xx trace"
+	if !bytes.HasPrefix(data, []byte("go 1.")) || len(data) < 100 {
+		t.Errorf("trace file has %d bytes starting %q", len(data), data[:min(len(data), 16)])
+	}
+}
+
+func TestAtomicOutput(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer("", out)
+	tr.Atomic = true
+	pw, done := startPipedTransfer(tr)
+	pw.Write(make([]byte, 4096))
+	waitTransferred(t, tr, 4096)
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output visible mid-transfer: %v", err)
+	}
+	if _, err := os.Stat(out + ".tmp"); err != nil {
+		t.Errorf("no temporary output: %v", err)
+	}
+	pw.Close()
+	if err := finishAtomic(tr, <-done); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, out); n != 4096 {
+		t.Errorf("output is %d bytes after success, want 4096", n)
+	}
+	if _, err := os.Stat(out + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary output left after success: %v", err)
+	}
+
+	// a failed transfer leaves the original alone
+	for _, keep := range []bool{false, true} {
+		writeTestFile(t, dir, "out", []byte("original"))
+		tr = newTestTransfer("", out)
+		tr.Atomic = true
+		tr.KeepPartial = keep
+		pw, done = startPipedTransfer(tr)
+		pw.Write(make([]byte, 4096))
+		pw.CloseWithError(errors.New("input went away"))
+		if err := finishAtomic(tr, <-done); err == nil {
+			t.Fatal("failed transfer reported success")
+		}
+		if got, _ := os.ReadFile(out); string(got) != "original" {
+			t.Errorf("original output replaced by a failed transfer: %q", got)
+		}
+		if _, err := os.Stat(out + ".tmp"); os.IsNotExist(err) == keep {
+			t.Errorf("-keepPartial=%v: temporary output kept: %v", keep, !os.IsNotExist(err))
+		}
+	}
+}
+
+func TestExpectDigest(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("hello\n"))
+	const sum = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	code, _, stderr := runMain(t, "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out"),
+		"-hash1", "sha256", "-expect1", strings.ToUpper(sum))
+	if code != 0 {
+		t.Errorf("matching digest failed with status %d\n%s", code, stderr)
+	}
+	if !strings.Contains(stderr, "sha256: "+sum) {
+		t.Errorf("digest not reported:\n%s", stderr)
+	}
+
+	wrong := strings.Repeat("0", 64)
+	tr := newTestTransfer(in, filepath.Join(dir, "out"))
+	tr.HashAlg, tr.Expect = "sha256", wrong
+	err := doOneTransfer(tr, nil)
+	if classifyError(err) != classChecksum {
+		t.Fatalf("mismatched digest returned %v", err)
+	}
+	if want := "sha256 mismatch: got " + sum + ", expected " + wrong; err.Error() != want {
+		t.Errorf("error is %q, want %q", err, want)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	var mu sync.Mutex
+	var opened []time.Time
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		if filepath.Base(name) == "in" {
+			mu.Lock()
+			opened = append(opened, time.Now())
+			mu.Unlock()
+		}
+		return open(name, flag, perm)
+	})
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 200<<10))
+	args := []string{"-maxOpenFiles", "3", "-numTransfers", "3"}
+	for i := 1; i <= 3; i++ {
+		n := strconv.Itoa(i)
+		args = append(args, "-if"+n, in, "-of"+n, filepath.Join(dir, "out"+n), "-bwlimit"+n, "1M")
+	}
+	// 3 descriptors are enough for one transfer at a time, each taking
+	// about 0.2 s
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if len(opened) != 3 {
+		t.Fatalf("inputs opened %d times, want 3", len(opened))
+	}
+	for i := 1; i < len(opened); i++ {
+		if gap := opened[i].Sub(opened[i-1]); gap < 150*time.Millisecond {
+			t.Errorf("transfer %d started %v after the one before; they overlapped", i+1, gap)
+		}
+	}
+
+	if err := runInProcess(t, "-maxOpenFiles", "1", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out")); err == nil {
+		t.Error("-maxOpenFiles below one transfer's needs accepted")
+	}
+}
+
+func TestPartitionGPT(t *testing.T) {
+	img := make([]byte, 64*512)
+	img[446+4] = 0xee // protective MBR
+	img[510], img[511] = 0x55, 0xaa
+	hdr := img[512:]
+	copy(hdr, "EFI PART")
+	binary.LittleEndian.PutUint64(hdr[72:], 2)   // entries at LBA 2
+	binary.LittleEndian.PutUint32(hdr[80:], 128) // entry count
+	binary.LittleEndian.PutUint32(hdr[84:], 128) // entry size
+	for i, r := range [][2]uint64{{34, 39}, {40, 47}} {
+		e := img[1024+128*i:]
+		e[0] = 0xaf // any non-zero type GUID
+		binary.LittleEndian.PutUint64(e[32:], r[0])
+		binary.LittleEndian.PutUint64(e[40:], r[1])
+	}
+	part2 := img[40*512 : 48*512]
+	for i := range part2 {
+		part2[i] = byte(i%255 + 1)
+	}
+
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "disk.img", img)
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer(in, out)
+	tr.Partition = 2
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, part2) {
+		t.Errorf("extracted %d bytes, want the %d of partition 2", len(got), len(part2))
+	}
+
+	if _, _, err := partitionRange(in, 3); err == nil || !strings.Contains(err.Error(), "partition 3 doesn't exist") {
+		t.Errorf("empty partition 3 gave %v", err)
+	}
+	plain := writeTestFile(t, dir, "plain", make([]byte, 4096))
+	if _, _, err := partitionRange(plain, 1); err == nil || !strings.Contains(err.Error(), "no recognizable partition table") {
+		t.Errorf("image without a table gave %v", err)
+	}
+}
+
+func TestLabelFormat(t *testing.T) {
+	label, err := parseLabelFormat("Cloning {{.Input}} → {{.Output}} — {{printf \"%.0f\" .Percent}}% — {{printf \"%.0f\" .Rate}} MB/s — {{.ETA}} ({{.Bytes}}/{{.Total}})")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stopped by an error at 42% after 2 s
+	start := time.Now()
+	tr := &Transfer{Index: 1, InputFilename: "sda", OutputFilename: "sdb",
+		Transferred: 420 << 20, Total: 1000 << 20, StartTime: start, EndTime: start.Add(2 * time.Second),
+		Finished: true, Err: errors.New("failed")}
+	mp := &MultiProgress{Transfers: []*Transfer{tr}, Label: label}
+	want := "Cloning sda → sdb — 42% — 210 MB/s — 00:00:02 (440401920/1048576000)"
+	if got := mp.bannerText(tr); got != want {
+		t.Errorf("label is %q, want %q", got, want)
+	}
+
+	if _, err := parseLabelFormat("{{.Speed}}"); err == nil {
+		t.Error("unknown field accepted")
+	}
+	if _, err := parseLabelFormat("{{.Rate"); err == nil {
+		t.Error("unterminated action accepted")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []webhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook sent as %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		payloads = append(payloads, p)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 1000))
+	args := []string{"-numTransfers", "2",
+		"-if1", in, "-of1", filepath.Join(dir, "out"),
+		"-if2", filepath.Join(dir, "missing"), "-of2", filepath.Join(dir, "out2")}
+	want, _, _ := runMain(t, args...)
+	code, _, stderr := runMain(t, append([]string{"-webhook", srv.URL, "-webhookEach"}, args...)...)
+	if code != want {
+		t.Errorf("exit status %d with -webhook, %d without\n%s", code, want, stderr)
+	}
+	if len(payloads) != 3 {
+		t.Fatalf("%d webhook calls, want one per transfer and one at the end", len(payloads))
+	}
+	for _, p := range payloads[:2] {
+		if p.Event != "transfer" || len(p.Transfers) != 1 {
+			t.Errorf("per-transfer payload %+v", p)
+		}
+	}
+	end := payloads[2]
+	if end.Event != "complete" || end.OK != 1 || end.Failed != 1 || end.Bytes != 1000 || len(end.Transfers) != 2 {
+		t.Fatalf("complete payload %+v", end)
+	}
+	if tr := end.Transfers[1]; tr.Index != 2 || tr.Status != "failed" || tr.Class != "input error" || tr.Error == "" {
+		t.Errorf("failed transfer reported as %+v", tr)
+	}
+
+	// a webhook that keeps failing is retried and logged, nothing more
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	ok := []string{"-webhook", bad.URL, "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out")}
+	code, _, stderr = runMain(t, ok...)
+	if code != 0 {
+		t.Errorf("failing webhook changed the exit status to %d", code)
+	}
+	if !strings.Contains(stderr, "webhook complete event failed after 3 attempts: server returned 503") {
+		t.Errorf("webhook failure not logged:\n%s", stderr)
+	}
+}
+
+func TestAutoBlockSize(t *testing.T) {
+	old := optimalIOSizeOf
+	optimalIOSizeOf = func(name string) int64 {
+		switch filepath.Base(name) {
+		case "raid":
+			return 1 << 20
+		case "fs":
+			return 4096
+		}
+		return 0
+	}
+	t.Cleanup(func() { optimalIOSizeOf = old })
+
+	for _, tc := range []struct {
+		out, in string
+		want    int64
+		from    string
+	}{
+		{"raid", "fs", 1 << 20, "optimal I/O size of raid"},
+		{"other", "raid", 1 << 20, "optimal I/O size of raid"},
+		{"fs", "", autoBlockSizeMin, "fs reports 4096, raised to the minimum"},
+		{"other", "", autoBlockSizeMin, "no optimal I/O size reported, using the minimum"},
+	} {
+		if bs, from := autoBlockSize(tc.out, tc.in); bs != tc.want || from != tc.from {
+			t.Errorf("output %s, input %s: bs %d (%s), want %d (%s)", tc.out, tc.in, bs, from, tc.want, tc.from)
+		}
+	}
+}
+
+func TestSampleVerify(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000*512)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer(in, out)
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	sample := func() *Transfer {
+		s := newTestTransfer(in, out)
+		s.writePath = out
+		s.Transferred = int64(len(data))
+		s.SampleFraction, s.SampleSeed = 0.05, 42
+		return s
+	}
+
+	s := sample()
+	if err := sampleVerify(s); err != nil {
+		t.Fatalf("identical files: %v", err)
+	}
+	if s.Sampled < 20 || s.Sampled > 100 {
+		t.Errorf("sampled %d of 1000 blocks for 5%%", s.Sampled)
+	}
+
+	// with every block changed, the mismatches are the sampled blocks
+	bad := append([]byte{}, data...)
+	for i := 0; i < len(bad); i += 512 {
+		bad[i] ^= 0xff
+	}
+	writeTestFile(t, dir, "out", bad)
+	s = sample()
+	sampleVerify(s)
+	sampled := s.Mismatches
+	if int64(len(sampled)) != s.Sampled {
+		t.Fatalf("%d of %d sampled blocks differ, want all", len(sampled), s.Sampled)
+	}
+
+	// the same seed samples the same blocks, so one changed block among
+	// them is found, at its offset
+	bad = append([]byte{}, data...)
+	bad[sampled[1]+100] ^= 0xff
+	writeTestFile(t, dir, "out", bad)
+	s = sample()
+	err := sampleVerify(s)
+	if classifyError(err) != classVerify || len(s.Mismatches) != 1 || s.Mismatches[0] != sampled[1] {
+		t.Fatalf("corrupted block at %d: mismatches %v, %v", sampled[1], s.Mismatches, err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("found 1 of %d sampled blocks differing, at output offsets %d", s.Sampled, sampled[1])) {
+		t.Errorf("error is %q", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	tr := newTestTransfer("", filepath.Join(dir, "out"))
+	tr.recording = &transferTrace{Index: 1, Output: tr.OutputFilename, Bs: tr.Bs}
+	pw, done := startPipedTransfer(tr)
+	// short reads of every size, then a read error
+	var sent int64
+	for _, n := range []int{100, 512, 7, 1000, 3} {
+		pw.Write(make([]byte, n))
+		sent += int64(n)
+	}
+	waitTransferred(t, tr, sent)
+	pw.CloseWithError(syscall.EIO)
+	recErr := <-done
+	if !errors.Is(recErr, syscall.EIO) {
+		t.Fatalf("recorded transfer returned %v, want EIO", recErr)
+	}
+
+	path := filepath.Join(dir, "trace.json")
+	if err := writeRecording(path, []*Transfer{tr}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var traces []*transferTrace
+	if err := json.Unmarshal(data, &traces); err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	for _, e := range traces[0].Events {
+		if e.Op == "read" && e.N > 0 && e.N < e.Len {
+			reads++
+		}
+	}
+	if reads < 3 {
+		t.Fatalf("trace has %d short reads: %+v", reads, traces[0].Events)
+	}
+
+	rp := &replayer{events: traces[0].Events}
+	replayed := &Transfer{}
+	err = dd(replayReader{rp}, replayWriter{rp}, traces[0].Bs, replayed)
+	if replayed.Transferred != tr.Transferred || !errors.Is(err, syscall.EIO) || rp.pos != len(rp.events) {
+		t.Errorf("replay wrote %d bytes with %v after %d of %d events; recorded %d bytes with %v",
+			replayed.Transferred, err, rp.pos, len(rp.events), tr.Transferred, recErr)
+	}
+	// and -replay reports the same byte count
+	_, _, stderr := runMain(t, "-replay", path)
+	if !strings.Contains(stderr, fmt.Sprintf(": %d bytes", tr.Transferred)) || !strings.Contains(stderr, "input/output error") {
+		t.Errorf("-replay summary doesn't match the recording:\n%s", stderr)
+	}
+}
+
+func TestFinalFrameFull(t *testing.T) {
+	start := time.Now()
+	var transfers []*Transfer
+	for i := 1; i <= 2; i++ {
+		transfers = append(transfers, &Transfer{Index: i, InputFilename: "in", OutputFilename: "out",
+			StartTime: start, Transferred: 990, Total: 1000})
+	}
+	done := make(chan struct{})
+	mp := &MultiProgress{Transfers: transfers, TermCols: 100, Done: done}
+	out := captureStdout(t, func() {
+		finished := make(chan struct{})
+		go func() {
+			mp.startProgress()
+			close(finished)
+		}()
+		// the last bytes land well before the next tick
+		for _, tr := range transfers {
+			tr.Mutex.Lock()
+			tr.Transferred = 1000
+			tr.EndTime = time.Now()
+			tr.Finished = true
+			tr.Mutex.Unlock()
+		}
+		close(done)
+		<-finished
+	})
+	full := LightGreen + strings.Repeat("-", 50) + DarkGreen + Reset
+	frames := strings.Split(out, "\033[4A")
+	if len(frames) < 2 {
+		t.Fatalf("no final frame drawn: %q", out)
+	}
+	if last := frames[len(frames)-1]; strings.Count(last, full) != 2 {
+		t.Errorf("final frame isn't at 100%% for both transfers: %q", last)
+	}
+}
+
+func TestStatsCsv(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 300<<10))
+	stats := filepath.Join(dir, "run.csv")
+	code, _, stderr := runMain(t, "-statsCsv", stats, "-statsInterval", "50ms", "-numTransfers", "2",
+		"-if1", in, "-of1", filepath.Join(dir, "out1"), "-bwlimit1", "1M",
+		"-if2", in, "-of2", filepath.Join(dir, "out2"), "-bwlimit2", "2M")
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	f, err := os.Open(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rows[0], ",") != "time,transfer,bytes,rate_mbps,percent" {
+		t.Fatalf("header is %q", rows[0])
+	}
+	last := map[string]int64{}
+	count := map[string]int{}
+	var lastTime time.Time
+	for _, row := range rows[1:] {
+		ts, err := time.Parse(time.RFC3339Nano, row[0])
+		if err != nil || ts.Before(lastTime) {
+			t.Fatalf("bad or out-of-order time in %q", row)
+		}
+		lastTime = ts
+		n, err := strconv.ParseInt(row[2], 10, 64)
+		if err != nil || n < last[row[1]] {
+			t.Fatalf("bytes went from %d to %q for transfer %s", last[row[1]], row[2], row[1])
+		}
+		last[row[1]] = n
+		count[row[1]]++
+	}
+	// transfer 1 takes about 0.3 s
+	if count["1"] < 4 || count["1"] != count["2"] {
+		t.Errorf("%v rows per transfer", count)
+	}
+	final := rows[len(rows)-2:]
+	for _, row := range final {
+		if row[2] != "307200" || row[4] != "100.0" {
+			t.Errorf("last row %q isn't at the end of the transfer", row)
+		}
+	}
+}
+
+func TestWarmupExcluded(t *testing.T) {
+	// a fast first 2 s from cache, then 10 MB/s
+	start := time.Now()
+	tr := &Transfer{Index: 1, InputFilename: "in", OutputFilename: "out", Warmup: 2 * time.Second,
+		StartTime: start, WarmupEnd: start.Add(2 * time.Second), WarmupBytes: 100 << 20,
+		EndTime: start.Add(12 * time.Second), Transferred: 200 << 20, Finished: true}
+	var b bytes.Buffer
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	for _, want := range []string{
+		"copied, 12.000 s, 16.67 MB/s",
+		"after 2s warmup: 104857600 bytes, 10.000 s, 10.00 MB/s",
+		"total after warmup: 104857600 bytes (100.00 MB), 10.000 s, 10.00 MB/s",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("summary lacks %q:\n%s", want, b.String())
+		}
+	}
+
+	tr.WarmupEnd = time.Time{}
+	b.Reset()
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	if !strings.Contains(b.String(), "finished within the warmup") || strings.Contains(b.String(), "total after warmup") {
+		t.Errorf("transfer shorter than the warmup:\n%s", b.String())
+	}
+}
+
+// shortWriter writes at most max bytes per call, without an error;
+// after stuck calls it stops writing anything
+type shortWriter struct {
+	buf   bytes.Buffer
+	max   int
+	calls int
+	stuck int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	s.calls++
+	if s.stuck > 0 && s.calls > s.stuck {
+		return 0, nil
+	}
+	return s.buf.Write(p[:min(len(p), s.max)])
+}
+
+func TestDdShortWrites(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	w := &shortWriter{max: 300}
+	got := &Transfer{}
+	if err := dd(bytes.NewReader(data), w, 4096, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Transferred != int64(len(data)) || !bytes.Equal(w.buf.Bytes(), data) {
+		t.Errorf("counted %d bytes and wrote %d, want all %d", got.Transferred, w.buf.Len(), len(data))
+	}
+
+	// a writer that stops making progress is an error, not a hang, and
+	// the count says what really got written
+	w = &shortWriter{max: 300, stuck: 5}
+	got = &Transfer{}
+	err := dd(bytes.NewReader(data), w, 4096, got)
+	if !errors.Is(err, io.ErrShortWrite) || classifyError(err) != classWrite {
+		t.Errorf("stuck writer gave %v", err)
+	}
+	if got.Transferred != 1500 || w.buf.Len() != 1500 {
+		t.Errorf("counted %d bytes with %d written, want 1500", got.Transferred, w.buf.Len())
+	}
+}
+
+func TestNullIO(t *testing.T) {
+	var opened []string
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		opened = append(opened, name)
+		return open(name, flag, perm)
+	})
+	if err := runInProcess(t, "-nullio", "-numTransfers", "1", "-bs1", "64K", "-count1", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if len(opened) > 0 {
+		t.Errorf("-nullio opened %q", opened)
+	}
+
+	code, _, stderr := runMain(t, "-nullio", "-numTransfers", "2", "-bs1", "64K", "-count1", "100", "-bs2", "4K", "-size2", "1000000")
+	if code != 0 {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	for _, want := range []string{
+		"#1 (zeros) --> (discard): 6553600 bytes",
+		"#2 (zeros) --> (discard): 1000000 bytes",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("summary lacks %q:\n%s", want, stderr)
+		}
+	}
+	if code, _, _ := runMain(t, "-nullio", "-numTransfers", "1"); code == 0 {
+		t.Error("-nullio without count or size succeeded")
+	}
+}
+
+func BenchmarkNullIO(b *testing.B) {
+	for _, bs := range []string{"4K", "64K", "1M"} {
+		b.Run(bs, func(b *testing.B) {
+			b.SetBytes(256 << 20)
+			for i := 0; i < b.N; i++ {
+				if err := runInProcess(b, "-nullio", "-fast", "-numTransfers", "1", "-bs1", bs, "-size1", strconv.Itoa(256<<20)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeVerify(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	resume := func(prefix []byte, fail bool) (*Transfer, error) {
+		writeTestFile(t, dir, "out", prefix)
+		tr := newTestTransfer(in, out)
+		tr.Resume, tr.ResumeVerify, tr.ResumeFailOnMismatch = true, true, fail
+		return tr, doOneTransfer(tr, nil)
+	}
+	check := func(what string) {
+		t.Helper()
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+			t.Errorf("%s: output differs from the input", what)
+		}
+	}
+
+	// only whole blocks of a matching prefix are kept
+	tr, err := resume(data[:3000], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Resumed != 2560 || tr.Transferred != 10000-2560 {
+		t.Errorf("matching prefix: resumed after %d and copied %d, want 2560 and %d", tr.Resumed, tr.Transferred, 10000-2560)
+	}
+	check("matching prefix")
+
+	corrupt := append([]byte{}, data[:3000]...)
+	corrupt[100] ^= 0xff
+	tr, err = resume(corrupt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Resumed != 0 || tr.Transferred != 10000 {
+		t.Errorf("corrupt prefix: resumed after %d and copied %d, want a restart", tr.Resumed, tr.Transferred)
+	}
+	check("corrupt prefix")
+
+	_, err = resume(corrupt, true)
+	if classifyError(err) != classVerify || !strings.Contains(err.Error(), "doesn't match the input, not resuming") {
+		t.Errorf("corrupt prefix with -resumeMismatch=fail gave %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, corrupt) {
+		t.Error("failed resume changed the existing output")
+	}
+}
+
+func TestAbsPosLayout(t *testing.T) {
+	transfers := []*Transfer{
+		{Index: 1, InputFilename: "a", OutputFilename: "b"},
+		{Index: 2, InputFilename: "c", OutputFilename: "d"},
+	}
+	rows := func(out string) []string {
+		var rs []string
+		for _, m := range regexp.MustCompile(`\033\[(\d+);1H`).FindAllStringSubmatch(out, -1) {
+			rs = append(rs, m[1])
+		}
+		return rs
+	}
+	mp := &MultiProgress{Transfers: transfers, AbsPos: true, TermCols: 80, TermRows: 24}
+
+	// two banner+bar pairs in the bottom four rows, after scrolling
+	// room for them on the first draw
+	first := captureStdout(t, func() { mp.drawPage(0, 1, true) })
+	if !strings.HasPrefix(first, "\n\n\n\n\033[21;1H") {
+		t.Errorf("first draw doesn't make room and start at row 21: %q", first)
+	}
+	again := captureStdout(t, func() { mp.rewind(4); mp.drawPage(0, 1, false) })
+	for _, out := range []string{first, again} {
+		if got := strings.Join(rows(out), ","); got != "21,22,23,24" {
+			t.Errorf("lines drawn at rows %s, want 21,22,23,24", got)
+		}
+		if regexp.MustCompile(`\033\[\d*A`).MatchString(out) {
+			t.Errorf("relative cursor movement in %q", out)
+		}
+	}
+	if strings.Contains(again, "\n") {
+		t.Errorf("redraw scrolls: %q", again)
+	}
+	if out := captureStdout(t, mp.leaveAbsPos); out != "\033[24;1H\n" {
+		t.Errorf("leaving the display prints %q", out)
+	}
+
+	// fullscreen centers the block
+	mp = &MultiProgress{Transfers: transfers, AbsPos: true, Fullscreen: true, TermCols: 80, TermRows: 24}
+	out := captureStdout(t, func() { mp.drawPage(0, 1, false) })
+	if got := strings.Join(rows(out), ","); got != "11,12,13,14" {
+		t.Errorf("fullscreen lines drawn at rows %s, want 11,12,13,14", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	rng := rand.New(rand.NewSource(1))
+	for attempt := 1; attempt <= 8; attempt++ {
+		// 1, 2, 4, 8, then capped at 10 s
+		full := min(base<<(attempt-1), max)
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 200; i++ {
+			d := retryDelay(attempt, base, max, rng)
+			if d < full/2 || d > full {
+				t.Fatalf("attempt %d waited %v, want %v to %v", attempt, d, full/2, full)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 100 {
+			t.Errorf("attempt %d: only %d different waits in 200; no jitter", attempt, len(seen))
+		}
+	}
+
+	// the same seed gives the same waits
+	a, b := rand.New(rand.NewSource(42)), rand.New(rand.NewSource(42))
+	for attempt := 1; attempt <= 5; attempt++ {
+		if da, db := retryDelay(attempt, base, max, a), retryDelay(attempt, base, max, b); da != db {
+			t.Errorf("attempt %d: %v and %v with the same seed", attempt, da, db)
+		}
+	}
+}
+
+// deviceReader returns its chunks one per Read, then empty reads with no
+// error forever
+type deviceReader struct {
+	chunks []int
+}
+
+func (d *deviceReader) Read(p []byte) (int, error) {
+	if len(d.chunks) == 0 {
+		return 0, nil
+	}
+	n := min(d.chunks[0], len(p))
+	d.chunks = d.chunks[1:]
+	clear(p[:n])
+	return n, nil
+}
+
+func TestEOFOnShort(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		chunks []int
+		want   int64
+	}{
+		{[]int{512, 512}, 1024},     // ends with an empty read
+		{[]int{512, 100, 512}, 612}, // ends with a short one
+	} {
+		tr := newTestTransfer("", filepath.Join(dir, "out"))
+		tr.IflagStr = "eof-on-short"
+		done := make(chan error, 1)
+		go func() { done <- doOneTransfer(tr, &deviceReader{chunks: tc.chunks}) }()
+		select {
+		case err := <-done:
+			if err != nil || tr.Transferred != tc.want {
+				t.Errorf("reads %v: copied %d bytes with %v, want %d", tc.chunks, tr.Transferred, err, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reads %v: transfer didn't end", tc.chunks)
+		}
+	}
+
+	// without the flag endless empty reads are an error rather than a hang
+	tr := newTestTransfer("", filepath.Join(dir, "out"))
+	err := doOneTransfer(tr, &deviceReader{chunks: []int{512}})
+	if !errors.Is(err, io.ErrNoProgress) || !strings.Contains(err.Error(), "try iflag=eof-on-short") {
+		t.Errorf("empty reads without eof-on-short gave %v", err)
+	}
+}
+
+func TestPickDevice(t *testing.T) {
+	// a fake /sys/block
+	sys := t.TempDir()
+	for name, files := range map[string]map[string]string{
+		"sda":   {"size": "1953525168\n", "removable": "0\n", "device/model": "BIG DISK  \n"},
+		"sdb":   {"size": "30031872\n", "removable": "1\n", "device/model": "USB STICK\n"},
+		"loop0": {"size": "0\n"},
+	} {
+		for file, content := range files {
+			p := filepath.Join(sys, name, file)
+			os.MkdirAll(filepath.Dir(p), 0o755)
+			writeTestFile(t, filepath.Dir(p), filepath.Base(p), []byte(content))
+		}
+	}
+	devs := listBlockDevices(sys)
+	if len(devs) != 2 || devs[1] != (blockDevice{"/dev/sdb", 30031872 * 512, "USB STICK", true}) {
+		t.Fatalf("found %+v", devs)
+	}
+
+	tfs := []*transferFlags{{in: "a.img"}, {in: "b.img", out: "b.out"}, {in: "c.img"}}
+	var out bytes.Buffer
+	// a wrong answer is asked again
+	script := bufio.NewReader(strings.NewReader("x\n3\n2\n1\n"))
+	if err := pickOutputs(script, &out, devs, tfs, 3); err != nil {
+		t.Fatal(err)
+	}
+	if tfs[0].out != "/dev/sdb" || tfs[1].out != "b.out" || tfs[2].out != "/dev/sda" {
+		t.Errorf("outputs are %q, %q, %q", tfs[0].out, tfs[1].out, tfs[2].out)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("  1) %-14s %10.1f GB  BIG DISK\n", "/dev/sda", 1000.2),
+		fmt.Sprintf("  2) %-14s %10.1f GB  USB STICK (removable)\n", "/dev/sdb", 15.4),
+		"Output for transfer #1 (a.img) [1-2]: Output for transfer #1 (a.img) [1-2]: Output for transfer #1 (a.img) [1-2]: ",
+		"Output for transfer #3 (c.img) [1-2]: ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("prompt lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// running out of answers is an error, not a loop
+	tfs = []*transferFlags{{in: "a.img"}}
+	if err := pickOutputs(bufio.NewReader(strings.NewReader("9\n")), io.Discard, devs, tfs, 1); err == nil {
+		t.Error("no valid choice accepted")
+	}
+}
+
+func TestConvCharset(t *testing.T) {
+	// spot checks against GNU dd's tables
+	hello := []byte{0xc8, 0x85, 0x93, 0x93, 0x96, 0x6b, 0x40, 0xe6, 0x96, 0x99, 0x93, 0x84, 0x5a}
+	for _, tc := range []struct {
+		conv    string
+		in, out []byte
+	}{
+		{"ascii", hello, []byte("Hello, World!")},
+		{"ebcdic", []byte("Hello, World!"), hello},
+		{"ibm", []byte("Hello, World!"), hello},
+		{"ebcdic", []byte("[]|^~"), []byte{0xad, 0xbd, 0x4f, 0x9a, 0x5f}},
+		{"ibm", []byte("[]|^~"), []byte{0xad, 0xbd, 0x4f, 0x5f, 0xa1}},
+		{"ascii,ucase", hello, []byte("HELLO, WORLD!")},
+		{"ebcdic,lcase", []byte("Hello"), []byte{0x88, 0x85, 0x93, 0x93, 0x96}},
+	} {
+		dir := t.TempDir()
+		in := writeTestFile(t, dir, "in", tc.in)
+		out := filepath.Join(dir, "out")
+		if code, _, stderr := runMain(t, "-status", "none", "-numTransfers", "1", "-if1", in, "-of1", out, "-conv1", tc.conv); code != 0 {
+			t.Fatalf("conv=%s: exit %d: %s", tc.conv, code, stderr)
+		}
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, tc.out) {
+			t.Errorf("conv=%s: % x, want % x", tc.conv, got, tc.out)
+		}
+	}
+
+	// conv=ascii undoes conv=ebcdic
+	for i := 0; i < 256; i++ {
+		if b := ebcdicToASCII[asciiToEBCDIC[i]]; b != byte(i) {
+			t.Errorf("%#02x comes back as %#02x", i, b)
+		}
+	}
+
+	if _, err := parseConvOflag("ascii,ebcdic", "none"); err == nil {
+		t.Error("conv=ascii,ebcdic accepted")
+	}
+}
+
+func TestFailFastCancels(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 1<<20))
+	missing := filepath.Join(dir, "missing")
+	out := filepath.Join(dir, "out2")
+	args := func(onError string) []string {
+		// the second transfer takes two seconds to finish
+		return []string{"-status", "none", "-onError", onError, "-numTransfers", "2",
+			"-if1", missing, "-of1", filepath.Join(dir, "out1"),
+			"-if2", in, "-of2", out, "-bwlimit2", "512K"}
+	}
+
+	code, _, stderr := runMain(t, args("continue")...)
+	if code != 1 || fileSize(t, out) != 1<<20 {
+		t.Errorf("-onError=continue: exit %d, second transfer wrote %d bytes\n%s", code, fileSize(t, out), stderr)
+	}
+
+	os.Remove(out)
+	start := time.Now()
+	code, _, stderr = runMain(t, append(args("continue"), "-failFast")...)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("-failFast took %v to exit", elapsed)
+	}
+	if code != 1 || !strings.Contains(stderr, "transfer #1 failed") || !strings.Contains(stderr, "canceled") {
+		t.Errorf("-failFast: exit %d\n%s", code, stderr)
+	}
+	// canceled early enough, the second transfer never creates its output
+	if fi, err := os.Stat(out); err == nil && fi.Size() >= 1<<20 {
+		t.Errorf("-failFast: second transfer wrote all %d bytes", fi.Size())
+	}
+}
+
+func TestJobStdin(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("job "), 1024)
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	sum := sha256.Sum256(data[512:])
+	spec, _ := json.Marshal(job{If: in, Of: out, Bs: "512", Skip: 1, Hash: "sha256", Options: map[string]string{"verify": "true"}})
+
+	code, stdout, stderr := runMainStdin(t, bytes.NewReader(spec), "-jobStdin", "-status", "none")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	var res webhookTransfer
+	if err := json.Unmarshal([]byte(stdout), &res); err != nil {
+		t.Fatalf("result %q: %v", stdout, err)
+	}
+	if res.Status != "ok" || res.Input != in || res.Output != out || res.Bytes != int64(len(data)-512) || res.Digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("result %+v", res)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data[512:]) {
+		t.Error("output doesn't match the input after skip")
+	}
+
+	// a failed job still writes its result
+	spec, _ = json.Marshal(job{If: filepath.Join(dir, "missing"), Of: out})
+	code, stdout, _ = runMainStdin(t, bytes.NewReader(spec), "-jobStdin", "-status", "none")
+	res = webhookTransfer{}
+	if err := json.Unmarshal([]byte(stdout), &res); code != 1 || err != nil || res.Status != "failed" || res.Error == "" {
+		t.Errorf("failed job: exit %d, result %q", code, stdout)
+	}
+
+	for _, bad := range []string{`{"if": "a"}`, `{"if": "a", "of": "b", "colour": "red"}`, `{"if": "a", "of": "b", "options": {"bs1": "4K"}}`} {
+		if code, _, _ := runMainStdin(t, strings.NewReader(bad), "-jobStdin"); code == 0 {
+			t.Errorf("job %s accepted", bad)
+		}
+	}
+}
+
+func TestShareSource(t *testing.T) {
+	var mu sync.Mutex
+	opened := 0
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		if filepath.Base(name) == "in" {
+			mu.Lock()
+			opened++
+			mu.Unlock()
+		}
+		return open(name, flag, perm)
+	})
+	dir := t.TempDir()
+	data := make([]byte, 1<<20+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	for _, share := range []bool{false, true} {
+		opened = 0
+		args := []string{"-shareSource=" + strconv.FormatBool(share), "-numTransfers", "3"}
+		for i := 1; i <= 3; i++ {
+			n := strconv.Itoa(i)
+			// the block sizes differ; the shared read uses the largest
+			args = append(args, "-if"+n, in, "-of"+n, filepath.Join(dir, "out"+n), "-bs"+n, strconv.Itoa(512<<i))
+		}
+		if err := runInProcess(t, args...); err != nil {
+			t.Fatal(err)
+		}
+		want := 3
+		if share {
+			want = 1
+		}
+		if opened != want {
+			t.Errorf("-shareSource=%v: input opened %d times, want %d", share, opened, want)
+		}
+		for i := 1; i <= 3; i++ {
+			if got, _ := os.ReadFile(filepath.Join(dir, fmt.Sprintf("out%d", i))); !bytes.Equal(got, data) {
+				t.Errorf("-shareSource=%v: output %d doesn't match", share, i)
+			}
+		}
+	}
+
+	// a transfer held back by delayN reads on its own, so it doesn't
+	// stall the others until it starts
+	opened = 0
+	args := []string{"-shareSource", "-numTransfers", "3", "-delay3", "200ms"}
+	for i := 1; i <= 3; i++ {
+		n := strconv.Itoa(i)
+		args = append(args, "-if"+n, in, "-of"+n, filepath.Join(dir, "out"+n))
+	}
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 2 {
+		t.Errorf("with -delay3: input opened %d times, want 2", opened)
+	}
+}
+
+func TestSetOOMScoreAdj(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "oom_score_adj", []byte("0\n"))
+	if err := setOOMScoreAdj(path, -500); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "-500" {
+		t.Errorf("wrote %q", got)
+	}
+	if err := setOOMScoreAdj(filepath.Join(dir, "missing", "oom_score_adj"), 1); err == nil || !strings.Contains(err.Error(), "error setting oom_score_adj") {
+		t.Errorf("missing file: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		os.Chmod(path, 0o444)
+		if err := setOOMScoreAdj(path, -1000); !errors.Is(err, os.ErrPermission) || !strings.Contains(err.Error(), "needs root") {
+			t.Errorf("read-only file: %v", err)
+		}
+	}
+
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	args := []string{"-status", "none", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out")}
+	for _, bad := range []string{"1001", "-1001", "low"} {
+		if code, _, stderr := runMain(t, append(args, "-oomScoreAdj", bad)...); code == 0 || !strings.Contains(stderr, "-oomScoreAdj must be") {
+			t.Errorf("-oomScoreAdj %s: exit %d\n%s", bad, code, stderr)
+		}
+	}
+	// raising it needs no privileges
+	if code, _, stderr := runMain(t, append(args, "-oomScoreAdj", "1000")...); code != 0 {
+		t.Errorf("-oomScoreAdj 1000: exit %d\n%s", code, stderr)
+	}
+}
+
+func TestOpenRetries(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	out := filepath.Join(dir, "out")
+	missing := filepath.Join(dir, "missing")
+	var mu sync.Mutex
+	var attempts map[string][]time.Time
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[name] = append(attempts[name], time.Now())
+		// busy twice, then fine
+		if name != missing && len(attempts[name]) <= 2 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EBUSY}
+		}
+		return open(name, flag, perm)
+	})
+	t.Cleanup(func() { openRetries, openRetryDelay = 0, time.Second })
+
+	attempts = map[string][]time.Time{}
+	if err := runInProcess(t, "-openRetries", "2", "-openRetryDelay", "20ms", "-numTransfers", "1", "-if1", in, "-of1", out); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{in, out} {
+		times := attempts[name]
+		if len(times) != 3 {
+			t.Fatalf("%s opened %d times, want 3", filepath.Base(name), len(times))
+		}
+		// the wait doubles
+		if d := times[1].Sub(times[0]); d < 20*time.Millisecond {
+			t.Errorf("%s: first retry after %v", filepath.Base(name), d)
+		}
+		if d := times[2].Sub(times[1]); d < 40*time.Millisecond {
+			t.Errorf("%s: second retry after %v", filepath.Base(name), d)
+		}
+	}
+	if got, _ := os.ReadFile(out); string(got) != "data" {
+		t.Errorf("output is %q", got)
+	}
+
+	attempts = map[string][]time.Time{}
+	if err := runInProcess(t, "-openRetries", "1", "-openRetryDelay", "1ms", "-numTransfers", "1", "-if1", in, "-of1", out); err == nil {
+		t.Error("still busy after the last retry, but succeeded")
+	}
+
+	// other errors aren't retried
+	attempts = map[string][]time.Time{}
+	runInProcess(t, "-openRetries", "5", "-openRetryDelay", "1ms", "-numTransfers", "1", "-if1", missing, "-of1", out)
+	if n := len(attempts[missing]); n != 1 {
+		t.Errorf("missing input opened %d times, want 1", n)
+	}
+}
+
+func TestEarlyRender(t *testing.T) {
+	tr := &Transfer{Index: 1, Name: "img", InputFilename: "in", OutputFilename: "out",
+		StartTime: time.Now(), Total: 1000}
+	moved, done := make(chan struct{}, 1), make(chan struct{})
+	w := &firstWriteNotifier{w: io.Discard, c: moved}
+	mp := &MultiProgress{Transfers: []*Transfer{tr}, TermCols: 100, Moved: moved, Done: done}
+	start := time.Now()
+	out := captureStdout(t, func() {
+		finished := make(chan struct{})
+		go func() {
+			mp.startProgress()
+			close(finished)
+		}()
+		tr.Mutex.Lock()
+		tr.Transferred = 500
+		tr.Mutex.Unlock()
+		w.Write(make([]byte, 500))
+		time.Sleep(100 * time.Millisecond)
+		// only the first write notifies
+		w.Write(make([]byte, 500))
+		if len(moved) != 0 {
+			t.Error("second write notified again")
+		}
+		tr.Mutex.Lock()
+		tr.Transferred = 1000
+		tr.Finished = true
+		tr.Mutex.Unlock()
+		close(done)
+		<-finished
+	})
+	if elapsed := time.Since(start); elapsed >= progressInterval {
+		t.Skipf("took %v, so the ticker may have drawn the frame", elapsed)
+	}
+	// the half-full bar can only come from the early redraw
+	half := LightGreen + strings.Repeat("-", 25) + DarkGreen + strings.Repeat("-", 25)
+	if !strings.Contains(out, half) {
+		t.Errorf("no frame drawn at 50%% before the first tick:\n%q", out)
+	}
+}
+
+func TestReadonlyInputs(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	var inFlags []int
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		if name == in {
+			inFlags = append(inFlags, flag)
+		}
+		return open(name, flag, perm)
+	})
+	t.Cleanup(func() { readonlyInputs = false })
+	if err := runInProcess(t, "-readonlyInputs", "-numTransfers", "1", "-if1", in, "-of1", filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if len(inFlags) == 0 {
+		t.Fatal("input not opened")
+	}
+	for _, fl := range inFlags {
+		if fl&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+			t.Errorf("input opened with flags %#x", fl)
+		}
+	}
+
+	// the output of one transfer is the input of another, under another
+	// name
+	other := writeTestFile(t, dir, "other", []byte("other"))
+	args := []string{"-status", "none", "-numTransfers", "2",
+		"-if1", in, "-of1", dir + "/./other",
+		"-if2", other, "-of2", filepath.Join(dir, "out2")}
+	code, _, stderr := runMain(t, append(args, "-readonlyInputs")...)
+	if code == 0 || !strings.Contains(stderr, "transfer #1 would write to") {
+		t.Errorf("-readonlyInputs: exit %d\n%s", code, stderr)
+	}
+	if got, _ := os.ReadFile(other); string(got) != "other" {
+		t.Errorf("input changed to %q", got)
+	}
+	if code, _, stderr := runMain(t, args...); strings.Contains(stderr, "would write to") {
+		t.Errorf("guard applied without -readonlyInputs: exit %d\n%s", code, stderr)
+	}
+}
+
+func TestMaxLoadPauses(t *testing.T) {
+	var mu sync.Mutex
+	avg := 1.0
+	setLoad := func(l float64) {
+		mu.Lock()
+		avg = l
+		mu.Unlock()
+	}
+	load := func() (float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return avg, nil
+	}
+	gate := newLoadGate()
+	gate.check(4, load)
+	stop := make(chan struct{})
+	go watchLoad(gate, 4, 10*time.Millisecond, load, stop)
+	defer close(stop)
+
+	tr := newTestTransfer("", filepath.Join(t.TempDir(), "out"))
+	tr.gate = gate
+	pw, done := startPipedTransfer(tr)
+	go feed(pw)
+	waitTransferred(t, tr, 64<<10)
+
+	setLoad(9.5)
+	time.Sleep(50 * time.Millisecond)
+	tr.Mutex.Lock()
+	before := tr.Transferred
+	tr.Mutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	tr.Mutex.Lock()
+	after := tr.Transferred
+	tr.Mutex.Unlock()
+	// a read already past the gate may still land
+	if after-before > tr.Bs {
+		t.Errorf("copied %d bytes while the load was above -maxLoad", after-before)
+	}
+
+	setLoad(2)
+	waitTransferred(t, tr, after+64<<10)
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if tr.Paused < 100*time.Millisecond {
+		t.Errorf("paused for %v", tr.Paused)
+	}
+	var b strings.Builder
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	if !strings.Contains(b.String(), "s for -maxLoad") {
+		t.Errorf("summary doesn't report the pause:\n%s", b.String())
+	}
+}
+
+func TestVerifyWrittenRegion(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(2)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	// a "device" much bigger than the image, full of old data
+	dev := writeTestFile(t, dir, "dev", bytes.Repeat([]byte{0xaa}, 1<<20))
+
+	tr := newTestTransfer(in, dev)
+	tr.Oflag = 0 // a device isn't created or truncated
+	tr.SeekOff = 4096
+	tr.Verify = true
+	tr.VerifyBs = 4096
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(t, dev) != 1<<20 {
+		t.Fatal("device size changed")
+	}
+	if err := verifyTransfer(tr); err != nil || tr.Verified != int64(len(data)) {
+		t.Errorf("verified %d bytes of the %d written: %v", tr.Verified, len(data), err)
+	}
+	tr.Err = nil
+	var b strings.Builder
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	if !strings.Contains(b.String(), "10000 bytes read back") || !strings.Contains(b.String(), "SHA-256 matches") {
+		t.Errorf("summary:\n%s", b.String())
+	}
+
+	corrupt := func(off int64) {
+		f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0x55}, off)
+		f.Close()
+	}
+	// the rest of the device isn't read back
+	corrupt(4096 + int64(len(data)))
+	tr.Verified = 0
+	if err := verifyTransfer(tr); err != nil {
+		t.Errorf("change past the written region: %v", err)
+	}
+	corrupt(4096 + int64(len(data)) - 1)
+	tr.Verified = 0
+	err := verifyTransfer(tr)
+	if classifyError(err) != classVerify {
+		t.Fatalf("change in the written region: %v", err)
+	}
+	tr.Err = err
+	b.Reset()
+	printSummary(&b, []*Transfer{tr}, 0, false)
+	if !strings.Contains(b.String(), "read back") || !strings.Contains(b.String(), ", failed") {
+		t.Errorf("summary after a mismatch:\n%s", b.String())
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	for _, tc := range []struct {
+		rates         []float64
+		width, height int
+		want          []string
+	}{
+		{[]float64{0, 10, 20, 40, 40, 20}, 80, 4, []string{
+			"   40.00 |   ##",
+			"         |   ##",
+			"         |  ####",
+			"         | #####",
+			"    0.00 +------",
+			"          0s  3s",
+		}},
+		// two samples to a column
+		{[]float64{10, 30, 20, 20, 0, 0, 40, 40}, 4, 2, []string{
+			"   40.00 |   #",
+			"         |## #",
+			"    0.00 +----",
+			"          0s 4s",
+		}},
+		{[]float64{0, 0}, 80, 1, []string{
+			"    0.00 |",
+			"    0.00 +--",
+			"          0s 1s",
+		}},
+	} {
+		got := renderChart(tc.rates, 500*time.Millisecond, tc.width, tc.height)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("renderChart(%v):\n%s\nwant:\n%s", tc.rates, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestUntilAcrossReads(t *testing.T) {
+	for _, tc := range []struct {
+		chunks    []string
+		delim     string
+		inclusive bool
+		want      string
+	}{
+		{[]string{"header EN", "D trailer"}, "END", false, "header "},
+		{[]string{"header EN", "D trailer"}, "END", true, "header END"},
+		{[]string{"E", "N", "D"}, "END", true, "END"},
+		{[]string{"a partial E", "N"}, "END", false, "a partial EN"},
+		{[]string{"ENEN", "D"}, "END", false, "EN"},
+	} {
+		var readers []io.Reader
+		for _, c := range tc.chunks {
+			readers = append(readers, strings.NewReader(c))
+		}
+		u := &untilReader{r: io.MultiReader(readers...), delim: []byte(tc.delim), inclusive: tc.inclusive}
+		got, err := io.ReadAll(u)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%q until %q (inclusive %v): %q, %v; want %q", tc.chunks, tc.delim, tc.inclusive, got, err, tc.want)
+		}
+	}
+
+	// through dd, with the delimiter across a block boundary
+	dir := t.TempDir()
+	data := append(bytes.Repeat([]byte{'x'}, 510), 0xde, 0xad, 0xbe, 0xef, 'y')
+	in := writeTestFile(t, dir, "in", data)
+	for _, inclusive := range []bool{false, true} {
+		out := filepath.Join(dir, "out")
+		code, _, stderr := runMain(t, "-status", "none", "-numTransfers", "1", "-if1", in, "-of1", out, "-bs1", "512",
+			"-until1", "deadbeef", "-untilInclusive="+strconv.FormatBool(inclusive))
+		want := data[:510]
+		if inclusive {
+			want = data[:514]
+		}
+		if got, _ := os.ReadFile(out); code != 0 || !bytes.Equal(got, want) {
+			t.Errorf("-untilInclusive=%v: exit %d, copied %d bytes, want %d\n%s", inclusive, code, len(got), len(want), stderr)
+		}
+	}
+}
+
+func TestAppendChecksumRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(3)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	for _, alg := range []string{"sha256", "sha512"} {
+		img := filepath.Join(dir, "img."+alg)
+		if code, _, stderr := runMain(t, "-status", "none", "-appendChecksum", "-numTransfers", "1", "-if1", in, "-of1", img, "-hash1", alg); code != 0 {
+			t.Fatalf("%s: -appendChecksum: exit %d\n%s", alg, code, stderr)
+		}
+		if n := fileSize(t, img); n != int64(len(data))+trailerSize {
+			t.Fatalf("%s: output is %d bytes", alg, n)
+		}
+		gotAlg, length, _, err := readTrailer(img)
+		if err != nil || gotAlg != alg || length != int64(len(data)) {
+			t.Errorf("%s: trailer %q, %d: %v", alg, gotAlg, length, err)
+		}
+
+		out := filepath.Join(dir, "out")
+		verify := func() (int, string) {
+			code, _, stderr := runMain(t, "-status", "none", "-verifyAppended", "-numTransfers", "1", "-if1", img, "-of1", out)
+			return code, stderr
+		}
+		if code, stderr := verify(); code != 0 {
+			t.Errorf("%s: intact image: exit %d\n%s", alg, code, stderr)
+		} else if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+			t.Errorf("%s: copied data doesn't match without the trailer (%d bytes)", alg, len(got))
+		}
+
+		f, err := os.OpenFile(img, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{^data[5000]}, 5000)
+		if code, stderr := verify(); code == 0 || !strings.Contains(stderr, "mismatch") {
+			t.Errorf("%s: tampered data: exit %d\n%s", alg, code, stderr)
+		}
+		f.WriteAt([]byte("XXXXXXXX"), int64(len(data))+80)
+		f.Close()
+		if code, stderr := verify(); code == 0 || !strings.Contains(stderr, "has no checksum trailer") {
+			t.Errorf("%s: no trailer: exit %d\n%s", alg, code, stderr)
+		}
+	}
+}
+
+func TestRedrawInterval(t *testing.T) {
+	for _, tc := range []struct {
+		cur, took, want time.Duration
+	}{
+		{progressInterval, 10 * time.Millisecond, progressInterval},
+		{progressInterval, 60 * time.Millisecond, 2 * progressInterval},
+		{4 * time.Second, time.Second, maxProgressInterval},
+		{maxProgressInterval, 5 * time.Second, maxProgressInterval},
+		{4 * time.Second, 50 * time.Millisecond, 2 * time.Second},
+		{time.Second, 10 * time.Millisecond, progressInterval},
+		// in between: keep it
+		{2 * time.Second, 100 * time.Millisecond, 2 * time.Second},
+	} {
+		if got := nextInterval(tc.cur, tc.took); got != tc.want {
+			t.Errorf("nextInterval(%v, %v) = %v, want %v", tc.cur, tc.took, got, tc.want)
+		}
+	}
+
+	// a slow redraw stretches the interval, a quick one shrinks it back
+	interval := progressInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	redraw(ticker, &interval, func() { time.Sleep(progressInterval / renderBudget * 2) })
+	if interval != 2*progressInterval {
+		t.Errorf("interval %v after a slow redraw", interval)
+	}
+	redraw(ticker, &interval, func() {})
+	if interval != progressInterval {
+		t.Errorf("interval %v after a quick redraw", interval)
+	}
+
+	// a frame of many transfers fits the budget of the shortest interval
+	var transfers []*Transfer
+	for i := 1; i <= 50; i++ {
+		transfers = append(transfers, &Transfer{Index: i, InputFilename: fmt.Sprintf("in%d", i), OutputFilename: fmt.Sprintf("out%d", i),
+			StartTime: time.Now().Add(-time.Minute), Transferred: int64(i) << 20, Total: 100 << 20})
+	}
+	mp := &MultiProgress{Transfers: transfers, TermCols: 120}
+	var took time.Duration
+	captureStdout(t, func() {
+		start := time.Now()
+		mp.drawPage(0, 1, true)
+		took = time.Since(start)
+	})
+	if took*renderBudget > progressInterval {
+		t.Errorf("drawing 50 transfers took %v", took)
+	}
+}
+
+func TestEmitDd(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "my disk.img", make([]byte, 100))
+	out := filepath.Join(dir, "out")
+	code, stdout, stderr := runMain(t, "-emitDd", "-numTransfers", "2",
+		"-if1", in, "-of1", out, "-bs1", "4M", "-count1", "10", "-skip1", "2", "-seek1", "1",
+		"-conv1", "notrunc,fsync", "-oflag1", "direct", "-hash1", "sha256",
+		"-if2", out, "-of2", filepath.Join(dir, "out2"), "-bs2", "512", "-size2", "1000")
+	if code != 0 {
+		t.Fatalf("exit %d\n%s", code, stderr)
+	}
+	want := "dd if=" + shellQuote(in) + " of=" + shellQuote(out) + " bs=4194304 count=10 skip=2 seek=1 conv=notrunc,fsync oflag=direct\n" +
+		"dd if=" + shellQuote(out) + " of=" + shellQuote(filepath.Join(dir, "out2")) + " bs=512 count=1000 iflag=count_bytes\n"
+	if !strings.HasPrefix(want, "dd if='") {
+		t.Errorf("input name with a space not quoted: %s", shellQuote(in))
+	}
+	if stdout != want {
+		t.Errorf("emitted:\n%s\nwant:\n%s", stdout, want)
+	}
+	if !strings.Contains(stderr, "transfer #1: hash1 (pipe through sha256sum) has no dd equivalent") {
+		t.Errorf("no warning about hash1:\n%s", stderr)
+	}
+	// nothing was run
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output written: %v", err)
+	}
+}
+
+func TestCollapseFinished(t *testing.T) {
+	var transfers []*Transfer
+	for i, name := range []string{"alpha", "bravo", "charlie"} {
+		transfers = append(transfers, &Transfer{Index: i + 1, InputFilename: name + ".in", OutputFilename: name + ".out",
+			StartTime: time.Now(), Transferred: 100, Total: 1000})
+	}
+	mp := &MultiProgress{Transfers: transfers, TermCols: 100, Collapse: true}
+	var first, second int
+	out := captureStdout(t, func() {
+		first = mp.drawPage(0, mp.pages(), true)
+		transfers[1].Mutex.Lock()
+		transfers[1].Transferred = 1000
+		transfers[1].Finished = true
+		transfers[1].Mutex.Unlock()
+		fmt.Print("\n--- redraw ---\n")
+		second = mp.drawPage(0, mp.pages(), false)
+	})
+	if first != 6 || second != 5 {
+		t.Errorf("drew %d lines, then %d; want 6, then 2 transfers and the count", first, second)
+	}
+	_, redraw, _ := strings.Cut(out, "--- redraw ---")
+	if !strings.Contains(redraw, "1 of 3 transfers finished") {
+		t.Errorf("no finished count in %q", redraw)
+	}
+	for _, tr := range transfers {
+		if shown := strings.Contains(redraw, tr.title()); shown != !tr.Finished {
+			t.Errorf("%s shown: %v", tr.title(), shown)
+		}
+	}
+	// the line no longer used is blanked
+	if !strings.HasSuffix(redraw, "\033[K\n\033[1A") {
+		t.Errorf("leftover line not cleared: %q", redraw[max(0, len(redraw)-40):])
+	}
+
+	// the summary still has all of them
+	var b strings.Builder
+	printSummary(&b, transfers, 0, false)
+	for _, tr := range transfers {
+		if !strings.Contains(b.String(), tr.InputFilename) {
+			t.Errorf("%s missing from the summary:\n%s", tr.InputFilename, b.String())
+		}
+	}
+}
+
+// chunkReader returns its chunks one read at a time, like a pipe fed in
+// pieces, then io.EOF
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestConvSync(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	tr := newTestTransfer("", out)
+	tr.Conv = "sync"
+	in := &chunkReader{chunks: [][]byte{bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 512), bytes.Repeat([]byte("c"), 300)}}
+	if err := doOneTransfer(tr, in); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every short read becomes a whole block
+	var want []byte
+	want = append(want, bytes.Repeat([]byte("a"), 100)...)
+	want = append(want, make([]byte, 412)...)
+	want = append(want, bytes.Repeat([]byte("b"), 512)...)
+	want = append(want, bytes.Repeat([]byte("c"), 300)...)
+	want = append(want, make([]byte, 212)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrote %d bytes, want 3 blocks of 512 padded with NULs:\n%q", len(got), got)
+	}
+}
+
+// flakyReader plays a script of reads: a byte fills one 512-byte block
+// with itself, and 0 is a failed read
+type flakyReader struct {
+	script []byte
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if len(f.script) == 0 {
+		return 0, io.EOF
+	}
+	b := f.script[0]
+	f.script = f.script[1:]
+	if b == 0 {
+		return 0, syscall.EIO
+	}
+	return copy(p, bytes.Repeat([]byte{b}, 512)), nil
+}
+
+func TestConvNoError(t *testing.T) {
+	block := func(b byte) []byte { return bytes.Repeat([]byte{b}, 512) }
+	for _, tc := range []struct {
+		conv string
+		want []byte
+	}{
+		// the second block reads on the retry; the fourth fails twice
+		// and is skipped
+		{"noerror,sync", bytes.Join([][]byte{block('a'), block('b'), make([]byte, 512), block('c')}, nil)},
+		{"noerror", bytes.Join([][]byte{block('a'), block('b'), block('c')}, nil)},
+	} {
+		out := filepath.Join(t.TempDir(), "out")
+		tr := newTestTransfer("", out)
+		tr.Conv = tc.conv
+		tr.ReadRetries = 1
+		if err := doOneTransfer(tr, &flakyReader{script: []byte{'a', 0, 'b', 0, 0, 'c'}}); err != nil {
+			t.Fatalf("conv=%s: %v", tc.conv, err)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("conv=%s: wrote %d bytes, want %d", tc.conv, len(got), len(tc.want))
+		}
+		if tr.BadBlocks != 1 {
+			t.Errorf("conv=%s: %d bad blocks, want 1", tc.conv, tr.BadBlocks)
+		}
+	}
+
+	// without noerror the copy stops at the failed read
+	out := filepath.Join(t.TempDir(), "out")
+	tr := newTestTransfer("", out)
+	if err := doOneTransfer(tr, &flakyReader{script: []byte{'a', 0, 'b'}}); err == nil {
+		t.Error("read error ignored without conv=noerror")
+	}
+
+	// a skipped block counts towards count like one that was read
+	out = filepath.Join(t.TempDir(), "out")
+	tr = newTestTransfer("", out)
+	tr.Conv = "noerror"
+	tr.Count = 3
+	if err := doOneTransfer(tr, &flakyReader{script: []byte{'a', 0, 'b', 'c'}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileSize(t, out); n != 2*512 {
+		t.Errorf("count=3 with a block skipped: wrote %d bytes, want %d", n, 2*512)
+	}
+}
+
+func TestConvSparse(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 8*512)
+	copy(data[512:], bytes.Repeat([]byte("x"), 512))
+	copy(data[4*512:], bytes.Repeat([]byte("y"), 100))
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	tr := newTestTransfer(in, out)
+	tr.Conv = "sparse"
+	tr.Sparse = true
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("output differs from the input (%d bytes of %d)", len(got), len(data))
+	}
+	// blocks 0, 2, 3, 5, 6 and 7 are zeros; the trailing hole is
+	// extended, not written
+	if tr.Holes != 6*512 {
+		t.Errorf("%d bytes left as holes, want %d", tr.Holes, 6*512)
+	}
+
+	// fullalloc promises an output without holes
+	if _, err := parseConvOflag("fullalloc,sparse", "none"); err == nil {
+		t.Error("conv=fullalloc,sparse accepted")
+	}
+}
+
+func TestFullBlock(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	pieces := func() *chunkReader {
+		c := &chunkReader{}
+		for b := data; len(b) > 0; b = b[min(100, len(b)):] {
+			c.chunks = append(c.chunks, b[:min(100, len(b))])
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		iflag string
+		size  int
+	}{
+		// each 100-byte read is padded to a block of its own
+		{"", 10 * 512},
+		// the reads are gathered into whole blocks first
+		{"fullblock", 2 * 512},
+	} {
+		out := filepath.Join(t.TempDir(), "out")
+		tr := newTestTransfer("", out)
+		tr.Conv = "sync"
+		tr.IflagStr = tc.iflag
+		if err := doOneTransfer(tr, pieces()); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tc.size {
+			t.Errorf("iflag=%s: wrote %d bytes, want %d", tc.iflag, len(got), tc.size)
+		}
+		if tc.iflag == "fullblock" && !bytes.Equal(got[:len(data)], data) {
+			t.Error("iflag=fullblock: data changed")
+		}
+	}
+}
+
+func TestByteOffsets(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	err := runInProcess(t, "-numTransfers", "1", "-if1", in, "-of1", out, "-bs1", "512",
+		"-iflag1", "skip_bytes,count_bytes", "-skip1", "100", "-count1", "1000",
+		"-oflag1", "seek_bytes", "-seek1", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(make([]byte, 10), data[100:1100]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrote %d bytes, want 10 zeros and input bytes 100 to 1100", len(got))
+	}
+}
+
+// sizeRecorder records the size of every write
+type sizeRecorder struct {
+	sizes []int
+	buf   bytes.Buffer
+}
+
+func (s *sizeRecorder) Write(p []byte) (int, error) {
+	s.sizes = append(s.sizes, len(p))
+	return s.buf.Write(p)
+}
+
+func TestIbsObs(t *testing.T) {
+	data := make([]byte, 2500)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// 300-byte reads become 1024-byte writes and a short last one
+	var rec sizeRecorder
+	pw := newPadWriter(&rec, 1024)
+	pw.short = true
+	if err := dd(bytes.NewReader(data), pw, 300, &Transfer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rec.sizes) != "[1024 1024 452]" || !bytes.Equal(rec.buf.Bytes(), data) {
+		t.Errorf("wrote %v, want [1024 1024 452] with the data unchanged", rec.sizes)
+	}
+
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	if err := runInProcess(t, "-numTransfers", "1", "-if1", in, "-of1", out, "-ibs1", "300", "-obs1", "1024"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Errorf("-ibs1 300 -obs1 1024 wrote %d bytes, want the %d input bytes", len(got), len(data))
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1200<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	// about 1.2 s, so there are a couple of progress lines
+	code, _, stderr := runMain(t, "-status", "json", "-numTransfers", "1", "-if1", in, "-of1", out, "-bwlimit1", "1M")
+	if code != 0 {
+		t.Fatalf("exit %d\n%s", code, stderr)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Error("output differs from the input")
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("want progress lines and a summary, got:\n%s", stderr)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		var ev progressEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || len(ev.Transfers) != 1 {
+			t.Fatalf("not a progress line: %q", line)
+		}
+		if b := ev.Transfers[0].Bytes; b < 0 || b > int64(len(data)) {
+			t.Errorf("progress line with %d bytes", b)
+		}
+	}
+	var sum webhookPayload
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &sum); err != nil {
+		t.Fatalf("not a JSON summary: %q", lines[len(lines)-1])
+	}
+	if sum.Event != "complete" || sum.Bytes != int64(len(data)) || len(sum.Transfers) != 1 || sum.Transfers[0].Status != "ok" {
+		t.Errorf("summary %+v", sum)
+	}
+
+	code, stdout, stderr := runMain(t, "-status", "none", "-numTransfers", "1", "-if1", in, "-of1", out)
+	if code != 0 || stdout != "" || stderr != "" {
+		t.Errorf("-status none: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+}
+
+// openTimes records when files are first opened, by base name
+type openTimes struct {
+	mu sync.Mutex
+	at map[string]time.Time
+}
+
+// recordOpens fakes openFile to note when each file is opened
+func recordOpens(t *testing.T) *openTimes {
+	o := &openTimes{at: map[string]time.Time{}}
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		o.mu.Lock()
+		if _, ok := o.at[filepath.Base(name)]; !ok {
+			o.at[filepath.Base(name)] = time.Now()
+		}
+		o.mu.Unlock()
+		return open(name, flag, perm)
+	})
+	return o
+}
+
+// get returns when name was opened
+func (o *openTimes) get(t *testing.T, name string) time.Time {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	at, ok := o.at[name]
+	if !ok {
+		t.Fatalf("%s never opened", name)
+	}
+	return at
+}
+
+// timedTransfers returns the arguments for n transfers in dir, from in1
+// to out1 and so on, each taking about size/1M seconds
+func timedTransfers(t *testing.T, dir string, n int, size int) []string {
+	args := []string{"-numTransfers", strconv.Itoa(n)}
+	for i := 1; i <= n; i++ {
+		s := strconv.Itoa(i)
+		in := writeTestFile(t, dir, "in"+s, make([]byte, size))
+		args = append(args, "-if"+s, in, "-of"+s, filepath.Join(dir, "out"+s), "-bwlimit"+s, "1M")
+	}
+	return args
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	opens := recordOpens(t)
+	dir := t.TempDir()
+	// four transfers of about 0.2 s in two slots: two at a time
+	args := append(timedTransfers(t, dir, 4, 200<<10), "-maxConcurrent", "2")
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	for i := 3; i <= 4; i++ {
+		gap := opens.get(t, fmt.Sprintf("in%d", i)).Sub(opens.get(t, fmt.Sprintf("in%d", i-2)))
+		if gap < 150*time.Millisecond {
+			t.Errorf("transfer %d started %v after transfer %d; three ran at once", i, gap, i-2)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if n := fileSize(t, filepath.Join(dir, fmt.Sprintf("out%d", i))); n != 200<<10 {
+			t.Errorf("output %d has %d bytes", i, n)
+		}
+	}
+	if err := runInProcess(t, "-maxConcurrent", "-1", "-numTransfers", "1", "-if1", filepath.Join(dir, "in1"), "-of1", filepath.Join(dir, "out1")); err == nil {
+		t.Error("negative -maxConcurrent accepted")
+	}
+}
+
+func TestAfter(t *testing.T) {
+	opens := recordOpens(t)
+	dir := t.TempDir()
+	// #1 waits for #2, which takes about 0.2 s
+	args := append(timedTransfers(t, dir, 2, 200<<10), "-after1", "2")
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if gap := opens.get(t, "in1").Sub(opens.get(t, "in2")); gap < 150*time.Millisecond {
+		t.Errorf("transfer 1 started %v after transfer 2 it waits for", gap)
+	}
+	if n := fileSize(t, filepath.Join(dir, "out1")); n != 200<<10 {
+		t.Errorf("output 1 has %d bytes", n)
+	}
+
+	// a failed transfer holds back those waiting for it for good
+	out1 := filepath.Join(dir, "again")
+	runInProcess(t, "-numTransfers", "2", "-after1", "2",
+		"-if1", filepath.Join(dir, "in1"), "-of1", out1, "-if2", filepath.Join(dir, "missing"), "-of2", filepath.Join(dir, "out2"))
+	if _, err := os.Stat(out1); !os.IsNotExist(err) {
+		t.Errorf("transfer 1 ran after transfer 2 failed: %v", err)
+	}
+
+	if err := runInProcess(t, "-numTransfers", "2", "-after1", "2", "-after2", "1",
+		"-if1", filepath.Join(dir, "in1"), "-of1", out1, "-if2", filepath.Join(dir, "in2"), "-of2", filepath.Join(dir, "out2")); err == nil {
+		t.Error("transfers waiting for each other accepted")
+	}
+}
+
+func TestPhases(t *testing.T) {
+	opens := recordOpens(t)
+	dir := t.TempDir()
+	args := timedTransfers(t, dir, 3, 200<<10)
+	// #2 takes about 0.4 s; #3 must wait for it as well as for #1
+	writeTestFile(t, dir, "in2", make([]byte, 400<<10))
+	args = append(args, "-phase1", "prepare", "-phase2", "prepare", "-phase3", "write")
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	in1, in2, in3 := opens.get(t, "in1"), opens.get(t, "in2"), opens.get(t, "in3")
+	if d := in2.Sub(in1); d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("transfers 1 and 2 of one phase started %v apart", d)
+	}
+	if gap := in3.Sub(in2); gap < 350*time.Millisecond {
+		t.Errorf("the second phase started %v after the first; want after both its transfers", gap)
+	}
+	if n := fileSize(t, filepath.Join(dir, "out3")); n != 200<<10 {
+		t.Errorf("output 3 has %d bytes", n)
+	}
+}
+
+func TestPerDevice(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok := physicalDisk(dir); !ok {
+		t.Skip("no device numbers for files here")
+	}
+	opens := recordOpens(t)
+	// both transfers are on the disk of dir
+	args := append(timedTransfers(t, dir, 2, 200<<10), "-perDevice", "1")
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if gap := opens.get(t, "in2").Sub(opens.get(t, "in1")); gap < 150*time.Millisecond {
+		t.Errorf("transfer 2 started %v after transfer 1 on the same disk; they overlapped", gap)
+	}
+	for i := 1; i <= 2; i++ {
+		if n := fileSize(t, filepath.Join(dir, fmt.Sprintf("out%d", i))); n != 200<<10 {
+			t.Errorf("output %d has %d bytes", i, n)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	opens := recordOpens(t)
+	dir := t.TempDir()
+	args := append(timedTransfers(t, dir, 2, 10<<10), "-delay2", "300ms")
+	if err := runInProcess(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if gap := opens.get(t, "in2").Sub(opens.get(t, "in1")); gap < 250*time.Millisecond {
+		t.Errorf("transfer 2 started %v after transfer 1, before its 300ms delay", gap)
+	}
+
+	// until it starts, a delayed transfer is shown waiting
+	code, _, stderr := runMain(t, append(timedTransfers(t, dir, 2, 10<<10), "-delay2", "1s", "-status", "json")...)
+	if code != 0 {
+		t.Fatalf("exit %d\n%s", code, stderr)
+	}
+	var ev progressEvent
+	if err := json.Unmarshal([]byte(stderr[:strings.Index(stderr, "\n")]), &ev); err != nil || len(ev.Transfers) != 2 {
+		t.Fatalf("no progress line first:\n%s", stderr)
+	}
+	if ev.Transfers[0].Waiting || !ev.Transfers[1].Waiting {
+		t.Errorf("first progress line %+v, want only transfer 2 waiting", ev.Transfers)
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	dir := t.TempDir()
+	mapFile := filepath.Join(dir, "map")
+	tr := newTestTransfer("", filepath.Join(dir, "out"))
+	tr.Conv = "noerror,sync"
+	tr.MapFile = mapFile
+	if err := doOneTransfer(tr, &flakyReader{script: []byte{'a', 0, 'b', 'c', 0, 0, 'd'}}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readRescueMap(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mapRange{{0, 512, '+'}, {512, 512, '-'}, {1024, 1024, '+'}, {2048, 1024, '-'}, {3072, 512, '+'}}
+	if fmt.Sprint(m.ranges) != fmt.Sprint(want) {
+		t.Errorf("map has %v, want %v", m.ranges, want)
+	}
+
+	// writing it back gives the same file
+	before, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.write(mapFile); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(mapFile); !bytes.Equal(after, before) {
+		t.Errorf("map changed on a round trip:\n%s\nto:\n%s", before, after)
+	}
+
+	// a later read of a bad range splits it
+	m.set(2048+512, 512, '+')
+	want = []mapRange{{0, 512, '+'}, {512, 512, '-'}, {1024, 1024, '+'}, {2048, 512, '-'}, {2560, 1024, '+'}}
+	if fmt.Sprint(m.ranges) != fmt.Sprint(want) {
+		t.Errorf("after set, map has %v, want %v", m.ranges, want)
+	}
+}
+
+func TestRescuePasses(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	// a first copy that lost 1024-3071 and couldn't read past the end
+	damaged := append([]byte{}, data...)
+	clear(damaged[1024:3072])
+	damaged = append(damaged, make([]byte, 1024)...)
+	out := writeTestFile(t, dir, "out", damaged)
+	mapFile := writeTestFile(t, dir, "map", []byte("# Mapfile\n0x00002400 +\n"+
+		"0x00000000  0x00000400  +\n0x00000400  0x00000800  -\n0x00000C00  0x00001400  +\n0x00002000  0x00000400  -\n"))
+
+	if err := runInProcess(t, "-numTransfers", "1", "-if1", in, "-of1", out, "-rescue1", mapFile, "-fill1", "dead", "-bs1", "4096"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, data...), bytes.Repeat([]byte{0xde, 0xad}, 512)...)
+	if !bytes.Equal(got, want) {
+		t.Error("rescued output isn't the input with the unreadable end filled with dead")
+	}
+	m, err := readRescueMap(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []mapRange{{0, 8192, '+'}, {8192, 1024, '-'}}; fmt.Sprint(m.ranges) != fmt.Sprint(want) {
+		t.Errorf("map after the rescue: %v, want %v", m.ranges, want)
+	}
+}
@@ -0,0 +1,185 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// clearDirect turns O_DIRECT off on f
+func clearDirect(f *os.File) error {
+	fl, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFL, fl&^uintptr(oDirect)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fdFile returns the inherited descriptor of an "fd:N" name after
+// checking that it is open for reading, or for writing if write is set.
+// Descriptors 0-2 are duplicated, so that closing the transfer's file
+// leaves stdin, stdout and stderr alone; others are closed after the
+// transfer, which e.g. lets the reader of a pipe see its end.
+func fdFile(name string, write bool) (*os.File, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "fd:"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %q", name)
+	}
+	fl, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(n), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("file descriptor %d is not open: %w", n, errno)
+	}
+	switch mode := int(fl) & syscall.O_ACCMODE; {
+	case write && mode == syscall.O_RDONLY:
+		return nil, fmt.Errorf("file descriptor %d is not open for writing", n)
+	case !write && mode == syscall.O_WRONLY:
+		return nil, fmt.Errorf("file descriptor %d is not open for reading", n)
+	}
+	if n <= 2 {
+		if n, err = syscall.Dup(n); err != nil {
+			return nil, fmt.Errorf("error duplicating file descriptor: %w", err)
+		}
+	}
+	f := os.NewFile(uintptr(n), name)
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return f, nil
+}
+
+// checkReadOnly asks the kernel how f was opened and fails unless it
+// can only be read
+func checkReadOnly(f *os.File) error {
+	fl, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return fmt.Errorf("error checking how %q is opened: %w", f.Name(), errno)
+	}
+	if int(fl)&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return fmt.Errorf("input %q is open for writing", f.Name())
+	}
+	return nil
+}
+
+// devIoctl issues the Linux or FreeBSD variant of an ioctl on f
+func devIoctl(f *os.File, linuxReq, freebsdReq uintptr, arg unsafe.Pointer) error {
+	var req uintptr
+	switch runtime.GOOS {
+	case "linux":
+		req = linuxReq
+	case "freebsd":
+		req = freebsdReq
+	default:
+		return errors.New("device ioctls not supported on " + runtime.GOOS)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fsBlockSize returns the block size of the filesystem holding name, or
+// 0 if it can't be queried
+func fsBlockSize(name string) int64 {
+	var st syscall.Statfs_t
+	if syscall.Statfs(name, &st) != nil {
+		return 0
+	}
+	return int64(st.Bsize)
+}
+
+// devNumbers returns the device fi is on and, for a device node, the
+// device it is
+func devNumbers(fi os.FileInfo) (dev, rdev uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Rdev), true
+}
+
+// fsFree returns the bytes available to unprivileged users and the total
+// and free inodes of the filesystem holding dir
+func fsFree(dir string) (free, files, ffree int64, err error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), int64(fs.Files), int64(fs.Ffree), nil
+}
+
+// setSockBufs sets SO_RCVBUF and SO_SNDBUF on socket fd
+func setSockBufs(fd uintptr, size int) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, size)
+}
+
+// setProcessNice sets the nice value of the whole process
+func setProcessNice(n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, n)
+}
+
+// checkFdLimit fails early if RLIMIT_NOFILE can't cover concurrent
+// transfers, rather than letting them die with EMFILE halfway through.
+func checkFdLimit(concurrent int) error {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return nil
+	}
+	need := uint64(concurrent*fdsPerTransfer + fdReserve)
+	if uint64(rl.Cur) >= need {
+		return nil
+	}
+	return fmt.Errorf("running %d transfers at once needs about %d open files but RLIMIT_NOFILE is %d; raise it (ulimit -n) or lower -maxOpenFiles",
+		concurrent, need, uint64(rl.Cur))
+}
+
+// infoSignals ask for a printSnapshot: SIGUSR1, and SIGINFO where it
+// exists (the syscall package doesn't define it for every platform)
+var infoSignals = func() []os.Signal {
+	sigs := []os.Signal{syscall.SIGUSR1}
+	switch runtime.GOOS {
+	case "freebsd", "darwin", "netbsd", "openbsd", "dragonfly":
+		sigs = append(sigs, syscall.Signal(29))
+	}
+	return sigs
+}()
@@ -0,0 +1,475 @@
+// BSD 3-Clause License
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// *Redistributions of source code must retain the above copyright notice, this
+//  list of conditions and the following disclaimer.
+//
+// *Redistributions in binary form must reproduce the above copyright notice,
+//  this list of conditions and the following disclaimer in the documentation
+//  and/or other materials provided with the distribution.
+//
+// *Neither the name of the copyright holder nor the names of its
+//  contributors may be used to endorse or promote products derived from
+//  this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// allocated returns the bytes the file at path has on disk
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestFullallocNoHoles(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 4096))
+	const seek = 1 << 20
+
+	holey := filepath.Join(dir, "holey")
+	tr := newTestTransfer(in, holey)
+	tr.SeekOff = seek
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if allocated(t, holey) >= seek {
+		t.Skip("filesystem does not make holes")
+	}
+
+	full := filepath.Join(dir, "full")
+	tr = newTestTransfer(in, full)
+	tr.SeekOff = seek
+	tr.Conv = "fullalloc"
+	if err := doOneTransfer(tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, full); size != seek+4096 {
+		t.Fatalf("output is %d bytes, want %d", size, seek+4096)
+	}
+	if n := allocated(t, full); n < seek+4096 {
+		t.Errorf("conv=fullalloc left holes: %d of %d bytes allocated", n, seek+4096)
+	}
+}
+
+func TestDeviceSizeNotMultipleOfBs(t *testing.T) {
+	old := deviceSizeOf
+	deviceSizeOf = func(f *os.File) int64 {
+		if f.Name() == "/dev/zero" {
+			return 10000
+		}
+		return old(f)
+	}
+	t.Cleanup(func() { deviceSizeOf = old })
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		count, skip int64
+		want        int64
+	}{
+		{math.MaxInt64, 0, 10000},
+		{10, 0, 10000}, // count past the end of the device
+		{2, 0, 8192},
+		{math.MaxInt64, 4096, 5904},
+	} {
+		out := filepath.Join(dir, "out")
+		tr := newTestTransfer("/dev/zero", out)
+		tr.Bs = 4096
+		tr.Count = tc.count
+		tr.SkipOff = tc.skip
+		if err := doOneTransfer(tr, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := fileSize(t, out); n != tc.want || tr.Total != tc.want {
+			t.Errorf("count %d, skip %d: copied %d bytes of a total %d, want %d", tc.count, tc.skip, n, tr.Total, tc.want)
+		}
+	}
+}
+
+func TestCheckFdLimit(t *testing.T) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Skip(err)
+	}
+	old := rl
+	rl.Cur = 64
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Skip(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &old)
+
+	if err := checkFdLimit(10); err != nil {
+		t.Errorf("10 transfers rejected under 64 files: %v", err)
+	}
+	if err := checkFdLimit(50); err == nil || !strings.Contains(err.Error(), "RLIMIT_NOFILE is 64") {
+		t.Errorf("50 transfers under 64 files gave %v", err)
+	}
+}
+
+func TestOptimalIOSizeOfFilesystem(t *testing.T) {
+	// an output that doesn't exist yet gets its directory's statfs block size
+	var st syscall.Statfs_t
+	dir := t.TempDir()
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Skip(err)
+	}
+	if got := optimalIOSize(filepath.Join(dir, "new.img")); got != int64(st.Bsize) {
+		t.Errorf("optimal I/O size %d, want the filesystem's %d", got, st.Bsize)
+	}
+}
+
+func TestSockBufClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+
+	const size = 20000
+	var rcvbuf int
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		raw, err := info.Conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		raw.Control(func(fd uintptr) {
+			rcvbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		})
+	}}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sockBufClient(size).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// Linux doubles the value for its bookkeeping
+	if rcvbuf < size || rcvbuf > 2*size {
+		t.Errorf("SO_RCVBUF is %d on the dialed connection, want %d", rcvbuf, size)
+	}
+
+	// -sockBuf is used for URL inputs
+	old := inputClient
+	t.Cleanup(func() { inputClient = old })
+	out := filepath.Join(t.TempDir(), "out")
+	if err := runInProcess(t, "-sockBuf", "64K", "-numTransfers", "1", "-if1", srv.URL, "-of1", out); err != nil {
+		t.Fatal(err)
+	}
+	if inputClient == old {
+		t.Error("-sockBuf didn't replace the input client")
+	}
+	if n := fileSize(t, out); n != 1000 {
+		t.Errorf("downloaded %d bytes with -sockBuf, want 1000", n)
+	}
+}
+
+func TestCheckSpaceInodes(t *testing.T) {
+	var freeBytes, freeInodes int64
+	old := fsFreeOf
+	fsFreeOf = func(dir string) (free, files, ffree int64, err error) {
+		return freeBytes, 1000, freeInodes, nil
+	}
+	t.Cleanup(func() { fsFreeOf = old })
+
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 1000))
+	var transfers []*Transfer
+	for i := 1; i <= 3; i++ {
+		tr := newTestTransfer(in, filepath.Join(dir, "part"+strconv.Itoa(i)))
+		tr.Index = i
+		transfers = append(transfers, tr)
+	}
+
+	freeBytes, freeInodes = 1<<30, 0
+	if err := checkSpace(transfers); err == nil || !strings.Contains(err.Error(), "not enough inodes for the outputs") ||
+		!strings.Contains(err.Error(), "need 3, 0 free") {
+		t.Errorf("no free inodes gave %v", err)
+	}
+	freeInodes = 3
+	if err := checkSpace(transfers); err != nil {
+		t.Errorf("3 outputs with 3 free inodes: %v", err)
+	}
+	freeBytes = 2999
+	if err := checkSpace(transfers); err == nil || !strings.Contains(err.Error(), "need 3000 bytes, 2999 free") {
+		t.Errorf("too little space gave %v", err)
+	}
+}
+
+func TestProgressSocket(t *testing.T) {
+	// t.TempDir can exceed the length limit of a socket path
+	dir, err := os.MkdirTemp("", "ddm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "p.sock")
+
+	in := writeTestFile(t, dir, "in", make([]byte, 4096))
+	tr := newTestTransfer(in, filepath.Join(dir, "out"))
+	l, err := listenProgress(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		serveProgress(l, []*Transfer{tr}, done)
+		close(served)
+	}()
+
+	// every client gets the events
+	var clients []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, bufio.NewReader(c))
+	}
+	for i, r := range clients {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		var ev progressEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Fatalf("client %d: %q: %v", i, line, err)
+		}
+		if ev.Done || len(ev.Transfers) != 1 || ev.Transfers[0].Input != in {
+			t.Errorf("client %d: event %+v", i, ev)
+		}
+	}
+
+	// when the transfers finish the clients get a last event and EOF
+	close(done)
+	<-served
+	for i, r := range clients {
+		var last progressEvent
+		for {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("client %d: %v", i, err)
+			}
+			json.Unmarshal(line, &last)
+		}
+		if !last.Done {
+			t.Errorf("client %d: last event %+v", i, last)
+		}
+	}
+	if _, err := net.Dial("unix", sock); err == nil {
+		t.Error("socket still accepts clients")
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	in := writeTestFile(t, t.TempDir(), "in", []byte("data"))
+	f, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := checkReadOnly(f); err != nil {
+		t.Errorf("read-only input: %v", err)
+	}
+
+	// an opener that got the flags wrong is caught
+	fakeOpen(t, func(open func(string, int, os.FileMode) (*os.File, error), name string, flag int, perm os.FileMode) (*os.File, error) {
+		return open(name, flag&^os.O_RDONLY|os.O_RDWR, perm)
+	})
+	readonlyInputs = true
+	t.Cleanup(func() { readonlyInputs = false })
+	if f, err := openInput(in, 0); err == nil || !strings.Contains(err.Error(), "open for writing") {
+		t.Errorf("input opened for writing: %v", err)
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func TestFDNames(t *testing.T) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the child gets inR as fd 3 and outW as fd 4
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DD_MULTI_ARGS="+strings.Join([]string{"-status", "none", "-numTransfers", "1", "-if1", "fd:3", "-of1", "fd:4"}, "\n"))
+	cmd.ExtraFiles = []*os.File{inR, outW}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	inR.Close()
+	outW.Close()
+
+	data := bytes.Repeat([]byte("through a pipe\n"), 10000)
+	go func() {
+		inW.Write(data)
+		inW.Close()
+	}()
+	got, err := io.ReadAll(outR)
+	outR.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes of %d through fd:4: %v", len(got), len(data), err)
+	}
+
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", []byte("data"))
+	for _, tc := range []struct{ in, out, msg string }{
+		{"fd:9", filepath.Join(dir, "out"), "file descriptor 9 is not open"},
+		{in, "fd:0", "file descriptor 0 is not open for writing"},
+		{"fd:x", filepath.Join(dir, "out"), "invalid file descriptor"},
+	} {
+		code, _, stderr := runMain(t, "-status", "none", "-numTransfers", "1", "-if1", tc.in, "-of1", tc.out)
+		if code == 0 || !strings.Contains(stderr, tc.msg) {
+			t.Errorf("-if1 %s -of1 %s: exit %d\n%s", tc.in, tc.out, code, stderr)
+		}
+	}
+}
+
+// startMain starts dd-multi with args in a child process, like runMain,
+// and returns it running with its stderr collected in the buffer
+func startMain(t *testing.T, args ...string) (*exec.Cmd, *bytes.Buffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DD_MULTI_ARGS="+strings.Join(args, "\n"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, &stderr
+}
+
+// waitSize waits until the file at path holds at least n bytes
+func waitSize(t *testing.T, path string, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if fi, err := os.Stat(path); err == nil && fi.Size() >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never reached %d bytes", path, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotSignal(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestFile(t, dir, "in", make([]byte, 1<<20))
+	out := filepath.Join(dir, "out")
+	// about a second, most of it left when the signal arrives
+	cmd, stderr := startMain(t, "-status", "none", "-numTransfers", "1", "-if1", in, "-of1", out, "-bwlimit1", "1M")
+	waitSize(t, out, 100<<10)
+	if err := cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+	if !regexp.MustCompile(`#1 .* --> .*: \d+ bytes \([0-9.]+ MB\) copied, [0-9.]+ s, [0-9.]+ MB/s\n`).MatchString(stderr.String()) {
+		t.Errorf("no snapshot on SIGUSR1:\n%s", stderr.String())
+	}
+	if n := fileSize(t, out); n != 1<<20 {
+		t.Errorf("the copy went on to %d bytes, want %d", n, 1<<20)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	in := writeTestFile(t, dir, "in", data)
+	out := filepath.Join(dir, "out")
+	state := filepath.Join(dir, "state.json")
+	cmd, stderr := startMain(t, "-status", "none", "-checkpoint", state, "-checkpointInterval", "50ms",
+		"-numTransfers", "1", "-if1", in, "-of1", out, "-bwlimit1", "1M")
+	waitSize(t, out, 200<<10)
+	cmd.Process.Signal(syscall.SIGINT)
+	if err := cmd.Wait(); err == nil {
+		t.Fatalf("interrupted run exited 0\n%s", stderr.String())
+	}
+	saved, err := readCheckpoint(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := saved[1]
+	if c.Offset < 200<<10 || c.Offset >= 1<<20 || c.Done {
+		t.Fatalf("checkpoint after the interruption: %+v", c)
+	}
+	// the checkpoint, not the output's size, says where to go on
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 1000))
+	f.Close()
+
+	code, _, errOut := runMain(t, "-resume="+state, "-numTransfers", "1", "-if1", in, "-of1", out)
+	if code != 0 {
+		t.Fatalf("exit %d\n%s", code, errOut)
+	}
+	if !strings.Contains(errOut, fmt.Sprintf("(resumed after %d bytes)", c.Offset)) {
+		t.Errorf("not resumed after the checkpoint's %d bytes:\n%s", c.Offset, errOut)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Error("resumed output differs from the input")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/bjensen91/dd-multi
+
+go 1.21